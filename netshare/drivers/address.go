@@ -0,0 +1,222 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ShareAddress is a parsed share location.  Besides URLs such as nfs://[fd00::1]:2049/export/path,
+// smb://host/share/sub and ceph://mon1,mon2:6789/path the legacy forms host/path, host:/path,
+// host:export and mon1,mon2:6789:/path are accepted.
+type ShareAddress struct {
+	Scheme string
+	Hosts  []string
+	Port   int
+	// Path is the export (NFS, Ceph) or the share name (CIFS)
+	Path string
+	// SubPath is the directory below a CIFS share
+	SubPath string
+}
+
+var shareSchemes = map[string]DriverType{
+	"nfs":  NFS,
+	"nfs4": NFS,
+	"smb":  CIFS,
+	"cifs": CIFS,
+	"efs":  EFS,
+	"ceph": CEPH,
+}
+
+// ParseShareAddress parses a share for the given driver type
+func ParseShareAddress(share string, dt DriverType) (*ShareAddress, error) {
+	a := &ShareAddress{Scheme: dt.String()}
+	rest := share
+
+	var authority string
+	if i := strings.Index(share, "://"); i > 0 {
+		scheme := strings.ToLower(share[:i])
+		if t, ok := shareSchemes[scheme]; !ok || t != dt {
+			return nil, fmt.Errorf("share %s: scheme %s is not supported by the %s driver", share, scheme, dt)
+		}
+		a.Scheme = scheme
+		rest = share[i+3:]
+		authority, rest = splitAuthority(rest)
+	} else {
+		rest = strings.TrimPrefix(rest, "//")
+		// legacy host:/path, which is also how an unbracketed IPv6 address can be given
+		if i := strings.Index(rest, ":/"); i > 0 && !strings.Contains(rest[:i], "/") {
+			authority, rest = rest[:i], rest[i+1:]
+		} else {
+			authority, rest = splitAuthority(rest)
+			// legacy host:export, the text after a single colon is the export unless it is a port
+			if i := strings.Index(authority, ":"); i > 0 && strings.Count(authority, ":") == 1 && !strings.Contains(authority, "[") {
+				if _, err := strconv.Atoi(authority[i+1:]); err != nil && authority[i+1:] != "" {
+					authority, rest = authority[:i], authority[i+1:]+rest
+				}
+			}
+		}
+	}
+
+	if authority == "" {
+		return nil, fmt.Errorf("share %s: missing host", share)
+	}
+	if err := a.parseHosts(authority); err != nil {
+		return nil, fmt.Errorf("share %s: %s", share, err.Error())
+	}
+
+	a.Path = path.Clean("/" + rest)
+	if dt == CIFS {
+		elems := strings.SplitN(strings.TrimPrefix(a.Path, "/"), "/", 2)
+		if elems[0] == "" {
+			return nil, fmt.Errorf("share %s: missing share name", share)
+		}
+		a.Path = elems[0]
+		if len(elems) > 1 {
+			a.SubPath = elems[1]
+		}
+	}
+	return a, nil
+}
+
+// splitAuthority splits at the first slash which is not part of a bracketed IPv6 address
+func splitAuthority(s string) (string, string) {
+	inBrackets := false
+	for i, c := range s {
+		switch c {
+		case '[':
+			inBrackets = true
+		case ']':
+			inBrackets = false
+		case '/':
+			if !inBrackets {
+				return s[:i], s[i:]
+			}
+		}
+	}
+	return s, "/"
+}
+
+// parseHosts parses a comma separated host list where each host may carry a port.  All ports must
+// agree since a mount has a single port option.
+func (a *ShareAddress) parseHosts(authority string) error {
+	for _, h := range strings.Split(authority, ",") {
+		host, port, err := splitHostPort(h)
+		if err != nil {
+			return err
+		}
+		if port != 0 {
+			if a.Port != 0 && a.Port != port {
+				return fmt.Errorf("hosts use different ports (%d, %d)", a.Port, port)
+			}
+			a.Port = port
+		}
+		a.Hosts = append(a.Hosts, host)
+	}
+	return nil
+}
+
+func splitHostPort(h string) (string, int, error) {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return "", 0, fmt.Errorf("empty host")
+	}
+	if strings.HasPrefix(h, "[") {
+		end := strings.Index(h, "]")
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing ] in %s", h)
+		}
+		host, rest := h[1:end], h[end+1:]
+		if rest == "" {
+			return host, 0, nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", 0, fmt.Errorf("unexpected %s after %s", rest, h[:end+1])
+		}
+		port, err := parsePort(rest[1:])
+		return host, port, err
+	}
+	switch strings.Count(h, ":") {
+	case 0:
+		return h, 0, nil
+	case 1:
+		i := strings.Index(h, ":")
+		port, err := parsePort(h[i+1:])
+		return h[:i], port, err
+	default:
+		// bare IPv6 address
+		if net.ParseIP(h) == nil {
+			return "", 0, fmt.Errorf("invalid host %s", h)
+		}
+		return h, 0, nil
+	}
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %s", s)
+	}
+	return p, nil
+}
+
+// Host returns the first host
+func (a *ShareAddress) Host() string {
+	return a.Hosts[0]
+}
+
+// NfsSource returns the host:/path form mount.nfs expects for one of the hosts
+func (a *ShareAddress) NfsSource(host string) string {
+	return bracketHost(host) + ":" + a.Path
+}
+
+// CifsSource returns the //host/share/sub UNC path
+func (a *ShareAddress) CifsSource() string {
+	s := "//" + bracketHost(a.Host()) + "/" + a.Path
+	if a.SubPath != "" {
+		s = s + "/" + a.SubPath
+	}
+	return s
+}
+
+// CephSource returns the mon1:port,mon2:port:/path form mount.ceph expects
+func (a *ShareAddress) CephSource(defaultPort string) string {
+	port := defaultPort
+	if a.Port != 0 {
+		port = strconv.Itoa(a.Port)
+	}
+	mons := make([]string, len(a.Hosts))
+	for i, h := range a.Hosts {
+		mons[i] = bracketHost(h)
+		if port != "" {
+			mons[i] = mons[i] + ":" + port
+		}
+	}
+	return strings.Join(mons, ",") + ":" + a.Path
+}
+
+// String returns the address in URL form
+func (a *ShareAddress) String() string {
+	hosts := make([]string, len(a.Hosts))
+	for i, h := range a.Hosts {
+		hosts[i] = bracketHost(h)
+	}
+	s := a.Scheme + "://" + strings.Join(hosts, ",")
+	if a.Port != 0 {
+		s = s + ":" + strconv.Itoa(a.Port)
+	}
+	s = s + "/" + strings.TrimPrefix(a.Path, "/")
+	if a.SubPath != "" {
+		s = s + "/" + a.SubPath
+	}
+	return s
+}
+
+func bracketHost(h string) string {
+	if strings.Contains(h, ":") {
+		return "[" + h + "]"
+	}
+	return h
+}
@@ -0,0 +1,84 @@
+package drivers
+
+import "testing"
+
+func TestParseShareAddressLegacyForms(t *testing.T) {
+	tests := []struct {
+		share string
+		want  string
+	}{
+		{"server/data", "nfs://server/data"},
+		{"server:/data", "nfs://server/data"},
+		{"server:data", "nfs://server/data"},
+		{"server:data/sub", "nfs://server/data/sub"},
+		{"server:2049/data", "nfs://server:2049/data"},
+		{"nfs1,nfs2:export/sub", "nfs://nfs1,nfs2/export/sub"},
+		{"fd00::1/data", "nfs://[fd00::1]/data"},
+		{"[fd00::1]:2049/data", "nfs://[fd00::1]:2049/data"},
+		{"nfs://server:2049/data", "nfs://server:2049/data"},
+	}
+	for _, tt := range tests {
+		a, err := ParseShareAddress(tt.share, NFS)
+		if err != nil {
+			t.Errorf("ParseShareAddress(%q): %s", tt.share, err)
+			continue
+		}
+		if got := a.String(); got != tt.want {
+			t.Errorf("ParseShareAddress(%q) = %s, want %s", tt.share, got, tt.want)
+		}
+	}
+}
+
+func TestParseShareAddressRejectsURLWithInvalidPort(t *testing.T) {
+	if _, err := ParseShareAddress("nfs://server:data/x", NFS); err == nil {
+		t.Error("expected an error for a non-numeric port in a URL")
+	}
+}
+
+func TestParseShareAddressURLs(t *testing.T) {
+	a, err := ParseShareAddress("nfs://[fd00::1]:2049/export/path", NFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Host() != "fd00::1" || a.Port != 2049 || a.Path != "/export/path" {
+		t.Errorf("nfs URL = %+v", a)
+	}
+	if src := a.NfsSource(a.Host()); src != "[fd00::1]:/export/path" {
+		t.Errorf("NfsSource = %s, want [fd00::1]:/export/path", src)
+	}
+
+	a, err = ParseShareAddress("smb://host/share/sub", CIFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Host() != "host" || a.Path != "share" || a.SubPath != "sub" {
+		t.Errorf("smb URL = %+v, want share share and sub-path sub", a)
+	}
+	if src := a.CifsSource(); src != "//host/share/sub" {
+		t.Errorf("CifsSource = %s, want //host/share/sub", src)
+	}
+	if _, err := ParseShareAddress("smb://host/", CIFS); err == nil {
+		t.Error("expected an error for a CIFS URL without a share")
+	}
+
+	a, err = ParseShareAddress("ceph://mon1,mon2:6789/path", CEPH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Hosts) != 2 || a.Port != 6789 || a.Path != "/path" {
+		t.Errorf("ceph URL = %+v", a)
+	}
+	if src := a.CephSource(""); src != "mon1:6789,mon2:6789:/path" {
+		t.Errorf("CephSource = %s, want mon1:6789,mon2:6789:/path", src)
+	}
+	// the monitors' port defaults to the one given to the driver
+	a, _ = ParseShareAddress("ceph://mon1,mon2/path", CEPH)
+	if src := a.CephSource("3300"); src != "mon1:3300,mon2:3300:/path" {
+		t.Errorf("CephSource = %s, want the default port", src)
+	}
+
+	// a scheme of another driver is refused
+	if _, err := ParseShareAddress("smb://host/share", NFS); err == nil {
+		t.Error("expected an error for an smb URL given to NFS")
+	}
+}
@@ -10,13 +10,17 @@ import (
 )
 
 const (
-	CephOptions = "cephopts"
+	CephOptions       = "cephopts"
+	CephNameOpt       = "name"
+	CephSecretFileOpt = "secretfile"
 )
 
 type cephDriver struct {
 	volumeDriver
 	username   string
-	password   string
+	secret     string
+	secretref  string
+	secretfile string
 	context    string
 	cephmount  string
 	cephport   string
@@ -24,11 +28,15 @@ type cephDriver struct {
 	cephopts   map[string]string
 }
 
-func NewCephDriver(root string, username string, password string, context string, cephmount string, cephport string, localmount string, cephopts string, mounts *MountManager) cephDriver {
+// NewCephDriver creates the Ceph driver.  username is the cephx client volumes mount as unless they set
+// name, its key comes from secretfile, secretref, secret or the client's keyring.
+func NewCephDriver(root string, username string, secret string, secretref string, secretfile string, context string, cephmount string, cephport string, localmount string, cephopts string, mounts *MountManager) cephDriver {
 	d := cephDriver{
 		volumeDriver: newVolumeDriver(root, mounts),
 		username:     username,
-		password:     password,
+		secret:       secret,
+		secretref:    secretref,
+		secretfile:   secretfile,
 		context:      context,
 		cephmount:    cephmount,
 		cephport:     cephport,
@@ -46,12 +54,14 @@ func (n cephDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error)
 	log.Debugf("Entering Mount: %v", r)
 	n.m.Lock()
 	defer n.m.Unlock()
-	hostdir := mountpoint(n.root, r.Name)
-	source := n.fixSource(r.Name, r.ID)
-	if n.mountm.HasMount(r.Name) && n.mountm.Count(r.Name) > 0 {
-		log.Infof("Using existing CEPH volume mount: %s", hostdir)
-		n.mountm.Increment(r.Name)
-		return &volume.MountResponse{Mountpoint: hostdir}, nil
+
+	resolvedName, resOpts, hostdir := n.resolveVolume(r.Name)
+	source, err := n.fixSource(resolvedName, resOpts)
+	if err != nil {
+		return nil, err
+	}
+	if n.existingMount(resolvedName, hostdir) {
+		return n.mountResponse(resolvedName, hostdir)
 	}
 
 	log.Infof("Mounting CEPH volume %s on %s", source, hostdir)
@@ -59,11 +69,20 @@ func (n cephDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error)
 		return nil, err
 	}
 
-	if err := n.mountVolume(r.Name, source, hostdir); err != nil {
+	if err := n.mountVolume(resolvedName, source, hostdir); err != nil {
 		return nil, err
 	}
-	n.mountm.Add(r.Name, hostdir)
-	return &volume.MountResponse{Mountpoint: hostdir}, nil
+	n.addMount(resolvedName, hostdir, resOpts)
+	return n.mountResponse(resolvedName, hostdir)
+}
+
+func (n cephDriver) mountResponse(name, hostdir string) (*volume.MountResponse, error) {
+	dir, err := n.volumeDir(name, hostdir, false)
+	if err != nil {
+		n.mountm.Decrement(name)
+		return nil, err
+	}
+	return &volume.MountResponse{Mountpoint: dir}, nil
 }
 
 func (n cephDriver) Unmount(r *volume.UnmountRequest) error {
@@ -71,24 +90,20 @@ func (n cephDriver) Unmount(r *volume.UnmountRequest) error {
 
 	n.m.Lock()
 	defer n.m.Unlock()
-	hostdir := mountpoint(n.root, r.Name)
 
-	if n.mountm.HasMount(r.Name) {
-		if n.mountm.Count(r.Name) > 1 {
-			log.Printf("Skipping unmount for %s - in use by other containers", r.Name)
-			n.mountm.Decrement(r.Name)
-			return nil
-		}
-		n.mountm.Decrement(r.Name)
+	resolvedName, _, hostdir := n.resolveVolume(r.Name)
+
+	if n.releaseMount(resolvedName) {
+		return nil
 	}
 
-	log.Infof("Unmounting volume name %s from %s", r.Name, hostdir)
+	log.Infof("Unmounting volume name %s from %s", resolvedName, hostdir)
 
 	if err := run(fmt.Sprintf("umount %s", hostdir)); err != nil {
 		return err
 	}
 
-	n.mountm.DeleteIfNotManaged(r.Name)
+	n.mountm.DeleteIfNotManaged(resolvedName)
 
 	if err := os.RemoveAll(hostdir); err != nil {
 		return err
@@ -97,38 +112,108 @@ func (n cephDriver) Unmount(r *volume.UnmountRequest) error {
 	return nil
 }
 
-func (n cephDriver) fixSource(name, id string) string {
-	if n.mountm.HasOption(name, ShareOpt) {
-		return n.mountm.GetOption(name, ShareOpt)
+func (n cephDriver) fixSource(name string, resOpts map[string]string) (string, error) {
+	addr, err := ParseShareAddress(n.volumeShare(name, resOpts), CEPH)
+	if err != nil {
+		return "", err
 	}
-	source := strings.Split(name, "/")
-	source[0] = source[0] + ":" + n.cephport + ":"
-	return strings.Join(source, "/")
+	return addr.CephSource(n.cephport), nil
 }
 
 func (n cephDriver) mountVolume(name, source, dest string) error {
-	var cmd string
-
 	options := n.mountOptions(n.mountm.GetOptions(name))
-	opts := ""
-	if val, ok := options[CephOptions]; ok {
-		fmt.Println("opts = ", val)
-		opts = "-o " + val
+	user := n.username
+	if v := options[CephNameOpt]; v != "" {
+		user = v
+	}
+	if strings.ContainsAny(user, ",/ ") {
+		return fmt.Errorf("invalid ceph client name %q", user)
+	}
+	secretfile, cleanup, err := n.secretFile(user, options)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	opts := []string{}
+	if n.context != "" {
+		opts = append(opts, n.context)
+	}
+	if user != "" {
+		opts = append(opts, "name="+user)
+	}
+	if secretfile != "" {
+		opts = append(opts, "secretfile="+secretfile)
+	}
+	if val := options[CephOptions]; val != "" {
+		opts = append(opts, val)
 	}
 
 	mountCmd := "mount"
 
 	if log.GetLevel() == log.DebugLevel {
-		mountCmd = mountCmd + " -t ceph"
+		mountCmd = mountCmd + " -v"
 	}
 
-	//cmd = fmt.Sprintf("%s -t ceph %s:%s:/ -o %s,%s,%s %s %s", mountCmd, n.cephmount, n.cephport, n.context, n.username, n.password, opts, dest)
-	cmd = fmt.Sprintf("%s -t ceph %s -o %s,%s,%s %s %s", mountCmd, source, n.context, n.username, n.password, opts, dest)
-
-	log.Debugf("exec: %s\n", strings.Replace(cmd, ","+n.password, ",****", 1))
+	cmd := fmt.Sprintf("%s -t ceph %s -o %s %s", mountCmd, source, strings.Join(opts, ","), dest)
+	log.Debugf("exec: %s\n", cmd)
 	return run(cmd)
 }
 
+// secretFile returns the file mount.ceph reads the cephx key of user from, so the key never is on a
+// command line: the volume's secretfile or secretref, the daemon's --secretfile, --secretref or --secret
+// when user is the daemon's client, or the key from the client's keyring.  Keys found elsewhere than in a
+// secretfile are written to a temporary file, which cleanup removes once mounted.  Without a key the
+// mount goes ahead without one, e.g. for clusters without cephx.
+func (n cephDriver) secretFile(user string, options map[string]string) (string, func(), error) {
+	none := func() {}
+	if path := options[CephSecretFileOpt]; path != "" {
+		if strings.ContainsAny(path, ", ") {
+			return "", none, fmt.Errorf("invalid %s %q", CephSecretFileOpt, path)
+		}
+		return path, none, nil
+	}
+
+	secret, err := optionSecret(options, "", "")
+	if err != nil {
+		return "", none, err
+	}
+	if secret == "" && user == n.username {
+		switch {
+		case n.secretfile != "":
+			return n.secretfile, none, nil
+		case n.secretref != "":
+			secret, err = resolveSecretRef(n.secretref)
+		default:
+			secret = n.secret
+		}
+		if err != nil {
+			return "", none, err
+		}
+	}
+	if secret == "" && user != "" {
+		keyring := ""
+		if secret, keyring, err = cephKeyringKey(user); err != nil {
+			return "", none, err
+		}
+		if secret != "" {
+			log.Debugf("Using the key of client.%s from %s", user, keyring)
+		}
+	}
+	if secret == "" {
+		return "", none, nil
+	}
+	if strings.ContainsAny(secret, "\r\n") {
+		return "", none, fmt.Errorf("the ceph key of client.%s must be a single line", user)
+	}
+
+	path, err := writeCredentialsFile(n.root, "ceph", secret+"\n")
+	if err != nil {
+		return "", none, err
+	}
+	return path, func() { os.Remove(path) }, nil
+}
+
 func (n cephDriver) mountOptions(src map[string]string) map[string]string {
 	if len(n.cephopts) == 0 && len(src) == 0 {
 		return EmptyMap
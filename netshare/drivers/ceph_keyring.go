@@ -0,0 +1,75 @@
+package drivers
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// CephConfigDir holds the keyrings of cephx clients, ceph.client.<name>.keyring
+	CephConfigDir = "/etc/ceph"
+)
+
+// cephKeyrings returns the keyrings searched for the key of client.<name>, in the order the ceph tools
+// use
+func cephKeyrings(name string) []string {
+	return []string{
+		filepath.Join(CephConfigDir, fmt.Sprintf("ceph.client.%s.keyring", name)),
+		filepath.Join(CephConfigDir, "ceph.keyring"),
+		filepath.Join(CephConfigDir, "keyring"),
+	}
+}
+
+// cephKeyringKey returns the key of client.<name> and the keyring it came from, the key is "" when no
+// keyring has it
+func cephKeyringKey(name string) (string, string, error) {
+	for _, path := range cephKeyrings(name) {
+		key, err := readKeyring(path, "client."+name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if key != "" {
+			return key, path, nil
+		}
+	}
+	return "", "", nil
+}
+
+// readKeyring returns the key of entity from a keyring file:
+//
+//	[client.admin]
+//		key = AQBSdFhd...==
+func readKeyring(path, entity string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if section == entity && len(kv) == 2 && strings.TrimSpace(kv[0]) == "key" {
+			return strings.TrimSpace(kv[1]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("error reading keyring %s: %s", path, err.Error())
+	}
+	return "", nil
+}
@@ -3,10 +3,9 @@ package drivers
 import (
 	"bytes"
 	"fmt"
-	"path/filepath"
+	"os"
 	"strings"
 
-	"github.com/dickeyxxx/netrc"
 	"github.com/docker/go-plugins-helpers/volume"
 	log "github.com/sirupsen/logrus"
 )
@@ -25,128 +24,178 @@ const (
 // CifsDriver driver structure
 type CifsDriver struct {
 	volumeDriver
-	creds    *CifsCreds
-	netrc    *netrc.Netrc
-	cifsopts map[string]string
+	creds      *CifsCreds
+	envCreds   *CifsCreds
+	netrc      *netrcFile
+	cifsopts   map[string]string
+	smbversion string
+	shares     *shareManager
+	krb        *kerberos
+	tenants    *cifsTenants
+	rotation   *credentialWatch
+	// owners holds the uid/gid mount options of volumes mounted with the uid or gid option
+	owners map[string]string
 }
 
 // CifsCreds contains Options for cifs-mount
 type CifsCreds struct {
-	user     string
-	pass     string
-	domain   string
-	security string
-	fileMode string
-	dirMode  string
+	user      string
+	pass      string
+	domain    string
+	security  string
+	fileMode  string
+	dirMode   string
+	keytab    string
+	principal string
+	// secretref is resolved to the password whenever the credentials are looked up
+	secretref string
 }
 
 func (creds *CifsCreds) String() string {
-	return fmt.Sprintf("creds: { user=%s,pass=****,domain=%s,security=%s, fileMode=%s, dirMode=%s}", creds.user, creds.domain, creds.security, creds.fileMode, creds.dirMode)
+	return fmt.Sprintf("creds: { user=%s,pass=****,domain=%s,security=%s, fileMode=%s, dirMode=%s, principal=%s}", creds.user, creds.domain, creds.security, creds.fileMode, creds.dirMode, creds.principal)
 }
 
 // NewCifsCredentials setting the credentials
-func NewCifsCredentials(user, pass, domain, security, fileMode, dirMode string) *CifsCreds {
-	return &CifsCreds{user: user, pass: pass, domain: domain, security: security, fileMode: fileMode, dirMode: dirMode}
+func NewCifsCredentials(user, pass, domain, security, fileMode, dirMode, keytab, principal, secretref string) *CifsCreds {
+	return &CifsCreds{user: user, pass: pass, domain: domain, security: security, fileMode: fileMode, dirMode: dirMode, keytab: keytab, principal: principal, secretref: secretref}
 }
 
-// NewCIFSDriver creating the cifs driver
-func NewCIFSDriver(root string, creds *CifsCreds, netrc, cifsopts string, mounts *MountManager) CifsDriver {
+// NewCIFSDriver creating the cifs driver.  creds are taken from the daemon flags and envCreds from the
+// environment, see credentialChain for the lookup order.
+func NewCIFSDriver(root string, creds, envCreds *CifsCreds, netrc, cifsopts, smbversion string, sharemounts bool, mounts *MountManager) CifsDriver {
 	d := CifsDriver{
 		volumeDriver: newVolumeDriver(root, mounts),
 		creds:        creds,
-		netrc:        parseNetRC(netrc),
+		envCreds:     envCreds,
+		netrc:        newNetrcFile(netrc),
 		cifsopts:     map[string]string{},
+		smbversion:   smbversion,
+		krb:          newKerberos(root),
+		tenants:      newCifsTenants(),
+		rotation:     newCredentialWatch(),
+		owners:       map[string]string{},
 	}
 	if len(cifsopts) > 0 {
 		d.cifsopts[CifsOpts] = cifsopts
 	}
-	return d
-}
-
-func parseNetRC(path string) *netrc.Netrc {
-	if n, err := netrc.Parse(filepath.Join(path, ".netrc")); err == nil {
-		return n
-	} else {
-		log.Warnf("Error: %s", err.Error())
+	if sharemounts {
+		d.shares = newShareManager(root)
 	}
-	return nil
+	go d.watchCredentials(CredentialCheckInterval)
+	return d
 }
 
 // Mount do the mounting
 func (c CifsDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
 	c.m.Lock()
 	defer c.m.Unlock()
-	hostdir := mountpoint(c.root, r.Name)
-	source := c.fixSource(r.Name)
-	host := c.parseHost(r.Name)
 
-	resolvedName, resOpts := resolveName(r.Name)
+	resolvedName, resOpts, hostdir := c.resolveVolume(r.Name)
 
 	log.Infof("Mount: %s, ID: %s", r.Name, r.ID)
 
 	// Support adhoc mounts (outside of docker volume create)
 	// need to adjust source for ShareOpt
-	if resOpts != nil {
-		if share, found := resOpts[ShareOpt]; found {
-			source = c.fixSource(share)
-		}
+	source, err := c.shareAddress(resolvedName, resOpts)
+	if err != nil {
+		return nil, err
 	}
 
-	if c.mountm.HasMount(r.Name) && c.mountm.Count(r.Name) > 0 {
-		log.Infof("Using existing CIFS volume mount: %s", hostdir)
-		c.mountm.Increment(r.Name)
-		if err := run(fmt.Sprintf("mountpoint -q %s", hostdir)); err != nil {
-			log.Infof("Existing CIFS volume not mounted, force remount.")
-		} else {
-			return &volume.MountResponse{Mountpoint: hostdir}, nil
+	multiuser := c.mountm.GetOptionAsBool(resolvedName, MultiuserOpt)
+	if multiuser {
+		if err := c.tenants.Attach(r.ID, r.Name, resolvedName, source); err != nil {
+			return nil, err
 		}
 	}
 
+	owner, err := c.mountOwner(r.Name, resolvedName)
+	if err != nil {
+		c.tenants.Detach(r.ID)
+		return nil, err
+	}
+
+	if mounted, found := c.owners[resolvedName]; found && c.mountm.Count(resolvedName) > 0 && mounted != owner {
+		c.tenants.Detach(r.ID)
+		return nil, fmt.Errorf("volume %s is already mounted with %s for another container, it can't be mounted with %s", resolvedName, mounted, owner)
+	}
+
+	if c.existingMount(resolvedName, hostdir) {
+		c.setTenantStatus(resolvedName, multiuser)
+		return c.mountResponse(resolvedName, hostdir)
+	}
+
 	log.Infof("Mounting CIFS volume %s on %s", source, hostdir)
 
 	if err := createDest(hostdir); err != nil {
+		c.tenants.Detach(r.ID)
 		return nil, err
 	}
 
-	if err := c.mountVolume(r.Name, source, hostdir, c.getCreds(host)); err != nil {
+	creds, credSource, err := c.getCreds(resolvedName, source)
+	if err != nil {
+		c.tenants.Detach(r.ID)
+		return nil, err
+	}
+	if owner != "" {
+		c.owners[resolvedName] = owner
+	}
+	if err := c.probeShare(resolvedName, source, creds); err != nil {
+		c.tenants.Detach(r.ID)
+		return nil, err
+	}
+	if err := c.mountSource(resolvedName, source, hostdir, creds); err != nil {
+		c.tenants.Detach(r.ID)
 		return nil, err
 	}
-	c.mountm.Add(r.Name, hostdir)
+	c.addMount(resolvedName, hostdir, resOpts)
+	c.mountm.SetStatus(resolvedName, StatusCredentials, credSource)
+	c.rotation.Set(resolvedName, creds)
+	c.mountm.DeleteStatus(resolvedName, StatusRotation)
+	if owner != "" {
+		c.mountm.SetStatus(resolvedName, StatusOwner, owner)
+	}
+	c.setTenantStatus(resolvedName, multiuser)
+	c.recordDialect(resolvedName, hostdir)
 
-	if c.mountm.GetOption(resolvedName, ShareOpt) != "" && c.mountm.GetOptionAsBool(resolvedName, CreateOpt) {
-		log.Infof("Mount: Share and Create options enabled - using %s as sub-dir mount", resolvedName)
-		datavol := filepath.Join(hostdir, resolvedName)
-		if err := createDest(filepath.Join(hostdir, resolvedName)); err != nil {
-			return nil, err
-		}
-		hostdir = datavol
+	return c.mountResponse(resolvedName, hostdir)
+}
+
+func (c CifsDriver) mountResponse(name, hostdir string) (*volume.MountResponse, error) {
+	dir, err := c.volumeDir(name, hostdir, c.shares != nil)
+	if err != nil {
+		c.mountm.Decrement(name)
+		return nil, err
 	}
-	return &volume.MountResponse{Mountpoint: hostdir}, nil
+	return &volume.MountResponse{Mountpoint: dir}, nil
 }
 
 // Unmount do the unmounting
 func (c CifsDriver) Unmount(r *volume.UnmountRequest) error {
 	c.m.Lock()
 	defer c.m.Unlock()
-	hostdir := mountpoint(c.root, r.Name)
-	source := c.fixSource(r.Name)
 
-	if c.mountm.HasMount(r.Name) {
-		if c.mountm.Count(r.Name) > 1 {
-			log.Infof("Skipping unmount for %s - in use by other containers", r.Name)
-			c.mountm.Decrement(r.Name)
-			return nil
-		}
-		c.mountm.Decrement(r.Name)
+	resolvedName, _, hostdir := c.resolveVolume(r.Name)
+
+	c.tenants.Detach(r.ID)
+	if c.releaseMount(resolvedName) {
+		c.setTenantStatus(resolvedName, c.mountm.GetOptionAsBool(resolvedName, MultiuserOpt))
+		return nil
 	}
 
-	log.Infof("Unmounting volume %s from %s", source, hostdir)
+	log.Infof("Unmounting volume %s from %s", resolvedName, hostdir)
 
-	if err := run(fmt.Sprintf("umount %s", hostdir)); err != nil {
+	if c.shares != nil {
+		if err := c.shares.Unmount(resolvedName, hostdir); err != nil {
+			return err
+		}
+	} else if err := run(fmt.Sprintf("umount %s", hostdir)); err != nil {
 		return err
 	}
 
-	c.mountm.DeleteIfNotManaged(r.Name)
+	c.rotation.Delete(resolvedName)
+	c.mountm.DeleteStatus(resolvedName, StatusRotation)
+	delete(c.owners, resolvedName)
+	c.mountm.DeleteIfNotManaged(resolvedName)
 
 	// ToDo:
 	// This is a bad idea.
@@ -160,27 +209,38 @@ func (c CifsDriver) Unmount(r *volume.UnmountRequest) error {
 	return nil
 }
 
-func (c CifsDriver) fixSource(name string) string {
-	if c.mountm.HasOption(name, ShareOpt) {
-		return "//" + c.mountm.GetOption(name, ShareOpt)
+// setTenantStatus reports the tenants of a multiuser volume
+func (c CifsDriver) setTenantStatus(name string, multiuser bool) {
+	if multiuser {
+		c.mountm.SetStatus(name, StatusTenants, c.tenants.Users(name))
 	}
-	return "//" + name
 }
 
-func (c CifsDriver) parseHost(name string) string {
-	n := name
-	if c.mountm.HasOption(name, ShareOpt) {
-		n = c.mountm.GetOption(name, ShareOpt)
+// mountSource mounts the volume on hostdir, either directly or as a bind mount from a shared mount of the
+// share.  Shares are only reused between volumes connecting with the same user and options.
+func (c CifsDriver) mountSource(name string, source *ShareAddress, hostdir string, creds *CifsCreds) error {
+	if c.shares == nil {
+		return c.mountVolume(name, source, hostdir, creds)
 	}
 
-	if strings.ContainsAny(n, "/") {
-		s := strings.Split(n, "/")
-		return s[0]
+	subdir, create := "", false
+	if c.mountm.GetOption(name, ShareOpt) != "" && c.mountm.GetOptionAsBool(name, CreateOpt) {
+		subdir, create = name, true
 	}
-	return n
+	options := merge(c.mountm.GetOptions(name), c.cifsopts)
+	key := shareKey(CIFS.String(), source.String(), creds.user, creds.domain, creds.principal, creds.security, creds.fileMode, creds.dirMode,
+		c.owners[name], optionsKey(options, PasswordOpt, ShareOpt, CreateOpt, UIDOpt, GIDOpt))
+	return c.shares.Mount(name, key, subdir, hostdir, create, func(dest string) error {
+		return c.mountVolume(name, source, dest, creds)
+	})
+}
+
+// shareAddress parses the volume's share, which defaults to the volume name
+func (c CifsDriver) shareAddress(name string, resOpts map[string]string) (*ShareAddress, error) {
+	return ParseShareAddress(c.volumeShare(name, resOpts), CIFS)
 }
 
-func (c CifsDriver) mountVolume(name, source, dest string, creds *CifsCreds) error {
+func (c CifsDriver) mountVolume(name string, source *ShareAddress, dest string, creds *CifsCreds) error {
 	var opts bytes.Buffer
 	var user = creds.user
 	var pass = creds.pass
@@ -188,46 +248,48 @@ func (c CifsDriver) mountVolume(name, source, dest string, creds *CifsCreds) err
 	var security = creds.security
 	var fileMode = creds.fileMode
 	var dirMode = creds.dirMode
+	var env []string
 
 	options := merge(c.mountm.GetOptions(name), c.cifsopts)
 	if val, ok := options[CifsOpts]; ok {
 		opts.WriteString(val + ",")
 	}
 
-	if c.mountm.HasOptions(name) {
-		mopts := c.mountm.GetOptions(name)
-		if v, found := mopts[UsernameOpt]; found {
-			user = v
+	if creds.principal != "" && creds.keytab != "" {
+		ccache, err := c.krb.CCache(creds.principal, creds.keytab)
+		if err != nil {
+			return err
 		}
-		if v, found := mopts[PasswordOpt]; found {
-			pass = v
+		// cifs.upcall looks at the environment of the mounting process first
+		env = append(env, "KRB5CCNAME=FILE:"+ccache)
+		if !strings.HasPrefix(security, "krb5") {
+			security = "krb5"
 		}
-		if v, found := mopts[DomainOpt]; found {
-			domain = v
-		}
-		if v, found := mopts[SecurityOpt]; found {
-			security = v
-		}
-		if v, found := mopts[FileModeOpt]; found {
-			fileMode = v
-		}
-		if v, found := mopts[DirModeOpt]; found {
-			dirMode = v
+	}
+
+	// a multiuser mount connects with the machine account and adds a session per accessing uid from
+	// the credentials cifscreds put in its keyring
+	if c.mountm.GetOptionAsBool(name, MultiuserOpt) {
+		opts.WriteString("multiuser,")
+		if security == "" {
+			security = "ntlmssp"
 		}
 	}
 
-	if user != "" {
-		// escape single quotes in password character as it will be quoted in command line
-		opts.WriteString(fmt.Sprintf("username='%s',", strings.Replace(user, "'", "\\'", -1)))
-		if pass != "" {
-			opts.WriteString(fmt.Sprintf("password='%s',", strings.Replace(pass, "'", "\\'", -1)))
+	if strings.HasPrefix(security, "krb5") {
+		opts.WriteString(fmt.Sprintf("cruid=%d,", os.Getuid()))
+	} else if user != "" {
+		credentials, err := c.writeCredentials(user, pass, domain)
+		if err != nil {
+			return err
 		}
+		defer os.Remove(credentials)
+		opts.WriteString(fmt.Sprintf("credentials=%s,", credentials))
 	} else {
 		opts.WriteString("guest,")
-	}
-
-	if domain != "" {
-		opts.WriteString(fmt.Sprintf("domain=%s,", domain))
+		if domain != "" {
+			opts.WriteString(fmt.Sprintf("domain=%s,", domain))
+		}
 	}
 
 	if security != "" {
@@ -242,28 +304,39 @@ func (c CifsDriver) mountVolume(name, source, dest string, creds *CifsCreds) err
 		opts.WriteString(fmt.Sprintf("dir_mode=%s,", dirMode))
 	}
 
-	opts.WriteString("rw ")
+	if owner := c.owners[name]; owner != "" {
+		opts.WriteString(owner + ",")
+	}
 
-	opts.WriteString(fmt.Sprintf("%s %s", source, dest))
-	cmd := fmt.Sprintf("mount -t cifs -o %s", opts.String())
-	log.Debugf("Executing: %s\n", strings.Replace(cmd, "password='"+pass+"'", "password='****'", 1))
-	return run(cmd)
-}
+	if source.Port != 0 {
+		opts.WriteString(fmt.Sprintf("port=%d,", source.Port))
+	}
+
+	// the UNC keeps the server's name, which Kerberos and the server itself need, and ip= gives the address
+	if ip := resolveHost(source.Host()); ip != source.Host() && !hasMountOption(options[CifsOpts], "ip") && !hasMountOption(options[CifsOpts], "addr") {
+		opts.WriteString(fmt.Sprintf("ip=%s,", ip))
+	}
 
-func (c CifsDriver) getCreds(host string) *CifsCreds {
-	log.Debugf("GetCreds: host=%s, netrc=%v", host, c.netrc)
-	if c.netrc != nil {
-		m := c.netrc.Machine(host)
-		if m != nil {
-			return &CifsCreds{
-				user:     m.Get("username"),
-				pass:     m.Get("password"),
-				domain:   m.Get("domain"),
-				security: m.Get("security"),
-				fileMode: m.Get("fileMode"),
-				dirMode:  m.Get("dirMode"),
-			}
+	opts.WriteString("rw")
+
+	versions := c.smbVersions(options)
+	for i, vers := range versions {
+		o := opts.String()
+		if vers != "" {
+			o = o + ",vers=" + vers
+		}
+		cmd := fmt.Sprintf("mount -t cifs -o %s %s %s", o, source.CifsSource(), dest)
+		log.Debugf("Executing: %s\n", cmd)
+		out, err := runOutput(cmd, env)
+		if err == nil {
+			return nil
 		}
+		if i < len(versions)-1 && isNegotiationError(out) {
+			log.Infof("%s did not accept SMB %s, trying %s", source.Host(), vers, versions[i+1])
+			continue
+		}
+		log.Println(out)
+		return err
 	}
-	return c.creds
+	return nil
 }
@@ -0,0 +1,26 @@
+package drivers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// writeCredentials writes a mount.cifs credentials file readable only by root and returns its path.
+// The caller removes it once the mount is done.
+func (c CifsDriver) writeCredentials(user, pass, domain string) (string, error) {
+	for _, v := range []string{user, pass, domain} {
+		if strings.ContainsAny(v, "\r\n") {
+			return "", errors.New("CIFS credentials must not contain line breaks")
+		}
+	}
+
+	content := fmt.Sprintf("username=%s\n", user)
+	if pass != "" {
+		content += fmt.Sprintf("password=%s\n", pass)
+	}
+	if domain != "" {
+		content += fmt.Sprintf("domain=%s\n", domain)
+	}
+	return writeCredentialsFile(c.root, "cred", content)
+}
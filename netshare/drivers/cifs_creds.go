@@ -0,0 +1,199 @@
+package drivers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dickeyxxx/netrc"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StatusCredentials = "credentials"
+)
+
+// netrcFile is a .netrc which is parsed again whenever it changes on disk
+type netrcFile struct {
+	m       *sync.Mutex
+	path    string
+	modTime time.Time
+	netrc   *netrc.Netrc
+}
+
+func newNetrcFile(dir string) *netrcFile {
+	n := &netrcFile{m: &sync.Mutex{}, path: filepath.Join(dir, ".netrc")}
+	n.reload()
+	return n
+}
+
+func (n *netrcFile) reload() {
+	fi, err := os.Stat(n.path)
+	if err != nil {
+		if n.netrc != nil || n.modTime.IsZero() {
+			log.Warnf("Error: %s", err.Error())
+		}
+		n.netrc, n.modTime = nil, time.Unix(0, 0)
+		return
+	}
+	if fi.ModTime().Equal(n.modTime) {
+		return
+	}
+	if !n.modTime.IsZero() {
+		log.Infof("%s changed, reloading", n.path)
+	}
+	n.modTime = fi.ModTime()
+	if parsed, err := netrc.Parse(n.path); err == nil {
+		n.netrc = parsed
+	} else {
+		log.Warnf("Error: %s", err.Error())
+		n.netrc = nil
+	}
+}
+
+// Machine returns the entry for name, reloading the file first if it changed
+func (n *netrcFile) Machine(name string) *netrc.Machine {
+	if n == nil {
+		return nil
+	}
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.reload()
+	if n.netrc == nil {
+		return nil
+	}
+	return n.netrc.Machine(name)
+}
+
+func credsFromNetrc(m *netrc.Machine) *CifsCreds {
+	return &CifsCreds{
+		user:      m.Get("username"),
+		pass:      m.Get("password"),
+		domain:    m.Get("domain"),
+		security:  m.Get("security"),
+		fileMode:  m.Get("fileMode"),
+		dirMode:   m.Get("dirMode"),
+		keytab:    m.Get(KeytabOpt),
+		principal: m.Get(PrincipalOpt),
+		secretref: m.Get(SecretRefOpt),
+	}
+}
+
+// credsFromOptions reads credentials from volume options.  A password given by reference
+// (password_file, password_env, secretref) is resolved here, at mount time, and never stored.
+func credsFromOptions(opts map[string]string) (*CifsCreds, error) {
+	pass := opts[PasswordOpt]
+	if secret, err := optionSecret(opts, PasswordFileOpt, PasswordEnvOpt); err != nil {
+		return nil, err
+	} else if secret != "" {
+		pass = secret
+	}
+	return &CifsCreds{
+		user:      opts[UsernameOpt],
+		pass:      pass,
+		domain:    opts[DomainOpt],
+		security:  opts[SecurityOpt],
+		fileMode:  opts[FileModeOpt],
+		dirMode:   opts[DirModeOpt],
+		keytab:    opts[KeytabOpt],
+		principal: opts[PrincipalOpt],
+	}, nil
+}
+
+// credentialSource is one step of the credential lookup chain
+type credentialSource struct {
+	name  string
+	creds *CifsCreds
+}
+
+// credentialChain lists where credentials for a share are looked up, in order:
+//
+//  1. volume options
+//  2. the .netrc entry for host/share
+//  3. the .netrc entry for host
+//  4. daemon flags
+//  5. environment (NETSHARE_CIFS_*)
+func (c CifsDriver) credentialChain(opts map[string]string, addr *ShareAddress) ([]credentialSource, error) {
+	volumeCreds, err := credsFromOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	chain := []credentialSource{{"volume options", volumeCreds}}
+	for _, machine := range []string{addr.Host() + "/" + addr.Path, addr.Host()} {
+		if m := c.netrc.Machine(machine); m != nil {
+			chain = append(chain, credentialSource{"netrc " + machine, credsFromNetrc(m)})
+		}
+	}
+	return append(chain,
+		credentialSource{"daemon flags", c.creds},
+		credentialSource{"environment", c.envCreds},
+	), nil
+}
+
+// getCreds resolves the credentials for a share and names the chain step the account came from.  The
+// username, password, domain and Kerberos settings are taken together from the first step defining an
+// account so accounts are never mixed, except that volume options override single fields as before.
+// Security and file modes fall back field by field.
+func (c CifsDriver) getCreds(name string, addr *ShareAddress) (*CifsCreds, string, error) {
+	return c.resolveCreds(c.mountm.GetOptions(name), addr)
+}
+
+// resolveCreds is getCreds for the given volume options, it doesn't touch the driver's volumes so it can
+// run without the driver lock
+func (c CifsDriver) resolveCreds(opts map[string]string, addr *ShareAddress) (*CifsCreds, string, error) {
+	chain, err := c.credentialChain(opts, addr)
+	if err != nil {
+		return nil, "", err
+	}
+	creds := &CifsCreds{}
+	source := "none (guest)"
+
+	for _, s := range chain[1:] {
+		if s.creds != nil && (s.creds.user != "" || s.creds.principal != "") {
+			pass := s.creds.pass
+			if s.creds.secretref != "" {
+				if pass, err = resolveSecretRef(s.creds.secretref); err != nil {
+					return nil, "", err
+				}
+			}
+			creds.user, creds.pass, creds.domain = s.creds.user, pass, s.creds.domain
+			creds.keytab, creds.principal = s.creds.keytab, s.creds.principal
+			source = s.name
+			break
+		}
+	}
+
+	for _, s := range chain {
+		if s.creds == nil {
+			continue
+		}
+		if s.name == chain[0].name {
+			if s.creds.user != "" || s.creds.principal != "" {
+				source = s.name
+			}
+			creds.user = firstOf(s.creds.user, creds.user)
+			creds.pass = firstOf(s.creds.pass, creds.pass)
+			creds.domain = firstOf(s.creds.domain, creds.domain)
+			creds.keytab = firstOf(s.creds.keytab, creds.keytab)
+			creds.principal = firstOf(s.creds.principal, creds.principal)
+		}
+		creds.security = firstOf(creds.security, s.creds.security)
+		creds.fileMode = firstOf(creds.fileMode, s.creds.fileMode)
+		creds.dirMode = firstOf(creds.dirMode, s.creds.dirMode)
+	}
+
+	log.Debugf("GetCreds: %s -> %s from %s", addr, creds, source)
+	return creds, source, nil
+}
+
+// firstOf returns the first non empty value
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
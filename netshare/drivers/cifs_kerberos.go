@@ -0,0 +1,127 @@
+package drivers
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	KeytabOpt    = "keytab"
+	PrincipalOpt = "principal"
+)
+
+var (
+	KerberosRenewInterval = 1 * time.Hour
+)
+
+// kerberos keeps a credential cache per principal fresh by running kinit with its keytab.  The caches
+// live in the private credentials directory under root and are passed to cifs.upcall through the
+// environment of the mount.
+type kerberos struct {
+	root    string
+	m       *sync.Mutex
+	tickets map[string]*ticket
+}
+
+type ticket struct {
+	principal string
+	keytab    string
+	ccache    string
+	renewed   time.Time
+}
+
+func newKerberos(root string) *kerberos {
+	k := &kerberos{
+		root:    root,
+		m:       &sync.Mutex{},
+		tickets: map[string]*ticket{},
+	}
+	go k.renewLoop(KerberosRenewInterval)
+	return k
+}
+
+// CCache returns the credential cache for principal, obtaining or renewing its ticket when needed
+func (k *kerberos) CCache(principal, keytab string) (string, error) {
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	t, found := k.tickets[principal]
+	if !found || t.keytab != keytab {
+		dir, err := credentialsDir(k.root)
+		if err != nil {
+			return "", err
+		}
+		t = &ticket{
+			principal: principal,
+			keytab:    keytab,
+			ccache:    filepath.Join(dir, fmt.Sprintf("krb5cc_%d_%x", os.Getuid(), sha1.Sum([]byte(principal)))),
+		}
+	}
+	if _, err := os.Stat(t.ccache); err != nil || time.Since(t.renewed) > KerberosRenewInterval {
+		if err := kinit(t.principal, t.keytab, t.ccache); err != nil {
+			return "", err
+		}
+		t.renewed = time.Now()
+	}
+	k.tickets[principal] = t
+	return t.ccache, nil
+}
+
+// renewLoop renews the tickets before they expire.  kinit runs without the lock so mounts don't wait
+// for it.
+func (k *kerberos) renewLoop(interval time.Duration) {
+	for range time.Tick(interval / 2) {
+		k.m.Lock()
+		due := []ticket{}
+		for _, t := range k.tickets {
+			if time.Since(t.renewed) > interval/2 {
+				due = append(due, *t)
+			}
+		}
+		k.m.Unlock()
+
+		for _, t := range due {
+			if err := kinit(t.principal, t.keytab, t.ccache); err != nil {
+				log.Errorf("Error renewing Kerberos ticket for %s: %s", t.principal, err.Error())
+				continue
+			}
+			k.m.Lock()
+			if cur, found := k.tickets[t.principal]; found && cur.ccache == t.ccache {
+				cur.renewed = time.Now()
+			}
+			k.m.Unlock()
+		}
+	}
+}
+
+// kinit obtains a ticket into a new cache file readable only by root, which then replaces ccache.  A
+// mount never reads a half written cache, and a renewal racing a mount doesn't corrupt it.
+func kinit(principal, keytab, ccache string) error {
+	log.Debugf("Obtaining Kerberos ticket for %s from %s", principal, keytab)
+	f, err := ioutil.TempFile(filepath.Dir(ccache), filepath.Base(ccache)+".")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	tmp := f.Name()
+
+	out, err := exec.Command("kinit", "-k", "-t", keytab, "-c", "FILE:"+tmp, principal).CombinedOutput()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("kinit for %s failed: %s %s", principal, err.Error(), strings.TrimSpace(string(out)))
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, ccache)
+}
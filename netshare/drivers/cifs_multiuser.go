@@ -0,0 +1,147 @@
+package drivers
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MultiuserOpt = "multiuser"
+
+	// container labels holding the tenant credentials of a multiuser mount
+	TenantLabelPrefix   = "netshare.cifs."
+	TenantUserLabel     = TenantLabelPrefix + UsernameOpt
+	TenantDomainLabel   = TenantLabelPrefix + DomainOpt
+	TenantPassFileLabel = TenantLabelPrefix + PasswordFileOpt
+	TenantSecretLabel   = TenantLabelPrefix + SecretRefOpt
+	TenantUIDLabel      = TenantLabelPrefix + "uid"
+
+	StatusTenants = "tenants"
+)
+
+// cifsTenant is the account a container accesses a multiuser mount with.  The kernel picks the
+// credentials from the keyring of the accessing uid, so they are added with cifscreds as that uid.
+type cifsTenant struct {
+	uid    int
+	user   string
+	domain string
+	host   string
+}
+
+func (t *cifsTenant) String() string {
+	return fmt.Sprintf("%s@%s (uid %d)", t.user, t.host, t.uid)
+}
+
+// tenantMount is a container's mount of a multiuser volume
+type tenantMount struct {
+	volume string
+	tenant *cifsTenant
+}
+
+// cifsTenants tracks the tenant credentials added for each mount ID
+type cifsTenants struct {
+	m      *sync.Mutex
+	mounts map[string]tenantMount
+}
+
+func newCifsTenants() *cifsTenants {
+	return &cifsTenants{m: &sync.Mutex{}, mounts: map[string]tenantMount{}}
+}
+
+// Attach adds the credentials of the container starting with the volume to the keyring and records
+// them under the mount ID.  dockerName is the volume as docker knows it, which differs from name for
+// ad-hoc volumes.  A container without tenant labels gets no credentials of its own.
+func (t *cifsTenants) Attach(id, dockerName, name string, source *ShareAddress) error {
+	c, err := requestingContainer(dockerName)
+	if err != nil {
+		return fmt.Errorf("multiuser volume %s: %s", name, err.Error())
+	}
+	user := containerLabel(c, TenantUserLabel)
+	if user == "" {
+		log.Infof("Container %s has no %s label, it accesses %s without credentials", c.ID, TenantUserLabel, name)
+		return nil
+	}
+
+	// the keyring is chosen by uid, guessing it would hand the credentials to other tenants' containers
+	uid, err := containerID(c, TenantUIDLabel)
+	if err != nil {
+		return fmt.Errorf("multiuser volume %s: %s, set it to the uid the container runs as", name, err.Error())
+	}
+
+	pass, err := optionSecret(map[string]string{
+		PasswordFileOpt: containerLabel(c, TenantPassFileLabel),
+		SecretRefOpt:    containerLabel(c, TenantSecretLabel),
+	}, PasswordFileOpt, "")
+	if err != nil {
+		return err
+	}
+
+	tenant := &cifsTenant{uid: uid, user: user, domain: containerLabel(c, TenantDomainLabel), host: source.Host()}
+	log.Infof("Adding credentials %s for container %s", tenant, c.ID)
+	if err := tenant.run("add", pass); err != nil {
+		return err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.mounts[id] = tenantMount{volume: name, tenant: tenant}
+	return nil
+}
+
+// Detach removes the credentials recorded for the mount ID unless another mount still uses them
+func (t *cifsTenants) Detach(id string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	tm, found := t.mounts[id]
+	if !found {
+		return
+	}
+	delete(t.mounts, id)
+	tenant := tm.tenant
+	for _, other := range t.mounts {
+		if *other.tenant == *tenant {
+			return
+		}
+	}
+	log.Infof("Removing credentials %s", tenant)
+	if err := tenant.run("clear", ""); err != nil {
+		log.Warnf("Error removing credentials %s: %s", tenant, err.Error())
+	}
+}
+
+// Users lists the tenants of a volume for its status
+func (t *cifsTenants) Users(volume string) []string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	users := []string{}
+	for _, tm := range t.mounts {
+		if tm.volume == volume {
+			users = append(users, tm.tenant.String())
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// run invokes cifscreds as the tenant's uid, passing the password on stdin
+func (t *cifsTenant) run(action, pass string) error {
+	args := []string{fmt.Sprintf("--reuid=%d", t.uid), "--clear-groups", "cifscreds", action, "-u", t.user}
+	if t.domain != "" {
+		args = append(args, "-d", t.domain)
+	} else {
+		args = append(args, t.host)
+	}
+	cmd := exec.Command("setpriv", args...)
+	if action == "add" {
+		cmd.Stdin = strings.NewReader(pass + "\n")
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cifscreds %s for %s failed: %s", action, t, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package drivers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	UIDOpt      = "uid"
+	GIDOpt      = "gid"
+	OwnerAuto   = "auto"
+	StatusOwner = "owner"
+
+	// container labels giving the ids auto ownership maps to, for a user given to docker run
+	OwnerUIDLabel = TenantLabelPrefix + UIDOpt
+	OwnerGIDLabel = TenantLabelPrefix + GIDOpt
+)
+
+// mountOwner works out the uid and gid a volume's files are owned by: auto takes the ids the container
+// being started runs as, see containerOwner, a number is used as-is.  It returns "" when neither option
+// is set.
+func (c CifsDriver) mountOwner(dockerName, name string) (string, error) {
+	uidOpt, gidOpt := c.mountm.GetOption(name, UIDOpt), c.mountm.GetOption(name, GIDOpt)
+	if uidOpt == "" && gidOpt == "" {
+		return "", nil
+	}
+
+	var owner []int
+	opts := []string{}
+	for i, o := range []struct {
+		key   string
+		value string
+	}{{UIDOpt, uidOpt}, {GIDOpt, gidOpt}} {
+		var id int
+		switch {
+		case o.value == "":
+			continue
+		case strings.EqualFold(o.value, OwnerAuto):
+			if owner == nil {
+				container, err := requestingContainer(dockerName)
+				if err != nil {
+					return "", fmt.Errorf("%s=%s on volume %s: %s", o.key, OwnerAuto, name, err.Error())
+				}
+				uid, gid, err := containerOwner(container)
+				if err != nil {
+					return "", fmt.Errorf("%s=%s on volume %s: %s", o.key, OwnerAuto, name, err.Error())
+				}
+				owner = []int{uid, gid}
+			}
+			id = owner[i]
+		default:
+			n, err := strconv.Atoi(o.value)
+			if err != nil || n < 0 {
+				return "", fmt.Errorf("invalid %s %s, expected a number or %s", o.key, o.value, OwnerAuto)
+			}
+			id = n
+		}
+		opts = append(opts, fmt.Sprintf("%s=%d,force%s", o.key, id, o.key))
+	}
+	return strings.Join(opts, ","), nil
+}
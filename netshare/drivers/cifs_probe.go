@@ -0,0 +1,125 @@
+package drivers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ShareCheckOpt = "sharecheck"
+)
+
+var (
+	// SmbProbeTimeout bounds a whole probe of a server
+	SmbProbeTimeout = 10 * time.Second
+)
+
+// SmbProbe is what probing a CIFS server found
+type SmbProbe struct {
+	Dialect string
+	// User is the account that authenticated, empty for anonymous access
+	User string
+	// CredentialSource names the step of the credential chain the account came from
+	CredentialSource string
+	Guest            bool
+	Shares           []SmbShare
+}
+
+// ProbeCifsServer authenticates to host with the credentials getCreds would use for its shares and lists
+// them.  creds, envCreds and netrc are the daemon's flag, environment and .netrc settings.
+func ProbeCifsServer(host string, creds, envCreds *CifsCreds, netrc string) (*SmbProbe, error) {
+	addr, err := ParseShareAddress(host, CIFS)
+	if err != nil {
+		// a bare host has no share name
+		if addr, err = ParseShareAddress(host+"/IPC$", CIFS); err != nil {
+			return nil, err
+		}
+	}
+	c := CifsDriver{
+		volumeDriver: newVolumeDriver("", NewVolumeManager()),
+		creds:        creds,
+		envCreds:     envCreds,
+		netrc:        newNetrcFile(netrc),
+	}
+	resolved, source, err := c.getCreds(addr.Host(), addr)
+	if err != nil {
+		return nil, err
+	}
+	if resolved.principal != "" && resolved.user == "" {
+		return nil, fmt.Errorf("credentials from %s use Kerberos, which the probe does not support", source)
+	}
+
+	conn, err := openSmbSession(addr, resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	probe := &SmbProbe{Dialect: conn.Dialect(), User: resolved.user, CredentialSource: source, Guest: conn.guest}
+	if probe.Shares, err = conn.enumShares(); err != nil {
+		return probe, fmt.Errorf("listing shares on %s failed: %s", addr.Host(), err.Error())
+	}
+	return probe, nil
+}
+
+// openSmbSession connects to the address's host and authenticates with creds
+func openSmbSession(addr *ShareAddress, creds *CifsCreds) (*smbConn, error) {
+	conn, err := dialSMB(resolveHost(addr.Host()), addr.Port, SmbProbeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.sessionSetup(creds.user, creds.pass, creds.domain); err != nil {
+		conn.Close()
+		user := creds.user
+		if user == "" {
+			user = "anonymous"
+		}
+		return nil, fmt.Errorf("authentication as %s on %s failed: %s", user, addr.Host(), err.Error())
+	}
+	return conn, nil
+}
+
+// probeShare checks that the share exists and that creds are accepted before mounting.  Only answers
+// which make the mount fail anyway are returned as errors, anything else is logged.
+func (c CifsDriver) probeShare(name string, addr *ShareAddress, creds *CifsCreds) error {
+	if !c.mountm.GetOptionAsBool(name, ShareCheckOpt) {
+		return nil
+	}
+	if strings.HasPrefix(creds.security, "krb5") || (creds.principal != "" && creds.keytab != "") {
+		log.Debugf("Skipping share check for %s, Kerberos is not supported by the probe", addr)
+		return nil
+	}
+
+	conn, err := dialSMB(resolveHost(addr.Host()), addr.Port, SmbProbeTimeout)
+	if err != nil {
+		log.Debugf("Skipping share check for %s - %s", addr, err.Error())
+		return nil
+	}
+	defer conn.Close()
+
+	if err := conn.sessionSetup(creds.user, creds.pass, creds.domain); err != nil {
+		if isSmbStatus(err, statusLogonFailure) || isSmbStatus(err, statusAccountDisabled) ||
+			isSmbStatus(err, statusAccountLockedOut) || isSmbStatus(err, statusPasswordExpired) {
+			return fmt.Errorf("authentication as %s on %s failed: %s", creds.user, addr.Host(), err.Error())
+		}
+		log.Debugf("Skipping share check for %s - %s", addr, err.Error())
+		return nil
+	}
+
+	treeID, err := conn.treeConnect(addr.Path)
+	switch {
+	case isSmbStatus(err, statusBadNetworkName):
+		return fmt.Errorf("share %s not found on host %s", addr.Path, addr.Host())
+	case isSmbStatus(err, statusAccessDenied):
+		return fmt.Errorf("access to share %s on host %s denied for %s", addr.Path, addr.Host(), creds.user)
+	case err != nil:
+		log.Debugf("Skipping share check for %s - %s", addr, err.Error())
+		return nil
+	}
+	conn.treeDisconnect(treeID)
+	log.Debugf("Share check for %s passed (SMB %s)", addr, conn.Dialect())
+	return nil
+}
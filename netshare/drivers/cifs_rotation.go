@@ -0,0 +1,254 @@
+package drivers
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StatusReauthenticated = "reauthenticated"
+	StatusRotation        = "rotation"
+
+	// rotation states reported for a volume whose credentials changed
+	RotationPending = "pending"
+	RotationFailed  = "failed"
+)
+
+var (
+	// CredentialCheckInterval is how often the credentials of mounted volumes are looked up again
+	CredentialCheckInterval = 1 * time.Minute
+	// CredentialQuietPeriod is how long changed credentials have to stay the same before they are used, so
+	// a secret file caught while being rewritten isn't
+	CredentialQuietPeriod = 1 * time.Minute
+)
+
+// credentialWatch remembers a fingerprint of the account each volume was mounted with, so a rotated
+// password (in .netrc, a secret file or a secret reference) is noticed before the server drops the session.
+type credentialWatch struct {
+	m            *sync.Mutex
+	fingerprints map[string]string
+	// changes holds the credentials seen to differ from those a volume was mounted with
+	changes map[string]*credentialChange
+	// lookupErrors holds the last failed lookup of a volume's credentials
+	lookupErrors map[string]string
+}
+
+type credentialChange struct {
+	fingerprint string
+	since       time.Time
+	state       string
+}
+
+func newCredentialWatch() *credentialWatch {
+	return &credentialWatch{
+		m:            &sync.Mutex{},
+		fingerprints: map[string]string{},
+		changes:      map[string]*credentialChange{},
+		lookupErrors: map[string]string{},
+	}
+}
+
+func (w *credentialWatch) Set(name string, creds *CifsCreds) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.fingerprints[name] = creds.fingerprint()
+	delete(w.changes, name)
+}
+
+func (w *credentialWatch) Delete(name string) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	delete(w.fingerprints, name)
+	delete(w.changes, name)
+	delete(w.lookupErrors, name)
+}
+
+// Observe compares creds with those name was mounted with.  It returns the change, or nil when there is
+// none, and whether the new credentials stayed the same for CredentialQuietPeriod.  Volumes mounted before
+// a restart have no fingerprint, their current credentials are taken as a baseline.
+func (w *credentialWatch) Observe(name string, creds *CifsCreds) (*credentialChange, bool) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	fp := creds.fingerprint()
+	mounted, found := w.fingerprints[name]
+	if !found {
+		w.fingerprints[name] = fp
+		return nil, false
+	}
+	if fp == mounted {
+		delete(w.changes, name)
+		return nil, false
+	}
+	ch, found := w.changes[name]
+	if !found || ch.fingerprint != fp {
+		ch = &credentialChange{fingerprint: fp, since: time.Now()}
+		w.changes[name] = ch
+	}
+	return ch, time.Since(ch.since) >= CredentialQuietPeriod
+}
+
+// SetState moves a change to state and reports whether it was in another one
+func (w *credentialWatch) SetState(ch *credentialChange, state string) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+	was := ch.state
+	ch.state = state
+	return was != state
+}
+
+// LookupFailed records the error of a credential lookup, or its success with "", and reports whether
+// it differs from the last one
+func (w *credentialWatch) LookupFailed(name, msg string) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+	was := w.lookupErrors[name]
+	if msg == "" {
+		delete(w.lookupErrors, name)
+	} else {
+		w.lookupErrors[name] = msg
+	}
+	return was != msg
+}
+
+// fingerprint identifies the account without keeping the password around
+func (creds *CifsCreds) fingerprint() string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join([]string{creds.user, creds.pass, creds.domain, creds.keytab, creds.principal}, "\x00"))))
+}
+
+// credentialCheck is a mounted volume whose credentials are looked up outside the driver lock
+type credentialCheck struct {
+	name   string
+	source *ShareAddress
+	opts   map[string]string
+	dir    string
+}
+
+// watchCredentials periodically looks up the credentials of every mounted volume again and
+// reauthenticates volumes whose credentials changed.  Secret providers, kinit and the remount may take a
+// while, so the driver lock is only held to read and update the volumes.
+func (c CifsDriver) watchCredentials(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.m.Lock()
+		checks := c.credentialChecks()
+		c.m.Unlock()
+
+		for _, check := range checks {
+			c.checkCredentials(check)
+		}
+	}
+}
+
+// credentialChecks returns the volumes in use with a copy of their options and the directory their
+// session is mounted on, which is the shared mount for volumes bound from one
+func (c CifsDriver) credentialChecks() []credentialCheck {
+	checks := []credentialCheck{}
+	for _, name := range c.mountm.Names() {
+		if c.mountm.Count(name) == 0 {
+			continue
+		}
+		source, err := c.shareAddress(name, nil)
+		if err != nil {
+			continue
+		}
+		opts := map[string]string{}
+		for k, v := range c.mountm.GetOptions(name) {
+			opts[k] = v
+		}
+		dir := mountpoint(c.root, name)
+		if c.shares != nil {
+			if d, ok := c.shares.Dir(name); ok {
+				dir = d
+			}
+		}
+		checks = append(checks, credentialCheck{name: name, source: source, opts: opts, dir: dir})
+	}
+	return checks
+}
+
+// checkCredentials reauthenticates a volume once its changed credentials have settled.  Each state of a
+// rotation is logged once and reported as rotation in the volume status until the volume is
+// reauthenticated or mounted again.
+func (c CifsDriver) checkCredentials(check credentialCheck) {
+	name := check.name
+	creds, credSource, err := c.resolveCreds(check.opts, check.source)
+	if err != nil {
+		if c.rotation.LookupFailed(name, err.Error()) {
+			log.Warnf("Error looking up credentials of %s: %s", name, err.Error())
+		}
+		return
+	}
+	c.rotation.LookupFailed(name, "")
+
+	ch, settled := c.rotation.Observe(name, creds)
+	switch {
+	case ch == nil:
+		c.setRotationStatus(name, "")
+		return
+	case ch.state == RotationFailed:
+		return
+	case !settled:
+		if c.rotation.SetState(ch, RotationPending) {
+			log.Infof("Credentials of %s from %s changed, reauthenticating once they stay unchanged for %s", name, credSource, CredentialQuietPeriod)
+			c.setRotationStatus(name, RotationPending)
+		}
+		return
+	}
+
+	if err := c.reauthenticate(check, creds); err != nil {
+		c.rotation.SetState(ch, RotationFailed)
+		log.Warnf("Reauthenticating %s failed: %s", name, err.Error())
+		c.setRotationStatus(name, RotationFailed)
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.mountm.Count(name) == 0 {
+		// unmounted meanwhile, the next mount uses the new credentials anyway
+		return
+	}
+	c.rotation.Set(name, creds)
+	c.mountm.DeleteStatus(name, StatusRotation)
+	c.mountm.SetStatus(name, StatusCredentials, credSource)
+	c.mountm.SetStatus(name, StatusReauthenticated, time.Now().UTC().Format(time.RFC3339))
+	log.Infof("Reauthenticated %s with credentials from %s", name, credSource)
+}
+
+// setRotationStatus reports the rotation state of a mounted volume, "" clears it
+func (c CifsDriver) setRotationStatus(name, state string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.mountm.Count(name) == 0 {
+		return
+	}
+	if state == "" {
+		c.mountm.DeleteStatus(name, StatusRotation)
+	} else {
+		c.mountm.SetStatus(name, StatusRotation, state)
+	}
+}
+
+// reauthenticate hands the new password to the existing session with a remount.  Unmounting and mounting
+// the volume again is no option while it is in use: running containers keep their own bind of the old
+// mount.  When the kernel doesn't accept the new password in place, the volume stays pending and picks the
+// new credentials up when it is mounted again after its containers have stopped.
+func (c CifsDriver) reauthenticate(check credentialCheck, creds *CifsCreds) error {
+	if creds.user == "" || strings.HasPrefix(creds.security, "krb5") {
+		return fmt.Errorf("%s is not authenticated with a password, it is reauthenticated when mounted again", check.name)
+	}
+	credentials, err := c.writeCredentials(creds.user, creds.pass, creds.domain)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(credentials)
+	if err := run(fmt.Sprintf("mount -t cifs -o remount,credentials=%s %s %s", credentials, check.source.CifsSource(), check.dir)); err != nil {
+		return fmt.Errorf("the kernel didn't accept the new password for %s, it is reauthenticated when mounted again after its containers have stopped", check.name)
+	}
+	return nil
+}
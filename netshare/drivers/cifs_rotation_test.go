@@ -0,0 +1,53 @@
+package drivers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCredentialWatch(t *testing.T) {
+	quiet := CredentialQuietPeriod
+	CredentialQuietPeriod = 50 * time.Millisecond
+	defer func() { CredentialQuietPeriod = quiet }()
+
+	w := newCredentialWatch()
+	old, rotated, partial := &CifsCreds{user: "svc", pass: "old"}, &CifsCreds{user: "svc", pass: "new"}, &CifsCreds{user: "svc", pass: "ne"}
+
+	// the first lookup after a restart is the baseline
+	if ch, _ := w.Observe("vol", old); ch != nil {
+		t.Fatal("the baseline is reported as a change")
+	}
+	if ch, settled := w.Observe("vol", partial); ch == nil || settled {
+		t.Fatalf("Observe of new credentials = %v, %v, want an unsettled change", ch, settled)
+	}
+	time.Sleep(CredentialQuietPeriod)
+	// credentials changing again start the quiet period over
+	ch, settled := w.Observe("vol", rotated)
+	if ch == nil || settled {
+		t.Fatalf("Observe of credentials changed again = %v, %v, want an unsettled change", ch, settled)
+	}
+	if !w.SetState(ch, RotationPending) || w.SetState(ch, RotationPending) {
+		t.Error("SetState doesn't report only the first move to pending")
+	}
+	time.Sleep(CredentialQuietPeriod)
+	if again, settled := w.Observe("vol", rotated); again != ch || !settled {
+		t.Errorf("Observe after the quiet period = %v, %v, want the settled change", again, settled)
+	}
+
+	// credentials changed back are no change
+	if ch, _ := w.Observe("vol", old); ch != nil {
+		t.Error("credentials changed back are reported as a change")
+	}
+	w.Observe("vol", rotated)
+	w.Set("vol", rotated)
+	if ch, _ := w.Observe("vol", rotated); ch != nil {
+		t.Error("the credentials set after reauthenticating are reported as a change")
+	}
+
+	if !w.LookupFailed("vol", "no such secret") || w.LookupFailed("vol", "no such secret") {
+		t.Error("LookupFailed doesn't report only the first of the same errors")
+	}
+	if !w.LookupFailed("vol", "") || w.LookupFailed("vol", "") {
+		t.Error("LookupFailed doesn't report only the first success")
+	}
+}
@@ -0,0 +1,63 @@
+package drivers
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	VersOpt        = "vers"
+	SmbVersionAuto = "auto"
+	StatusDialect  = "vers"
+)
+
+// SmbAutoVersions are the dialects tried, newest first, in auto mode
+var SmbAutoVersions = []string{"3.1.1", "3.0", "2.1"}
+
+// smbVersions returns the vers= values to try for a mount.  An empty value leaves the choice to the
+// kernel, which is also the case when cifsopts already carry a vers= option.
+func (c CifsDriver) smbVersions(options map[string]string) []string {
+	if strings.Contains(","+options[CifsOpts], ",vers=") {
+		return []string{""}
+	}
+	vers := c.smbversion
+	if v, found := options[VersOpt]; found {
+		vers = v
+	}
+	switch strings.ToLower(vers) {
+	case "":
+		return []string{""}
+	case SmbVersionAuto:
+		return SmbAutoVersions
+	default:
+		return []string{vers}
+	}
+}
+
+// isNegotiationError reports whether mount.cifs output indicates the server refused the dialect
+// rather than the credentials or share.  EINVAL (error(22)) is left out: it mostly means bad options,
+// which another dialect won't fix.
+func isNegotiationError(out string) bool {
+	for _, e := range []string{"error(95)", "error(112)", "Operation not supported", "Host is down"} {
+		if strings.Contains(out, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordDialect stores the dialect the kernel negotiated for the mount at hostdir in the volume status
+func (c CifsDriver) recordDialect(name, hostdir string) {
+	_, _, options, found := procMount(hostdir)
+	if !found {
+		return
+	}
+	for _, o := range strings.Split(options, ",") {
+		if strings.HasPrefix(o, "vers=") {
+			c.mountm.SetStatus(name, StatusDialect, strings.TrimPrefix(o, "vers="))
+			log.Debugf("CIFS volume %s negotiated SMB %s", name, strings.TrimPrefix(o, "vers="))
+			return
+		}
+	}
+}
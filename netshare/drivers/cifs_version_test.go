@@ -0,0 +1,35 @@
+package drivers
+
+import "testing"
+
+func TestIsNegotiationError(t *testing.T) {
+	tests := []struct {
+		out  string
+		want bool
+	}{
+		{"mount error(95): Operation not supported\nRefer to the mount.cifs(8) manual page", true},
+		{"mount error(112): Host is down", true},
+		{"mount error(22): Invalid argument", false},
+		{"mount error(13): Permission denied", false},
+		{"mount error(2): No such file or directory", false},
+	}
+	for _, tt := range tests {
+		if got := isNegotiationError(tt.out); got != tt.want {
+			t.Errorf("isNegotiationError(%q) = %v, want %v", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestSmbVersions(t *testing.T) {
+	c := CifsDriver{smbversion: SmbVersionAuto}
+	if got := c.smbVersions(map[string]string{}); len(got) != len(SmbAutoVersions) {
+		t.Errorf("smbVersions in auto mode = %v, want %v", got, SmbAutoVersions)
+	}
+	if got := c.smbVersions(map[string]string{VersOpt: "2.1"}); len(got) != 1 || got[0] != "2.1" {
+		t.Errorf("smbVersions with vers=2.1 = %v", got)
+	}
+	// a vers= in cifsopts is left to the kernel
+	if got := c.smbVersions(map[string]string{CifsOpts: "rw,vers=3.0"}); len(got) != 1 || got[0] != "" {
+		t.Errorf("smbVersions with vers in cifsopts = %v", got)
+	}
+}
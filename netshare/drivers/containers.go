@@ -0,0 +1,218 @@
+package drivers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// requestingContainer finds the container a Mount request is made for.  The plugin API only passes an
+// opaque mount ID, but docker mounts volumes while the container is being started, so it is the newest
+// container in the created state which uses the volume.  Only the container list is read: docker holds
+// the container's lock while it calls Mount, so inspecting the container would wait for Mount itself.
+func requestingContainer(volumeName string) (*types.Container, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var found *types.Container
+	candidates := 0
+	for i, c := range containers {
+		if c.State != "created" && c.State != "restarting" {
+			continue
+		}
+		for _, m := range c.Mounts {
+			if m.Name != volumeName {
+				continue
+			}
+			candidates++
+			if found == nil || c.Created > found.Created {
+				found = &containers[i]
+			}
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no starting container uses volume %s", volumeName)
+	}
+	if candidates > 1 {
+		log.Warnf("%d containers are starting with volume %s, assuming %s", candidates, volumeName, found.ID)
+	}
+	return found, nil
+}
+
+// containerLabel returns a label of the container or ""
+func containerLabel(c *types.Container, label string) string {
+	return c.Labels[label]
+}
+
+// containerID returns the numeric id given by a label of the container
+func containerID(c *types.Container, label string) (int, error) {
+	s := containerLabel(c, label)
+	if s == "" {
+		return 0, fmt.Errorf("container %s has no %s label", c.ID, label)
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid %s label %q on container %s", label, s, c.ID)
+	}
+	return id, nil
+}
+
+// containerOwner returns the uid and gid the container runs as.  The uid and gid labels come first, they
+// are the only way to see a user given to docker run.  Otherwise the USER of the container's image is
+// resolved.
+func containerOwner(c *types.Container) (int, int, error) {
+	uidLabel, gidLabel := containerLabel(c, OwnerUIDLabel), containerLabel(c, OwnerGIDLabel)
+	var uid, gid int
+	var err error
+	if uidLabel == "" || gidLabel == "" {
+		image := c.ImageID
+		if image == "" {
+			image = c.Image
+		}
+		if uid, gid, err = imageUser(image); err != nil {
+			return 0, 0, fmt.Errorf("user of container %s: %s", c.ID, err.Error())
+		}
+	}
+	if uidLabel != "" {
+		if uid, err = containerID(c, OwnerUIDLabel); err != nil {
+			return 0, 0, err
+		}
+	}
+	if gidLabel != "" {
+		if gid, err = containerID(c, OwnerGIDLabel); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// imageUser resolves the USER of an image to numeric ids.  Unlike the container, the image can be
+// inspected while docker starts a container.  User and group names are looked up in the image's
+// /etc/passwd and /etc/group, read from its layers.
+func imageUser(image string) (int, int, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cli.Close()
+
+	info, _, err := cli.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		return 0, 0, err
+	}
+	user := ""
+	if info.Config != nil {
+		user = info.Config.User
+	}
+	return resolveUser(user, imageLayers(info.GraphDriver))
+}
+
+// imageLayers returns the directories of an image's layers, topmost first.  Only the overlay storage
+// drivers expose them.
+func imageLayers(gd types.GraphDriverData) []string {
+	if gd.Name != "overlay2" && gd.Name != "overlay" {
+		return nil
+	}
+	dirs := []string{}
+	if d := gd.Data["UpperDir"]; d != "" {
+		dirs = append(dirs, d)
+	}
+	if d := gd.Data["LowerDir"]; d != "" {
+		dirs = append(dirs, strings.Split(d, ":")...)
+	}
+	return dirs
+}
+
+// resolveUser maps a USER directive (name, uid, name:group or uid:gid) to ids the way docker does: names
+// are looked up in the image, a user without a group gets the primary group of its passwd entry, or 0
+// when it has none.  An empty USER is root.
+func resolveUser(user string, layers []string) (int, int, error) {
+	if user == "" {
+		return 0, 0, nil
+	}
+	name, group := user, ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		name, group = user[:i], user[i+1:]
+	}
+
+	uid, err := strconv.Atoi(name)
+	numeric := err == nil
+	gid := 0
+	entry, err := layerEntry(layers, "etc/passwd", func(fields []string) bool {
+		return len(fields) >= 4 && (fields[0] == name || numeric && fields[2] == name)
+	})
+	switch {
+	case entry != nil:
+		if uid, err = strconv.Atoi(entry[2]); err != nil {
+			return 0, 0, fmt.Errorf("invalid uid of %s in /etc/passwd", name)
+		}
+		gid, _ = strconv.Atoi(entry[3])
+	case !numeric && err != nil:
+		return 0, 0, fmt.Errorf("user %s can't be looked up in the image (%s), use a numeric USER or the %s label", name, err.Error(), OwnerUIDLabel)
+	case !numeric:
+		return 0, 0, fmt.Errorf("user %s is not in the image's /etc/passwd", name)
+	}
+
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			entry, err := layerEntry(layers, "etc/group", func(fields []string) bool {
+				return len(fields) >= 3 && fields[0] == group
+			})
+			if err != nil {
+				return 0, 0, fmt.Errorf("group %s can't be looked up in the image (%s), use a numeric group or the %s label", group, err.Error(), OwnerGIDLabel)
+			}
+			if entry == nil {
+				return 0, 0, fmt.Errorf("group %s is not in the image's /etc/group", group)
+			}
+			if gid, err = strconv.Atoi(entry[2]); err != nil {
+				return 0, 0, fmt.Errorf("invalid gid of %s in /etc/group", group)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// layerEntry returns the first line of a colon separated file in the image, like /etc/passwd, for which
+// match is true.  The topmost layer holding the file wins, a whiteout in a layer above hides it.
+func layerEntry(layers []string, file string, match func(fields []string) bool) ([]string, error) {
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("the image's storage driver doesn't expose its files")
+	}
+	for _, dir := range layers {
+		if _, err := os.Lstat(filepath.Join(dir, filepath.Dir(file), ".wh."+filepath.Base(file))); err == nil {
+			break
+		}
+		f, err := os.Open(filepath.Join(dir, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if fields := strings.Split(scanner.Text(), ":"); match(fields) {
+				return fields, nil
+			}
+		}
+		return nil, scanner.Err()
+	}
+	return nil, fmt.Errorf("the image has no /%s", file)
+}
@@ -0,0 +1,96 @@
+package drivers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+// writeLayer creates a layer directory holding files, given by path below the layer
+func writeLayer(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "netshare-layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestResolveUser(t *testing.T) {
+	base := writeLayer(t, map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/bash\nold:x:900:900::/:/bin/false\n",
+		"etc/group":  "root:x:0:\nstaff:x:50:\n",
+	})
+	defer os.RemoveAll(base)
+	top := writeLayer(t, map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/bash\napp:x:1001:1002::/app:/bin/sh\n",
+	})
+	defer os.RemoveAll(top)
+	layers := []string{top, base}
+
+	tests := []struct {
+		user     string
+		uid, gid int
+	}{
+		{"", 0, 0},
+		{"app", 1001, 1002},
+		{"1001", 1001, 1002},
+		{"app:staff", 1001, 50},
+		{"app:7", 1001, 7},
+		// a uid without a passwd entry gets group 0
+		{"4000", 4000, 0},
+		{"4000:4000", 4000, 4000},
+	}
+	for _, tt := range tests {
+		uid, gid, err := resolveUser(tt.user, layers)
+		if err != nil {
+			t.Errorf("resolveUser(%q): %s", tt.user, err)
+			continue
+		}
+		if uid != tt.uid || gid != tt.gid {
+			t.Errorf("resolveUser(%q) = %d:%d, want %d:%d", tt.user, uid, gid, tt.uid, tt.gid)
+		}
+	}
+
+	// the entry of the topmost layer wins
+	for _, user := range []string{"old", "app:nogroup"} {
+		if _, _, err := resolveUser(user, layers); err == nil {
+			t.Errorf("resolveUser(%q) succeeded", user)
+		}
+	}
+	// names can't be resolved without the image's files, numbers can
+	if _, _, err := resolveUser("app", nil); err == nil {
+		t.Error("resolveUser of a name without layers succeeded")
+	}
+	if uid, gid, err := resolveUser("1001:1001", nil); err != nil || uid != 1001 || gid != 1001 {
+		t.Errorf("resolveUser of numbers without layers = %d:%d, %v", uid, gid, err)
+	}
+
+	// a whiteout hides the files of the layers below
+	deleted := writeLayer(t, map[string]string{"etc/.wh.passwd": ""})
+	defer os.RemoveAll(deleted)
+	if _, _, err := resolveUser("app", []string{deleted, top}); err == nil {
+		t.Error("resolveUser found a user in a deleted /etc/passwd")
+	}
+}
+
+func TestImageLayers(t *testing.T) {
+	gd := types.GraphDriverData{Name: "overlay2", Data: map[string]string{"UpperDir": "/l/3/diff", "LowerDir": "/l/2/diff:/l/1/diff"}}
+	if got := imageLayers(gd); len(got) != 3 || got[0] != "/l/3/diff" || got[2] != "/l/1/diff" {
+		t.Errorf("imageLayers = %v, want the upper directory first", got)
+	}
+	if got := imageLayers(types.GraphDriverData{Name: "devicemapper"}); got != nil {
+		t.Errorf("imageLayers of devicemapper = %v", got)
+	}
+}
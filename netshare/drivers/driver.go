@@ -1,6 +1,7 @@
 package drivers
 
 import (
+	"path/filepath"
 	"sync"
 
 	"github.com/docker/go-plugins-helpers/volume"
@@ -21,8 +22,79 @@ func newVolumeDriver(root string, mounts *MountManager) volumeDriver {
 	}
 }
 
+// resolveVolume maps the name of a Mount or Unmount request to the volume.  An ad-hoc name
+// (docker run -v server/share#name:/data) resolves to name, returning the inline share as options.
+func (v volumeDriver) resolveVolume(requestName string) (string, map[string]string, string) {
+	name, resOpts := resolveName(requestName)
+	return name, resOpts, mountpoint(v.root, name)
+}
+
+// volumeShare returns the share of a volume: the inline share of an ad-hoc name, the share option or
+// the volume name itself.
+func (v volumeDriver) volumeShare(name string, resOpts map[string]string) string {
+	if s, found := resOpts[ShareOpt]; found {
+		return s
+	}
+	if v.mountm.HasOption(name, ShareOpt) {
+		return v.mountm.GetOption(name, ShareOpt)
+	}
+	return name
+}
+
+// existingMount takes another reference on a volume which is still mounted on hostdir.  A volume whose
+// mount has gone away is mounted again.
+func (v volumeDriver) existingMount(name, hostdir string) bool {
+	if !v.mountm.HasMount(name) {
+		return false
+	}
+	if _, _, _, mounted := procMount(hostdir); !mounted {
+		if v.mountm.Count(name) > 0 {
+			log.Infof("Existing volume %s not mounted, force remount.", name)
+		}
+		return false
+	}
+	log.Infof("Using existing volume mount: %s", hostdir)
+	v.mountm.Increment(name)
+	return true
+}
+
+// addMount counts a new mount of the volume, registering ad-hoc volumes docker did not create first
+func (v volumeDriver) addMount(name, hostdir string, resOpts map[string]string) {
+	if !v.mountm.HasMount(name) {
+		v.mountm.Create(name, hostdir, resOpts)
+	}
+	v.mountm.Add(name, hostdir)
+}
+
+// releaseMount drops a reference to the volume and reports whether other containers still use it
+func (v volumeDriver) releaseMount(name string) bool {
+	if v.mountm.HasMount(name) {
+		if v.mountm.Count(name) > 1 {
+			log.Infof("Skipping unmount for %s - in use by other containers", name)
+			v.mountm.Decrement(name)
+			return true
+		}
+		v.mountm.Decrement(name)
+	}
+	return false
+}
+
+// volumeDir returns the directory served for a volume mounted on hostdir.  A volume with both the share
+// and create options (every ad-hoc volume) is a sub-directory of the share named after the volume,
+// unless the share manager already bound that sub-directory to hostdir.
+func (v volumeDriver) volumeDir(name, hostdir string, bound bool) (string, error) {
+	if bound || v.mountm.GetOption(name, ShareOpt) == "" || !v.mountm.GetOptionAsBool(name, CreateOpt) {
+		return hostdir, nil
+	}
+	datavol := filepath.Join(hostdir, name)
+	if err := createDest(datavol); err != nil {
+		return "", err
+	}
+	return datavol, nil
+}
+
 func (v volumeDriver) Create(r *volume.CreateRequest) error {
-	log.Debugf("Entering Create: name: %s, options %v", r.Name, r.Options)
+	log.Debugf("Entering Create: name: %s, options %v", r.Name, redactOptions(r.Options))
 
 	v.m.Lock()
 	defer v.m.Unlock()
@@ -34,7 +106,10 @@ func (v volumeDriver) Create(r *volume.CreateRequest) error {
 			r.Options = resOpts
 		}
 	}
-	log.Debugf("Create volume -> name: %s, %v", resName, r.Options)
+	log.Debugf("Create volume -> name: %s, %v", resName, redactOptions(r.Options))
+	if _, found := r.Options[PasswordOpt]; found {
+		log.Warnf("Volume %s has a plain text password option, which docker shows in volume inspect - consider %s or %s", resName, PasswordFileOpt, SecretRefOpt)
+	}
 
 	dest := mountpoint(v.root, resName)
 	if err := createDest(dest); err != nil {
@@ -76,7 +151,7 @@ func (v volumeDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
 
 	if v.mountm.HasMount(resolvedName) {
 		log.Debugf("Get: mount found for %s, host directory: %s", resolvedName, hostdir)
-		return &volume.GetResponse{Volume: &volume.Volume{Name: resolvedName, Mountpoint: hostdir}}, nil
+		return &volume.GetResponse{Volume: &volume.Volume{Name: resolvedName, Mountpoint: hostdir, Status: v.mountm.GetStatus(resolvedName)}}, nil
 	}
 	return nil, nil
 }
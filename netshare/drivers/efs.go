@@ -2,9 +2,9 @@ package drivers
 
 import (
 	"fmt"
-	"os"
+	"net"
 	"regexp"
-	"strings"
+	"strconv"
 
 	"github.com/docker/go-plugins-helpers/volume"
 	log "github.com/sirupsen/logrus"
@@ -12,121 +12,298 @@ import (
 
 const (
 	EfsTemplateURI = "%s.efs.%s.amazonaws.com"
+	EfsNfsPort     = 2049
+	// DefaultEfsOptions are the NFS mount options AWS recommends for EFS
+	DefaultEfsOptions = "nfsvers=4.1,rsize=1048576,wsize=1048576,hard,timeo=600,retrans=2,noresvport"
 )
 
+// efsDriver mounts EFS file systems with the NFS driver's options, shared mounts and cleanup, resolving
+// file system ids to a mount target
 type efsDriver struct {
-	volumeDriver
-	resolve  bool
-	region   string
-	resolver *Resolver
-	dnscache map[string]string
+	nfsDriver
+	resolve    bool
+	tls        bool
+	region     string
+	availZone  string
+	metadata   *metaDataClient
+	endpoint   string
+	resolver   *CachingResolver
+	zones      map[string]string
+	tunnels    *tunnelManager
+	provisions *provisionManager
 }
 
-func NewEFSDriver(root, nameserver string, resolve bool, mounts *MountManager) efsDriver {
+// NewEFSDriver creates the EFS driver.  region and availZone default to the environment and the instance
+// metadata at metadataURL.  Without resolve the metadata service isn't used and a missing region is only
+// an error for the features needing it.  endpoint is the EFS API used to provision file systems.  nfsopts
+// and sharemounts work as for the NFS driver.
+func NewEFSDriver(root, nameserver, region, availZone, metadataURL, endpoint, nfsopts string, resolve, tls, ipv6, sharemounts bool, mounts *MountManager) (efsDriver, error) {
 
 	d := efsDriver{
-		volumeDriver: newVolumeDriver(root, mounts),
-		resolve:      resolve,
-		dnscache:     map[string]string{},
+		nfsDriver: nfsDriver{
+			volumeDriver: newVolumeDriver(root, mounts),
+			version:      4,
+			nfsopts:      map[string]string{},
+		},
+		resolve:    resolve,
+		tls:        tls,
+		metadata:   newMetaDataClient(metadataURL),
+		endpoint:   endpoint,
+		zones:      map[string]string{},
+		tunnels:    newTunnelManager(),
+		provisions: newProvisionManager(),
 	}
 
+	if sharemounts {
+		d.shares = newShareManager(root)
+	}
+	if len(nfsopts) > 0 {
+		d.nfsopts[NfsOptions] = nfsopts
+	}
 	if resolve {
-		d.resolver = NewResolver(nameserver)
+		d.resolver = DefaultCachingResolver()
+		if nameserver != "" || ipv6 {
+			resolver := NewResolver(nameserver)
+			resolver.SetIPv6(ipv6)
+			d.resolver = NewCachingResolver(resolver)
+		}
+	}
+	if !resolve {
+		// mount targets are given by address, the region is only needed to provision file systems
+		d.region, d.availZone = envRegion(region), availZone
+		return d, nil
 	}
-	md, err := fetchAWSMetaData()
+	md, err := awsRegion(region, availZone, d.metadata)
 	if err != nil {
-		log.Fatalf("Error resolving AWS metadata: %s", err.Error())
-		os.Exit(1)
+		return d, err
 	}
 	d.region = md.Region
-	return d
+	d.availZone = md.AvailZone
+	go d.restoreTunnels()
+	return d, nil
 }
 
 func (e efsDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
+	log.Debugf("Entering Mount: %v", r)
+	name, _ := resolveName(r.Name)
+	// waiting for a file system still being provisioned doesn't hold up the other volumes
+	if err := e.provisioned(name); err != nil {
+		return nil, err
+	}
 	e.m.Lock()
 	defer e.m.Unlock()
-	hostdir := mountpoint(e.root, r.Name)
-	source := e.fixSource(r.Name, r.ID)
 
-	if e.mountm.HasMount(r.Name) && e.mountm.Count(r.Name) > 0 {
-		log.Infof("Using existing EFS volume mount: %s", hostdir)
-		e.mountm.Increment(r.Name)
-		return &volume.MountResponse{Mountpoint: hostdir}, nil
+	resolvedName, resOpts, hostdir := e.resolveVolume(r.Name)
+	addr, err := ParseShareAddress(e.volumeShare(resolvedName, resOpts), EFS)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Infof("Mounting EFS volume %s on %s", source, hostdir)
+	// a tunneled mount is only usable once its tunnel runs again
+	if err := e.restoreTunnel(resolvedName, hostdir); err != nil {
+		return nil, fmt.Errorf("volume %s: %s", resolvedName, err.Error())
+	}
+	if e.existingMount(resolvedName, hostdir) {
+		return e.mountResponse(resolvedName, hostdir)
+	}
+
+	log.Infof("Mounting EFS volume %s on %s", addr, hostdir)
 
 	if err := createDest(hostdir); err != nil {
 		return nil, err
 	}
 
-	if err := e.mountVolume(source, hostdir); err != nil {
+	e.addMount(resolvedName, hostdir, resOpts)
+
+	if err := e.mountSource(resolvedName, addr, hostdir); err != nil {
+		e.mountm.Decrement(resolvedName)
+		e.tunnels.Release(resolvedName)
 		return nil, err
 	}
-	e.mountm.Add(r.Name, hostdir)
-	return &volume.MountResponse{Mountpoint: hostdir}, nil
+	return e.mountResponse(resolvedName, hostdir)
 }
 
 func (e efsDriver) Unmount(r *volume.UnmountRequest) error {
+	log.Debugf("Entering Unmount: %v", r)
 	e.m.Lock()
 	defer e.m.Unlock()
-	hostdir := mountpoint(e.root, r.Name)
-	source := e.fixSource(r.Name, r.ID)
-
-	if e.mountm.HasMount(r.Name) {
-		if e.mountm.Count(r.Name) > 1 {
-			log.Infof("Skipping unmount for %s - in use by other containers", hostdir)
-			e.mountm.Decrement(r.Name)
-			return nil
-		}
-		e.mountm.Decrement(r.Name)
+
+	resolvedName, _, hostdir := e.resolveVolume(r.Name)
+
+	if e.releaseMount(resolvedName) {
+		return nil
 	}
 
-	log.Infof("Unmounting volume %s from %s", source, hostdir)
+	log.Infof("Unmounting volume %s from %s", resolvedName, hostdir)
 
-	if err := run(fmt.Sprintf("umount %s", hostdir)); err != nil {
+	if err := e.unmountVolume(resolvedName, hostdir); err != nil {
 		return err
 	}
+	e.tunnels.Release(resolvedName)
+	return nil
+}
 
-	e.mountm.DeleteIfNotManaged(r.Name)
-
-	if err := os.RemoveAll(r.Name); err != nil {
+// mountSource mounts the file system on hostdir: through the efs mount helper for access points, through
+// a TLS tunnel when encrypted in transit and otherwise from its mount target.  The volume's nfsopts, or
+// the daemon's, replace DefaultEfsOptions.
+func (e efsDriver) mountSource(name string, addr *ShareAddress, hostdir string) error {
+	opts := e.mountOptions(name)
+	if opts == "" {
+		opts = DefaultEfsOptions
+	} else if !hasMountOption(opts, "nfsvers") && !hasMountOption(opts, "vers") {
+		opts = setMountOption(opts, "nfsvers", "4.1")
+	}
+	accessPoint := e.mountm.GetOption(name, AccessPointOpt)
+	iam := e.mountm.GetOptionAsBool(name, IAMOpt)
+	profile := e.mountm.GetOption(name, AwsProfileOpt)
+	if err := checkAwsProfile(profile); err != nil {
 		return err
 	}
 
-	return nil
+	fstype, source := "nfs4", ""
+	var err error
+	switch {
+	case accessPoint != "":
+		// the efs mount helper sets up its own TLS tunnel and signs IAM requests for access points
+		if source, err = accessPointSource(addr, accessPoint); err != nil {
+			return err
+		}
+		fstype = "efs"
+		opts = setMountOption(setMountOption(opts, "tls", ""), AccessPointOpt, accessPoint)
+		if iam {
+			opts = setMountOption(opts, IAMOpt, "")
+			if profile != "" {
+				opts = setMountOption(opts, AwsProfileOpt, profile)
+			}
+		}
+		e.mountm.SetStatus(name, StatusAccessPoint, accessPoint)
+	case iam || e.useTLS(name):
+		var identity *efsIdentity
+		if iam {
+			identity = newEFSIdentity(profile, e.region, "", e.metadata)
+		}
+		port := 0
+		if source, port, err = e.tunnelSource(name, addr, identity, 0); err != nil {
+			return err
+		}
+		opts = setMountOption(opts, "port", strconv.Itoa(port))
+		e.mountm.SetStatus(name, StatusTLS, e.tunnels.Status(name))
+	default:
+		source = bracketHost(e.mountTarget(addr.Host())) + ":" + addr.Path
+	}
+	if az := e.zones[addr.Host()]; az != "" {
+		e.mountm.SetStatus(name, StatusAvailZone, az)
+	}
+
+	key := shareKey(EFS.String(), addr.String(), fstype, opts)
+	return e.mountShared(name, key, hostdir, func(dest string) error {
+		return e.mountVolume(fstype, opts, source, dest)
+	})
 }
 
-func (e efsDriver) fixSource(name, id string) string {
-	if e.mountm.HasOption(name, ShareOpt) {
-		name = e.mountm.GetOption(name, ShareOpt)
+// useTLS reports whether the volume is mounted through a TLS tunnel, the tls option overrides the
+// daemon's --tls flag
+func (e efsDriver) useTLS(name string) bool {
+	if e.mountm.GetOption(name, TLSOpt) == "" {
+		return e.tls
 	}
+	return e.mountm.GetOptionAsBool(name, TLSOpt)
+}
 
-	v := strings.Split(name, "/")
-	reg, _ := regexp.Compile("([0-9]+\\.[0-9]+\\.[0-9]+\\.[0-9]+)$")
-	uri := reg.FindString(v[0])
+// tunnelSource starts or joins the TLS tunnel to the file system's mount target and returns the local
+// source and port to mount.  A new tunnel listens on port unless it is 0.  A tunnel with an identity
+// authorizes its connections with IAM.
+func (e efsDriver) tunnelSource(name string, addr *ShareAddress, identity *efsIdentity, port int) (string, int, error) {
+	fsid := addr.Host()
+	if !e.resolve || !efsFileSystemID.MatchString(fsid) {
+		return "", 0, fmt.Errorf("encryption in transit and IAM need a file system id (fs-...) as the share, not %s", fsid)
+	}
+	if identity != nil {
+		identity.fsid = fsid
+	}
+	target := net.JoinHostPort(e.mountTarget(fsid), strconv.Itoa(EfsNfsPort))
+	port, err := e.tunnels.Acquire(name, fsid, target, fmt.Sprintf(EfsTemplateURI, fsid, e.region), identity, port)
+	if err != nil {
+		return "", 0, err
+	}
+	return "127.0.0.1:" + addr.Path, port, nil
+}
 
-	if e.resolve {
-		uri = fmt.Sprintf(EfsTemplateURI, v[0], e.region)
-		if i, ok := e.dnscache[uri]; ok {
-			uri = i
+// restoreTunnels starts the TLS tunnels of the volumes which were mounted through one before the plugin
+// restarted.  The mounts, and the containers' binds of them, stay pinned to the old local port.
+func (e efsDriver) restoreTunnels() {
+	e.m.Lock()
+	defer e.m.Unlock()
+	for _, name := range e.mountm.Names() {
+		if err := e.restoreTunnel(name, e.mountm.GetHostDir(name)); err != nil {
+			log.Warnf("Volume %s: %s, its mount can't reach the file system until it is mounted again", name, err.Error())
 		}
+	}
+}
 
-		log.Debugf("Attempting to resolve: %s", uri)
-		if ip, err := e.resolver.Lookup(uri); err == nil {
-			log.Debugf("Resolved Addresses: %s", ip)
-			e.dnscache[uri] = ip
-			uri = ip
-		} else {
-			log.Errorf("Error during resolve: %s", err.Error())
-		}
+// restoreTunnel starts the tunnel a mount on hostdir goes through on its port, unless the volume isn't
+// mounted through a tunnel or its tunnel is running.  Access points use the efs mount helper's tunnel.
+func (e efsDriver) restoreTunnel(name, hostdir string) error {
+	source, fstype, options, mounted := procMount(hostdir)
+	port, tunneled := tunnelPort(source, fstype, options)
+	if !mounted || !tunneled || e.mountm.GetOption(name, AccessPointOpt) != "" || e.tunnels.Has(name) {
+		return nil
+	}
+	addr, err := ParseShareAddress(e.volumeShare(name, nil), EFS)
+	if err != nil {
+		return err
+	}
+	var identity *efsIdentity
+	if e.mountm.GetOptionAsBool(name, IAMOpt) {
+		identity = newEFSIdentity(e.mountm.GetOption(name, AwsProfileOpt), e.region, "", e.metadata)
+	}
+	_, got, err := e.tunnelSource(name, addr, identity, port)
+	if err != nil {
+		return fmt.Errorf("restoring the TLS tunnel on port %d failed: %s", port, err.Error())
 	}
-	v[0] = uri + ":"
-	return strings.Join(v, "/")
+	if got != port {
+		e.tunnels.Release(name)
+		return fmt.Errorf("the TLS tunnel of %s runs on port %d, not on port %d of the mount", addr.Host(), got, port)
+	}
+	e.mountm.SetStatus(name, StatusTLS, e.tunnels.Status(name))
+	log.Infof("Restored the TLS tunnel of volume %s on port %d", name, port)
+	return nil
+}
+
+// mountTarget returns the address of the mount target for host, which is a file system id when
+// resolving is enabled
+func (e efsDriver) mountTarget(host string) string {
+	if !e.resolve {
+		reg, _ := regexp.Compile("([0-9]+\\.[0-9]+\\.[0-9]+\\.[0-9]+)$")
+		return reg.FindString(host)
+	}
+	return e.zoneMountTarget(host)
+}
+
+// needRegion fails features which can't work without the AWS region
+func (e efsDriver) needRegion(feature string) error {
+	if e.region == "" {
+		return fmt.Errorf("%s needs the AWS region, set it with --region or AWS_REGION", feature)
+	}
+	return nil
 }
 
-func (e efsDriver) mountVolume(source, dest string) error {
-	cmd := fmt.Sprintf("mount -t nfs4 -o nfsvers=4.1 %s %s", source, dest)
+func (e efsDriver) lookupTarget(name string) (string, error) {
+	log.Debugf("Attempting to resolve: %s", name)
+	ip, err := e.resolver.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Resolved Address: %s", ip)
+	return ip, nil
+}
+
+func (e efsDriver) mountVolume(fstype, opts, source, dest string) error {
+	mountCmd := "mount"
+	if log.GetLevel() == log.DebugLevel {
+		mountCmd = mountCmd + " -v"
+	}
+	cmd := fmt.Sprintf("%s -t %s -o %s %s %s", mountCmd, fstype, opts, source, dest)
 	log.Debugf("exec: %s\n", cmd)
 	return run(cmd)
 }
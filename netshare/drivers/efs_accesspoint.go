@@ -0,0 +1,28 @@
+package drivers
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	AccessPointOpt    = "accesspoint"
+	StatusAccessPoint = "accesspoint"
+)
+
+var (
+	efsFileSystemID  = regexp.MustCompile(`^fs-[0-9a-f]+$`)
+	efsAccessPointID = regexp.MustCompile(`^fsap-[0-9a-f]+$`)
+)
+
+// accessPointSource returns the fsid:/path source the efs mount helper expects.  Access points are
+// enforced by the helper, which needs the file system id rather than a mount target address.
+func accessPointSource(addr *ShareAddress, accessPoint string) (string, error) {
+	if !efsAccessPointID.MatchString(accessPoint) {
+		return "", fmt.Errorf("invalid access point id %s, expected fsap-...", accessPoint)
+	}
+	if !efsFileSystemID.MatchString(addr.Host()) {
+		return "", fmt.Errorf("%s=%s needs a file system id (fs-...) as the share, not %s", AccessPointOpt, accessPoint, addr.Host())
+	}
+	return addr.Host() + ":" + addr.Path, nil
+}
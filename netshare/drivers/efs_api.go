@@ -0,0 +1,222 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	EfsEndpointURI      = "https://elasticfilesystem.%s.amazonaws.com"
+	EnvAwsEfsEndpoint   = "AWS_ENDPOINT_URL_EFS"
+	efsAPIVersionPrefix = "/2015-02-01"
+)
+
+// efsAPI is a small client of the EFS API, signing its requests with SigV4
+type efsAPI struct {
+	endpoint string
+	region   string
+	metadata *metaDataClient
+	client   *http.Client
+}
+
+// efsAPIError is an error answer of the EFS API
+type efsAPIError struct {
+	Status       int    `json:"-"`
+	ErrorCode    string `json:"ErrorCode"`
+	Message      string `json:"Message"`
+	FileSystemID string `json:"FileSystemId"`
+}
+
+func (e *efsAPIError) Error() string {
+	return fmt.Sprintf("EFS API error %s (%d): %s", e.ErrorCode, e.Status, e.Message)
+}
+
+type efsTag struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+}
+
+type efsFileSystem struct {
+	FileSystemID    string   `json:"FileSystemId"`
+	CreationToken   string   `json:"CreationToken"`
+	LifeCycleState  string   `json:"LifeCycleState"`
+	PerformanceMode string   `json:"PerformanceMode,omitempty"`
+	ThroughputMode  string   `json:"ThroughputMode,omitempty"`
+	Encrypted       bool     `json:"Encrypted"`
+	Tags            []efsTag `json:"Tags,omitempty"`
+}
+
+type efsMountTarget struct {
+	MountTargetID        string `json:"MountTargetId"`
+	FileSystemID         string `json:"FileSystemId"`
+	SubnetID             string `json:"SubnetId"`
+	LifeCycleState       string `json:"LifeCycleState"`
+	IPAddress            string `json:"IpAddress"`
+	AvailabilityZoneName string `json:"AvailabilityZoneName"`
+}
+
+// newEFSAPI returns a client of endpoint, AWS_ENDPOINT_URL_EFS or the regional endpoint
+func newEFSAPI(endpoint, region string, metadata *metaDataClient) *efsAPI {
+	if endpoint == "" {
+		endpoint = os.Getenv(EnvAwsEfsEndpoint)
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf(EfsEndpointURI, region)
+	}
+	return &efsAPI{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		region:   region,
+		metadata: metadata,
+		client:   &http.Client{Timeout: AwsRequestTimeout},
+	}
+}
+
+func (a *efsAPI) CreateFileSystem(fs map[string]interface{}) (*efsFileSystem, error) {
+	out := &efsFileSystem{}
+	return out, a.call("POST", "/file-systems", nil, fs, out)
+}
+
+func (a *efsAPI) DescribeFileSystem(id string) (*efsFileSystem, error) {
+	out := struct {
+		FileSystems []efsFileSystem `json:"FileSystems"`
+	}{}
+	if err := a.call("GET", "/file-systems", url.Values{"FileSystemId": {id}}, nil, &out); err != nil {
+		return nil, err
+	}
+	if len(out.FileSystems) == 0 {
+		return nil, &efsAPIError{Status: http.StatusNotFound, ErrorCode: "FileSystemNotFound", Message: id}
+	}
+	return &out.FileSystems[0], nil
+}
+
+// FindFileSystem returns the file system created with the creation token, or nil when there is none
+func (a *efsAPI) FindFileSystem(token string) (*efsFileSystem, error) {
+	out := struct {
+		FileSystems []efsFileSystem `json:"FileSystems"`
+	}{}
+	if err := a.call("GET", "/file-systems", url.Values{"CreationToken": {token}}, nil, &out); err != nil {
+		return nil, err
+	}
+	if len(out.FileSystems) == 0 {
+		return nil, nil
+	}
+	return &out.FileSystems[0], nil
+}
+
+func (a *efsAPI) DeleteFileSystem(id string) error {
+	return a.call("DELETE", "/file-systems/"+url.QueryEscape(id), nil, nil, nil)
+}
+
+func (a *efsAPI) CreateMountTarget(fsid, subnet string, securityGroups []string) (*efsMountTarget, error) {
+	in := map[string]interface{}{"FileSystemId": fsid, "SubnetId": subnet}
+	if len(securityGroups) > 0 {
+		in["SecurityGroups"] = securityGroups
+	}
+	out := &efsMountTarget{}
+	return out, a.call("POST", "/mount-targets", nil, in, out)
+}
+
+func (a *efsAPI) DescribeMountTargets(fsid string) ([]efsMountTarget, error) {
+	out := struct {
+		MountTargets []efsMountTarget `json:"MountTargets"`
+	}{}
+	err := a.call("GET", "/mount-targets", url.Values{"FileSystemId": {fsid}}, nil, &out)
+	return out.MountTargets, err
+}
+
+func (a *efsAPI) DeleteMountTarget(id string) error {
+	return a.call("DELETE", "/mount-targets/"+url.QueryEscape(id), nil, nil, nil)
+}
+
+// call sends a signed request and decodes the JSON answer into out
+func (a *efsAPI) call(method, path string, query url.Values, in, out interface{}) error {
+	body := []byte{}
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	uri := a.endpoint + efsAPIVersionPrefix + path
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	creds, err := loadAWSCredentials("", a.region, a.metadata)
+	if err != nil {
+		return err
+	}
+	signRequest(req, body, creds, a.region, EfsService, time.Now())
+
+	r, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode/100 != 2 {
+		apiErr := &efsAPIError{}
+		json.Unmarshal(data, apiErr)
+		apiErr.Status = r.StatusCode
+		if apiErr.ErrorCode == "" {
+			apiErr.ErrorCode = strings.SplitN(r.Header.Get("X-Amzn-Errortype"), ":", 2)[0]
+		}
+		return apiErr
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("invalid EFS API response to %s %s: %s", method, path, err.Error())
+		}
+	}
+	return nil
+}
+
+// signRequest adds the SigV4 Authorization header for body to req
+func signRequest(req *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(awsTimeFormat))
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// url.Values sorts by key, SigV4 wants spaces as %20
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	canonical := strings.Join([]string{req.Method, path, query, canonicalHeaders, signed, sha256Hex(string(body))}, "\n")
+	signature := sigv4Sign(creds.SecretAccessKey, now, region, service, sigv4StringToSign(now, region, service, canonical))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, sigv4Scope(now, region, service), signed, signature))
+}
@@ -0,0 +1,259 @@
+package drivers
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	EnvAwsAccessKeyID     = "AWS_ACCESS_KEY_ID"
+	EnvAwsSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+	EnvAwsSessionToken    = "AWS_SESSION_TOKEN"
+	EnvAwsProfile         = "AWS_PROFILE"
+	EnvAwsCredentialsFile = "AWS_SHARED_CREDENTIALS_FILE"
+	EnvAwsRoleArn         = "AWS_ROLE_ARN"
+	EnvAwsRoleSession     = "AWS_ROLE_SESSION_NAME"
+	EnvAwsWebIdentity     = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	EnvAwsStsEndpoint     = "AWS_ENDPOINT_URL_STS"
+	StsURI                = "https://sts.%s.amazonaws.com/"
+	awsTimeFormat         = "20060102T150405Z"
+)
+
+var (
+	// AwsRequestTimeout bounds requests to STS
+	AwsRequestTimeout = 10 * time.Second
+)
+
+// awsCredentials are AWS security credentials and where they came from
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Expiration is zero for long term credentials
+	Expiration time.Time
+	Source     string
+}
+
+// loadAWSCredentials looks up credentials like the AWS SDKs: a named profile if one is given, otherwise the
+// environment, a web identity token, the default profile and finally the instance role.
+func loadAWSCredentials(profile, region string, md *metaDataClient) (*awsCredentials, error) {
+	if profile != "" {
+		return profileCredentials(profile)
+	}
+	if id := os.Getenv(EnvAwsAccessKeyID); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv(EnvAwsSecretAccessKey),
+			SessionToken:    os.Getenv(EnvAwsSessionToken),
+			Source:          "environment",
+		}, nil
+	}
+	if os.Getenv(EnvAwsRoleArn) != "" && os.Getenv(EnvAwsWebIdentity) != "" {
+		return webIdentityCredentials(region)
+	}
+	profile = os.Getenv(EnvAwsProfile)
+	if profile == "" {
+		profile = "default"
+	}
+	if creds, err := profileCredentials(profile); err == nil {
+		return creds, nil
+	} else if os.Getenv(EnvAwsProfile) != "" {
+		return nil, err
+	}
+	return instanceRoleCredentials(md)
+}
+
+func credentialsFile() string {
+	if f := os.Getenv(EnvAwsCredentialsFile); f != "" {
+		return f
+	}
+	return filepath.Join(os.Getenv("HOME"), ".aws", "credentials")
+}
+
+// profileCredentials reads a profile of the shared credentials file
+func profileCredentials(profile string) (*awsCredentials, error) {
+	path := credentialsFile()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := &awsCredentials{Source: "profile " + profile}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("profile %s in %s has no access key", profile, path)
+	}
+	return creds, nil
+}
+
+// instanceRoleCredentials fetches the temporary credentials of the instance profile's role
+func instanceRoleCredentials(md *metaDataClient) (*awsCredentials, error) {
+	role, err := md.Get(iamCredentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials found and the instance role is unavailable: %s", err.Error())
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	if role == "" {
+		return nil, fmt.Errorf("no AWS credentials found and the instance has no role")
+	}
+	body, err := md.Get(iamCredentialsPath + role)
+	if err != nil {
+		return nil, err
+	}
+	doc := struct {
+		Code            string
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}{}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return nil, fmt.Errorf("invalid credentials of instance role %s: %s", role, err.Error())
+	}
+	if doc.Code != "" && doc.Code != "Success" {
+		return nil, fmt.Errorf("credentials of instance role %s are unavailable: %s", role, doc.Code)
+	}
+	return &awsCredentials{
+		AccessKeyID:     doc.AccessKeyID,
+		SecretAccessKey: doc.SecretAccessKey,
+		SessionToken:    doc.Token,
+		Expiration:      doc.Expiration,
+		Source:          "instance role " + role,
+	}, nil
+}
+
+// webIdentityCredentials exchanges the web identity token, as used by EKS service accounts, for role
+// credentials with STS
+func webIdentityCredentials(region string) (*awsCredentials, error) {
+	token, err := ioutil.ReadFile(os.Getenv(EnvAwsWebIdentity))
+	if err != nil {
+		return nil, err
+	}
+	session := os.Getenv(EnvAwsRoleSession)
+	if session == "" {
+		session = fmt.Sprintf("netshare-%d", time.Now().Unix())
+	}
+	endpoint := os.Getenv(EnvAwsStsEndpoint)
+	if endpoint == "" {
+		endpoint = fmt.Sprintf(StsURI, region)
+	}
+	q := url.Values{}
+	q.Set("Action", "AssumeRoleWithWebIdentity")
+	q.Set("Version", "2011-06-15")
+	q.Set("RoleArn", os.Getenv(EnvAwsRoleArn))
+	q.Set("RoleSessionName", session)
+	q.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+	body, err := awsGet(strings.TrimSuffix(endpoint, "/") + "/?" + q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("assuming role %s failed: %s", os.Getenv(EnvAwsRoleArn), err.Error())
+	}
+	doc := struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}{}
+	if err := xml.Unmarshal([]byte(body), &doc); err != nil {
+		return nil, fmt.Errorf("invalid STS response: %s", err.Error())
+	}
+	return &awsCredentials{
+		AccessKeyID:     doc.Credentials.AccessKeyID,
+		SecretAccessKey: doc.Credentials.SecretAccessKey,
+		SessionToken:    doc.Credentials.SessionToken,
+		Expiration:      doc.Credentials.Expiration,
+		Source:          "web identity " + os.Getenv(EnvAwsRoleArn),
+	}, nil
+}
+
+func awsGet(uri string) (string, error) {
+	client := &http.Client{Timeout: AwsRequestTimeout}
+	r, err := client.Get(uri)
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	if r.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", uri, r.Status)
+	}
+	return string(body), nil
+}
+
+// sigv4Scope is the credential scope of a signature: date/region/service/aws4_request
+func sigv4Scope(t time.Time, region, service string) string {
+	return strings.Join([]string{t.UTC().Format("20060102"), region, service, "aws4_request"}, "/")
+}
+
+// sigv4Sign signs stringToSign with the key derived from the secret for the scope's date, region and
+// service and returns the hex encoded signature
+func sigv4Sign(secret string, t time.Time, region, service, stringToSign string) string {
+	key := hmacSHA256([]byte("AWS4"+secret), t.UTC().Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sigv4StringToSign hashes a canonical request into the string to sign
+func sigv4StringToSign(t time.Time, region, service, canonicalRequest string) string {
+	return strings.Join([]string{"AWS4-HMAC-SHA256", t.UTC().Format(awsTimeFormat), sigv4Scope(t, region, service), sha256Hex(canonicalRequest)}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,220 @@
+package drivers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var awsEnv = []string{
+	EnvAwsAccessKeyID, EnvAwsSecretAccessKey, EnvAwsSessionToken, EnvAwsProfile, EnvAwsCredentialsFile,
+	EnvAwsRoleArn, EnvAwsRoleSession, EnvAwsWebIdentity, EnvAwsStsEndpoint, EnvAwsRegion, EnvAwsDefaultRegion,
+}
+
+// setAwsEnv clears the AWS environment, applies env and returns a func restoring the original
+func setAwsEnv(env map[string]string) func() {
+	saved := map[string]string{}
+	for _, k := range awsEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			saved[k] = v
+		}
+		os.Unsetenv(k)
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for _, k := range awsEnv {
+			os.Unsetenv(k)
+		}
+		for k, v := range saved {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// newInstanceRole serves the credentials of role "netshare-role" from an IMDSv2 metadata stand-in
+func newInstanceRole(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == metaDataTokenPath {
+			fmt.Fprint(w, "imds-token")
+			return
+		}
+		if r.Header.Get(metaDataTokenHeader) != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case iamCredentialsPath:
+			fmt.Fprint(w, "netshare-role\n")
+		case iamCredentialsPath + "netshare-role":
+			fmt.Fprint(w, `{"Code": "Success", "AccessKeyId": "ASIAINSTANCE", "SecretAccessKey": "instance-secret",
+				"Token": "instance-token", "Expiration": "2026-10-19T12:00:00Z"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// newSTS answers AssumeRoleWithWebIdentity for the token "web-token"
+func newSTS(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("Action") != "AssumeRoleWithWebIdentity" || q.Get("WebIdentityToken") != "web-token" ||
+			q.Get("RoleArn") != "arn:aws:iam::123456789012:role/netshare" || q.Get("RoleSessionName") != "netshare-test" {
+			t.Errorf("unexpected STS request %s", r.URL.RawQuery)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAWEBIDENTITY</AccessKeyId>
+      <SecretAccessKey>web-secret</SecretAccessKey>
+      <SessionToken>web-session</SessionToken>
+      <Expiration>2026-10-19T13:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`)
+	}))
+}
+
+func TestLoadAWSCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netshare-aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	credsFile := filepath.Join(dir, "credentials")
+	err = ioutil.WriteFile(credsFile, []byte(`[default]
+aws_access_key_id = AKIADEFAULT
+aws_secret_access_key = default-secret
+
+# a named profile
+[named]
+aws_access_key_id=AKIANAMED
+aws_secret_access_key=named-secret
+aws_session_token=named-token
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("web-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	imds := newInstanceRole(t)
+	defer imds.Close()
+	sts := newSTS(t)
+	defer sts.Close()
+
+	all := map[string]string{
+		EnvAwsAccessKeyID:     "AKIAENV",
+		EnvAwsSecretAccessKey: "env-secret",
+		EnvAwsRoleArn:         "arn:aws:iam::123456789012:role/netshare",
+		EnvAwsRoleSession:     "netshare-test",
+		EnvAwsWebIdentity:     tokenFile,
+		EnvAwsStsEndpoint:     sts.URL,
+		EnvAwsCredentialsFile: credsFile,
+	}
+	without := func(keys ...string) map[string]string {
+		env := map[string]string{}
+		for k, v := range all {
+			env[k] = v
+		}
+		for _, k := range keys {
+			delete(env, k)
+		}
+		return env
+	}
+
+	tests := []struct {
+		profile string
+		env     map[string]string
+		source  string
+		id      string
+		token   string
+	}{
+		// an explicit profile wins over everything else
+		{"named", all, "profile named", "AKIANAMED", "named-token"},
+		{"", all, "environment", "AKIAENV", ""},
+		{"", without(EnvAwsAccessKeyID), "web identity arn:aws:iam::123456789012:role/netshare", "ASIAWEBIDENTITY", "web-session"},
+		{"", without(EnvAwsAccessKeyID, EnvAwsRoleArn), "profile default", "AKIADEFAULT", ""},
+		{"", map[string]string{EnvAwsCredentialsFile: credsFile, EnvAwsProfile: "named"}, "profile named", "AKIANAMED", "named-token"},
+		{"", map[string]string{EnvAwsCredentialsFile: filepath.Join(dir, "missing")}, "instance role netshare-role", "ASIAINSTANCE", "instance-token"},
+	}
+	for _, tt := range tests {
+		restore := setAwsEnv(tt.env)
+		creds, err := loadAWSCredentials(tt.profile, "us-east-1", newMetaDataClient(imds.URL))
+		restore()
+		if err != nil {
+			t.Errorf("%s: %s", tt.source, err)
+			continue
+		}
+		if creds.Source != tt.source || creds.AccessKeyID != tt.id || creds.SessionToken != tt.token {
+			t.Errorf("loadAWSCredentials = %+v, want %s from %s with token %q", creds, tt.id, tt.source, tt.token)
+		}
+	}
+
+	// temporary credentials keep their expiry
+	restore := setAwsEnv(without(EnvAwsAccessKeyID))
+	creds, err := loadAWSCredentials("", "us-east-1", newMetaDataClient(imds.URL))
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC); !creds.Expiration.Equal(want) {
+		t.Errorf("web identity expiration = %s, want %s", creds.Expiration, want)
+	}
+}
+
+func TestLoadAWSCredentialsMissingProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netshare-aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credsFile := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(credsFile, []byte("[default]\naws_access_key_id = AKIADEFAULT\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	imds := newInstanceRole(t)
+	defer imds.Close()
+
+	// a profile requested through AWS_PROFILE must not silently fall back to the instance role
+	restore := setAwsEnv(map[string]string{EnvAwsCredentialsFile: credsFile, EnvAwsProfile: "other"})
+	defer restore()
+	if creds, err := loadAWSCredentials("", "us-east-1", newMetaDataClient(imds.URL)); err == nil {
+		t.Errorf("loadAWSCredentials = %+v, want an error for the missing profile", creds)
+	}
+	// neither does a default profile without a secret key
+	os.Unsetenv(EnvAwsProfile)
+	if _, err := loadAWSCredentials("default", "us-east-1", newMetaDataClient(imds.URL)); err == nil {
+		t.Error("loadAWSCredentials accepted a profile without a secret key")
+	}
+}
+
+// get-vanilla of the AWS Signature Version 4 test suite
+func TestSigV4Sign(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	canonical := "GET\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" + sha256Hex("")
+
+	stringToSign := sigv4StringToSign(now, "us-east-1", "service", canonical)
+	want := "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/service/aws4_request\n" +
+		"bb579772317eb040ac9ed261061d46c1f17a8133879d6129b6e1c25292927e63"
+	if stringToSign != want {
+		t.Errorf("sigv4StringToSign = %q, want %q", stringToSign, want)
+	}
+	signature := sigv4Sign("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", now, "us-east-1", "service", stringToSign)
+	if want := "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"; signature != want {
+		t.Errorf("sigv4Sign = %s, want %s", signature, want)
+	}
+}
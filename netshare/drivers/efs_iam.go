@@ -0,0 +1,207 @@
+package drivers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IAMOpt        = "iam"
+	AwsProfileOpt = "awsprofile"
+	EfsService    = "elasticfilesystem"
+)
+
+var (
+	// extensions the EFS mount target reads IAM authorization from, as written by amazon-efs-utils
+	oidEfsClientAuth = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 4843, 7, 2}
+	oidEfsFileSystem = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 4843, 7, 3}
+
+	// EfsCertificateLifetime is how long a client certificate is used before it is signed again
+	EfsCertificateLifetime = time.Hour
+)
+
+// efsClientAuth is a SigV4 signed "Connect" request, bound to the certificate's public key
+type efsClientAuth struct {
+	AccessKeyID   string `asn1:"explicit,tag:0,utf8"`
+	Signature     []byte `asn1:"explicit,tag:1"`
+	SigV4DateTime string `asn1:"explicit,tag:2,utf8"`
+	SessionToken  string `asn1:"optional,explicit,tag:3,utf8"`
+}
+
+// efsIdentity signs the client certificates a TLS tunnel presents so the mount target can authorize the
+// connection against the file system policy
+type efsIdentity struct {
+	profile  string
+	region   string
+	fsid     string
+	metadata *metaDataClient
+	m        *sync.Mutex
+	key      *rsa.PrivateKey
+	refresh  time.Time
+	source   string
+}
+
+func newEFSIdentity(profile, region, fsid string, metadata *metaDataClient) *efsIdentity {
+	return &efsIdentity{profile: profile, region: region, fsid: fsid, metadata: metadata, m: &sync.Mutex{}}
+}
+
+// Key identifies tunnels which can present the same certificate
+func (i *efsIdentity) Key() string {
+	return IAMOpt + ":" + i.profile
+}
+
+// Source names where the credentials came from
+func (i *efsIdentity) Source() string {
+	i.m.Lock()
+	defer i.m.Unlock()
+	return i.source
+}
+
+// Expired reports whether the certificate should be signed again
+func (i *efsIdentity) Expired() bool {
+	i.m.Lock()
+	defer i.m.Unlock()
+	return time.Now().After(i.refresh)
+}
+
+// Certificate loads the current credentials and signs a new client certificate with them
+func (i *efsIdentity) Certificate() (tls.Certificate, error) {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	creds, err := loadAWSCredentials(i.profile, i.region, i.metadata)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if i.key == nil {
+		if i.key, err = rsa.GenerateKey(rand.Reader, 3072); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	now := time.Now().UTC()
+	cert, err := efsClientCertificate(i.key, creds, i.region, i.fsid, now)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	i.source = creds.Source
+	i.refresh = now.Add(EfsCertificateLifetime)
+	// temporary credentials must still be valid when the tunnel connects
+	if !creds.Expiration.IsZero() && creds.Expiration.Add(-5*time.Minute).Before(i.refresh) {
+		i.refresh = creds.Expiration.Add(-5 * time.Minute)
+	}
+	return cert, nil
+}
+
+// efsClientCertificate creates a self signed certificate carrying a SigV4 signature of the file system
+// id and the hash of key's public key
+func efsClientCertificate(key *rsa.PrivateKey, creds *awsCredentials, region, fsid string, now time.Time) (tls.Certificate, error) {
+	pubHash, err := publicKeyHash(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	canonical := efsCanonicalRequest(pubHash, creds, region, fsid, now)
+	signature := sigv4Sign(creds.SecretAccessKey, now, region, EfsService, sigv4StringToSign(now, region, EfsService, canonical))
+
+	auth, err := asn1.Marshal(efsClientAuth{
+		AccessKeyID:   creds.AccessKeyID,
+		Signature:     []byte(signature),
+		SigV4DateTime: now.Format(awsTimeFormat),
+		SessionToken:  creds.SessionToken,
+	})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	fs, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(fsid)})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyID, _ := hex.DecodeString(pubHash)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "docker-volume-netshare"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(24 * time.Hour),
+		SubjectKeyId:          keyID,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidEfsClientAuth, Value: auth},
+			{Id: oidEfsFileSystem, Value: fs},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// efsCanonicalRequest is the canonical form of the "Connect" request the mount target verifies
+func efsCanonicalRequest(pubHash string, creds *awsCredentials, region, fsid string, now time.Time) string {
+	params := map[string]string{
+		"Action":              "Connect",
+		"PublicKeyHash":       url.QueryEscape(pubHash),
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    url.QueryEscape(creds.AccessKeyID + "/" + sigv4Scope(now, region, EfsService)),
+		"X-Amz-Date":          url.QueryEscape(now.Format(awsTimeFormat)),
+		"X-Amz-Expires":       "86400",
+		"X-Amz-SignedHeaders": "host",
+	}
+	if creds.SessionToken != "" {
+		params["X-Amz-Security-Token"] = url.QueryEscape(creds.SessionToken)
+	}
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	query := []string{}
+	for _, k := range keys {
+		query = append(query, k+"="+params[k])
+	}
+	return strings.Join([]string{"GET", "/", strings.Join(query, "&"), "host:" + fsid, "host", sha256Hex("")}, "\n")
+}
+
+// publicKeyHash is the hex SHA-1 of the subjectPublicKey bit string of key
+func publicKeyHash(key *rsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	spki := struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checkAwsProfile rejects profile names which can't be passed on to the efs mount helper
+func checkAwsProfile(profile string) error {
+	if strings.ContainsAny(profile, ", ") {
+		return fmt.Errorf("invalid %s %q", AwsProfileOpt, profile)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package drivers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+var efsTestCreds = &awsCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	SessionToken:    "session/token+==",
+}
+
+// the expected values follow the request amazon-efs-utils signs, computed independently of this package
+func TestEFSCanonicalRequest(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	canonical := efsCanonicalRequest("7c8e5d3f0e1a2b4c6d8e9f0a1b2c3d4e5f607182", efsTestCreds, "us-east-1", "fs-deadbeef", now)
+
+	want := "GET\n/\n" +
+		"Action=Connect&PublicKeyHash=7c8e5d3f0e1a2b4c6d8e9f0a1b2c3d4e5f607182&X-Amz-Algorithm=AWS4-HMAC-SHA256" +
+		"&X-Amz-Credential=AKIDEXAMPLE%2F20150830%2Fus-east-1%2Felasticfilesystem%2Faws4_request" +
+		"&X-Amz-Date=20150830T123600Z&X-Amz-Expires=86400&X-Amz-Security-Token=session%2Ftoken%2B%3D%3D" +
+		"&X-Amz-SignedHeaders=host\n" +
+		"host:fs-deadbeef\nhost\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if canonical != want {
+		t.Errorf("efsCanonicalRequest = %q, want %q", canonical, want)
+	}
+
+	signature := sigv4Sign(efsTestCreds.SecretAccessKey, now, "us-east-1", EfsService, sigv4StringToSign(now, "us-east-1", EfsService, canonical))
+	if want := "6d3162c7bc5d145f4dce9a2aa19e4ed935099fd22e6914e95f776ad4a913fd78"; signature != want {
+		t.Errorf("signature = %s, want %s", signature, want)
+	}
+}
+
+func TestEFSClientCertificate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	tlsCert, err := efsClientCertificate(key, efsTestCreds, "eu-west-1", "fs-0123456789abcdef0", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(cert); err != nil {
+		t.Errorf("certificate isn't self signed: %s", err)
+	}
+
+	pubHash, err := publicKeyHash(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(cert.SubjectKeyId); got != pubHash {
+		t.Errorf("subject key id = %s, want the public key hash %s", got, pubHash)
+	}
+
+	var auth *efsClientAuth
+	fsid := ""
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidEfsClientAuth):
+			auth = &efsClientAuth{}
+			if rest, err := asn1.Unmarshal(ext.Value, auth); err != nil || len(rest) != 0 {
+				t.Fatalf("invalid client auth extension: %v", err)
+			}
+		case ext.Id.Equal(oidEfsFileSystem):
+			v := asn1.RawValue{}
+			if _, err := asn1.Unmarshal(ext.Value, &v); err != nil {
+				t.Fatal(err)
+			}
+			if v.Tag != asn1.TagUTF8String {
+				t.Errorf("file system extension has tag %d, want a UTF8String", v.Tag)
+			}
+			fsid = string(v.Bytes)
+		}
+	}
+	if fsid != "fs-0123456789abcdef0" {
+		t.Errorf("file system extension = %q", fsid)
+	}
+	if auth == nil {
+		t.Fatal("certificate has no client auth extension")
+	}
+
+	canonical := efsCanonicalRequest(pubHash, efsTestCreds, "eu-west-1", "fs-0123456789abcdef0", now)
+	signature := sigv4Sign(efsTestCreds.SecretAccessKey, now, "eu-west-1", EfsService, sigv4StringToSign(now, "eu-west-1", EfsService, canonical))
+	want := efsClientAuth{
+		AccessKeyID:   "AKIDEXAMPLE",
+		Signature:     []byte(signature),
+		SigV4DateTime: "20261019T080000Z",
+		SessionToken:  "session/token+==",
+	}
+	if auth.AccessKeyID != want.AccessKeyID || string(auth.Signature) != string(want.Signature) ||
+		auth.SigV4DateTime != want.SigV4DateTime || auth.SessionToken != want.SessionToken {
+		t.Errorf("client auth = %+v, want %+v", auth, want)
+	}
+}
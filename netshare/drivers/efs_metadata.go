@@ -2,11 +2,36 @@ package drivers
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const (
-	MetaDataURL = "http://169.254.169.254/latest/dynamic/instance-identity/document"
+	DefaultMetaDataEndpoint = "http://169.254.169.254"
+	EnvMetaDataEndpoint     = "AWS_EC2_METADATA_SERVICE_ENDPOINT"
+	EnvAwsRegion            = "AWS_REGION"
+	EnvAwsDefaultRegion     = "AWS_DEFAULT_REGION"
+	identityDocumentPath    = "/latest/dynamic/instance-identity/document"
+	availZonePath           = "/latest/meta-data/placement/availability-zone"
+	iamCredentialsPath      = "/latest/meta-data/iam/security-credentials/"
+	metaDataTokenPath       = "/latest/api/token"
+	metaDataTokenHeader     = "X-aws-ec2-metadata-token"
+	metaDataTokenTTLHeader  = "X-aws-ec2-metadata-token-ttl-seconds"
+)
+
+var (
+	// MetaDataTimeout bounds each request to the instance metadata service
+	MetaDataTimeout = 2 * time.Second
+	// MetaDataTokenTTL is the lifetime of IMDSv2 session tokens
+	MetaDataTokenTTL = 6 * time.Hour
 )
 
 type metaData struct {
@@ -14,14 +39,139 @@ type metaData struct {
 	Region    string `json:"region,omitempty"`
 }
 
-func fetchAWSMetaData() (*metaData, error) {
-	r, err := http.Get(MetaDataURL)
+// metaDataClient reads the instance metadata service with IMDSv2 session tokens, falling back to IMDSv1
+// when the service doesn't hand out tokens
+type metaDataClient struct {
+	endpoint string
+	client   *http.Client
+	m        *sync.Mutex
+	token    string
+	expires  time.Time
+}
+
+// newMetaDataClient returns a client of the metadata service at endpoint, AWS_EC2_METADATA_SERVICE_ENDPOINT
+// or the link local address
+func newMetaDataClient(endpoint string) *metaDataClient {
+	if endpoint == "" {
+		endpoint = os.Getenv(EnvMetaDataEndpoint)
+	}
+	if endpoint == "" {
+		endpoint = DefaultMetaDataEndpoint
+	}
+	return &metaDataClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: MetaDataTimeout},
+		m:        &sync.Mutex{},
+	}
+}
+
+// Get returns the document at path, e.g. /latest/meta-data/placement/availability-zone
+func (c *metaDataClient) Get(path string) (string, error) {
+	req, err := http.NewRequest("GET", c.endpoint+path, nil)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	if token := c.sessionToken(); token != "" {
+		req.Header.Set(metaDataTokenHeader, token)
+	}
+	r, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("instance metadata service at %s is unavailable: %s", c.endpoint, err.Error())
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	if r.StatusCode == http.StatusUnauthorized {
+		// the token was revoked or the service restarted
+		c.m.Lock()
+		c.token = ""
+		c.m.Unlock()
+	}
+	if r.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata %s returned %s", path, r.Status)
+	}
+	return string(body), nil
+}
+
+// sessionToken returns an IMDSv2 token, fetching a new one when it expires.  An empty token means the
+// service only speaks IMDSv1.
+func (c *metaDataClient) sessionToken() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token
+	}
+
+	req, err := http.NewRequest("PUT", c.endpoint+metaDataTokenPath, nil)
+	if err != nil {
+		return ""
+	}
+	ttl := int(MetaDataTokenTTL / time.Second)
+	req.Header.Set(metaDataTokenTTLHeader, strconv.Itoa(ttl))
+	r, err := c.client.Do(req)
+	if err != nil {
+		return ""
 	}
 	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || r.StatusCode != http.StatusOK {
+		return ""
+	}
+	c.token = strings.TrimSpace(string(body))
+	// renew a minute early so requests don't race the expiry
+	c.expires = time.Now().Add(time.Duration(ttl)*time.Second - time.Minute)
+	return c.token
+}
 
+// Identity returns the region and availability zone from the instance identity document
+func (c *metaDataClient) Identity() (*metaData, error) {
+	body, err := c.Get(identityDocumentPath)
+	if err != nil {
+		return nil, err
+	}
 	md := &metaData{}
-	json.NewDecoder(r.Body).Decode(md)
+	if err := json.Unmarshal([]byte(body), md); err != nil {
+		return nil, fmt.Errorf("invalid instance identity document: %s", err.Error())
+	}
+	if md.Region == "" {
+		return nil, fmt.Errorf("instance identity document has no region")
+	}
 	return md, nil
 }
+
+// awsRegion returns region, the region from the environment or from the instance metadata, in that
+// order.  Without availZone the instance's zone is looked up as well, which is optional when the region
+// is known.
+func awsRegion(region, availZone string, md *metaDataClient) (*metaData, error) {
+	if region = envRegion(region); region != "" {
+		if availZone == "" {
+			az, err := md.Get(availZonePath)
+			if err != nil {
+				log.Warnf("No availability zone given and %s, using the regional mount targets", err.Error())
+			}
+			availZone = strings.TrimSpace(az)
+		}
+		return &metaData{Region: region, AvailZone: availZone}, nil
+	}
+	doc, err := md.Identity()
+	if err != nil {
+		return nil, fmt.Errorf("no region given and %s", err.Error())
+	}
+	if availZone != "" {
+		doc.AvailZone = availZone
+	}
+	return doc, nil
+}
+
+// envRegion returns region or the region from the environment
+func envRegion(region string) string {
+	if region == "" {
+		region = os.Getenv(EnvAwsRegion)
+	}
+	if region == "" {
+		region = os.Getenv(EnvAwsDefaultRegion)
+	}
+	return region
+}
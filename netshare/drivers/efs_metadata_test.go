@@ -0,0 +1,220 @@
+package drivers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMetaData is an instance metadata service handing out the token "token-<n>" on the n-th PUT.
+// Without tokens it behaves like a service which only speaks IMDSv1.
+type fakeMetaData struct {
+	m        sync.Mutex
+	tokens   bool
+	puts     int
+	ttls     []string
+	token    string
+	requests []string
+	docs     map[string]string
+}
+
+func (f *fakeMetaData) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	if r.Method == "PUT" && r.URL.Path == metaDataTokenPath {
+		if !f.tokens {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.puts++
+		f.ttls = append(f.ttls, r.Header.Get(metaDataTokenTTLHeader))
+		f.token = "token-" + strconv.Itoa(f.puts)
+		fmt.Fprint(w, f.token)
+		return
+	}
+	if f.tokens && r.Header.Get(metaDataTokenHeader) != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	doc, found := f.docs[r.URL.Path]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, doc)
+}
+
+// revoke invalidates the current token, as when the service restarts
+func (f *fakeMetaData) revoke() {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.token = "revoked"
+}
+
+func newFakeMetaData(tokens bool) *fakeMetaData {
+	return &fakeMetaData{
+		tokens: tokens,
+		docs: map[string]string{
+			availZonePath:        "eu-west-1b",
+			identityDocumentPath: `{"availabilityZone": "eu-west-1c", "region": "eu-west-1"}`,
+		},
+	}
+}
+
+func TestMetaDataSessionToken(t *testing.T) {
+	f := newFakeMetaData(true)
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	md := newMetaDataClient(server.URL)
+	for i := 0; i < 3; i++ {
+		az, err := md.Get(availZonePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if az != "eu-west-1b" {
+			t.Errorf("Get = %q, want eu-west-1b", az)
+		}
+	}
+	// the token is reused until it expires
+	if f.puts != 1 {
+		t.Errorf("%d token requests, want 1", f.puts)
+	}
+	if want := strconv.Itoa(int(MetaDataTokenTTL / time.Second)); f.ttls[0] != want {
+		t.Errorf("token TTL header = %q, want %s", f.ttls[0], want)
+	}
+}
+
+func TestMetaDataV1Fallback(t *testing.T) {
+	f := newFakeMetaData(false)
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	md := newMetaDataClient(server.URL)
+	az, err := md.Get(availZonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if az != "eu-west-1b" {
+		t.Errorf("Get = %q, want eu-west-1b", az)
+	}
+	want := []string{"PUT " + metaDataTokenPath, "GET " + availZonePath}
+	if fmt.Sprint(f.requests) != fmt.Sprint(want) {
+		t.Errorf("requests = %v, want %v", f.requests, want)
+	}
+}
+
+func TestMetaDataUnauthorized(t *testing.T) {
+	f := newFakeMetaData(true)
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	md := newMetaDataClient(server.URL)
+	if _, err := md.Get(availZonePath); err != nil {
+		t.Fatal(err)
+	}
+	f.revoke()
+	// the rejected token is dropped and the next request fetches a new one
+	if _, err := md.Get(availZonePath); err == nil {
+		t.Error("Get succeeded with a revoked token")
+	}
+	az, err := md.Get(availZonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if az != "eu-west-1b" {
+		t.Errorf("Get = %q, want eu-west-1b", az)
+	}
+	if f.puts != 2 || f.token != "token-2" {
+		t.Errorf("%d token requests, current token %s, want a second token", f.puts, f.token)
+	}
+}
+
+func TestMetaDataTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	timeout := MetaDataTimeout
+	MetaDataTimeout = 100 * time.Millisecond
+	md := newMetaDataClient(server.URL)
+	MetaDataTimeout = timeout
+
+	start := time.Now()
+	if _, err := md.Get(availZonePath); err == nil {
+		t.Error("Get succeeded against a hanging service")
+	}
+	// one timeout for the token and one for the request
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Get took %s", elapsed)
+	}
+}
+
+func TestAwsRegion(t *testing.T) {
+	f := newFakeMetaData(true)
+	server := httptest.NewServer(f)
+	defer server.Close()
+	restore := setAwsEnv(nil)
+	defer restore()
+
+	tests := []struct {
+		region    string
+		availZone string
+		want      metaData
+	}{
+		{"", "", metaData{Region: "eu-west-1", AvailZone: "eu-west-1c"}},
+		{"", "eu-west-1a", metaData{Region: "eu-west-1", AvailZone: "eu-west-1a"}},
+		// the zone is still looked up when only the region is given
+		{"eu-west-1", "", metaData{Region: "eu-west-1", AvailZone: "eu-west-1b"}},
+		{"eu-west-1", "eu-west-1a", metaData{Region: "eu-west-1", AvailZone: "eu-west-1a"}},
+	}
+	for _, tt := range tests {
+		md, err := awsRegion(tt.region, tt.availZone, newMetaDataClient(server.URL))
+		if err != nil {
+			t.Errorf("awsRegion(%q, %q): %s", tt.region, tt.availZone, err)
+			continue
+		}
+		if *md != tt.want {
+			t.Errorf("awsRegion(%q, %q) = %+v, want %+v", tt.region, tt.availZone, *md, tt.want)
+		}
+	}
+
+	// without the metadata service a given region is enough
+	server.Close()
+	md, err := awsRegion("eu-west-1", "", newMetaDataClient(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Region != "eu-west-1" || md.AvailZone != "" {
+		t.Errorf("awsRegion = %+v, want eu-west-1 without a zone", *md)
+	}
+	if _, err := awsRegion("", "", newMetaDataClient(server.URL)); err == nil {
+		t.Error("awsRegion succeeded without a region and metadata")
+	}
+}
+
+func TestNewEFSDriverNoResolve(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected metadata request %s %s", r.Method, r.URL.Path)
+	}))
+	defer server.Close()
+	restore := setAwsEnv(nil)
+	defer restore()
+
+	d, err := NewEFSDriver("/tmp/netshare-efs", "", "", "", server.URL, "", "", false, false, false, false, NewVolumeManager())
+	if err != nil {
+		t.Fatalf("NewEFSDriver without resolve and region: %s", err)
+	}
+	if err := d.needRegion("provisioning"); err == nil {
+		t.Error("provisioning is allowed without a region")
+	}
+}
@@ -0,0 +1,510 @@
+package drivers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ProvisionOpt       = "provision"
+	PerformanceModeOpt = "performancemode"
+	ThroughputModeOpt  = "throughputmode"
+	ThroughputOpt      = "throughput"
+	EncryptedOpt       = "encrypted"
+	KmsKeyOpt          = "kmskey"
+	TagsOpt            = "tags"
+	SubnetsOpt         = "subnets"
+	SecurityGroupsOpt  = "securitygroups"
+	DeleteOpt          = "delete"
+	StatusFileSystem   = "filesystem"
+	StatusProvisioning = "provisioning"
+	// efsVolumeTag marks file systems created for a volume
+	efsVolumeTag = "netshare:volume"
+)
+
+var (
+	// ProvisionTimeout bounds waiting for a new file system and its mount targets to become available,
+	// or to be deleted
+	ProvisionTimeout = 10 * time.Minute
+	// ProvisionPollInterval is how often their state is checked meanwhile
+	ProvisionPollInterval = 5 * time.Second
+	// ProvisionMountTimeout bounds how long Mount waits for a file system which is still being provisioned,
+	// keeping the request within docker's plugin timeout
+	ProvisionMountTimeout = 20 * time.Second
+)
+
+// provisionJob waits for a file system and creates its mount targets in the background
+type provisionJob struct {
+	fsid string
+	done chan struct{}
+	err  error
+}
+
+// Wait returns the job's error, or an error when it doesn't finish within timeout
+func (j *provisionJob) Wait(timeout time.Duration) error {
+	select {
+	case <-j.done:
+		return j.err
+	case <-time.After(timeout):
+		return fmt.Errorf("file system %s is still being provisioned, try again later", j.fsid)
+	}
+}
+
+func (j *provisionJob) Finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *provisionJob) Failed() bool {
+	return j.Finished() && j.err != nil
+}
+
+// provisionManager runs one provisioning job per volume
+type provisionManager struct {
+	m    *sync.Mutex
+	jobs map[string]*provisionJob
+}
+
+func newProvisionManager() *provisionManager {
+	return &provisionManager{m: &sync.Mutex{}, jobs: map[string]*provisionJob{}}
+}
+
+// Start runs provision for the volume's file system unless a job for it is running or has succeeded
+func (p *provisionManager) Start(name, fsid string, provision func() error) *provisionJob {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if job, found := p.jobs[name]; found && job.fsid == fsid && !job.Failed() {
+		return job
+	}
+	job := &provisionJob{fsid: fsid, done: make(chan struct{})}
+	p.jobs[name] = job
+	go func() {
+		job.err = provision()
+		close(job.done)
+	}()
+	return job
+}
+
+func (p *provisionManager) Get(name string) *provisionJob {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.jobs[name]
+}
+
+func (p *provisionManager) Forget(name string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	delete(p.jobs, name)
+}
+
+// Create creates a file system for volumes created with provision=true and sets the volume's share to
+// it.  Waiting for the file system and creating its mount targets continues in the background, so Create
+// returns within docker's plugin timeout and Mount waits for them instead.
+func (e efsDriver) Create(r *volume.CreateRequest) error {
+	if !isTrue(r.Options[ProvisionOpt]) {
+		return e.volumeDriver.Create(r)
+	}
+	if _, found := r.Options[ShareOpt]; found {
+		return fmt.Errorf("volume %s: %s=true creates the file system, it can't be combined with %s", r.Name, ProvisionOpt, ShareOpt)
+	}
+	if err := e.needRegion("volume " + r.Name + ": " + ProvisionOpt + "=true"); err != nil {
+		return err
+	}
+	name, _ := resolveName(r.Name)
+	fsid, err := e.createFileSystem(name, r.Options)
+	if err != nil {
+		return err
+	}
+	r.Options[ShareOpt] = fsid + "/"
+	if err := e.volumeDriver.Create(r); err != nil {
+		return err
+	}
+	e.m.Lock()
+	e.mountm.SetStatus(name, StatusFileSystem, fsid)
+	e.m.Unlock()
+	e.startProvision(name, fsid, r.Options)
+	return nil
+}
+
+// Remove deletes the mount targets and the file system of volumes created with provision=true and
+// delete=true.  The volume is only removed once they are gone, so a failed deletion can be retried.
+func (e efsDriver) Remove(r *volume.RemoveRequest) error {
+	name, _ := resolveName(r.Name)
+	e.m.Lock()
+	provisioned := e.mountm.GetOptionAsBool(name, ProvisionOpt) && e.mountm.GetOptionAsBool(name, DeleteOpt)
+	inUse := provisioned && e.mountm.InUse(name)
+	e.m.Unlock()
+
+	if provisioned {
+		if inUse {
+			return fmt.Errorf("volume %s is currently in use", name)
+		}
+		if job := e.provisions.Get(name); job != nil && !job.Finished() {
+			return fmt.Errorf("file system %s of volume %s is still being provisioned", job.fsid, name)
+		}
+		fsid, _, err := e.provisionedFileSystem(name)
+		if err != nil {
+			return err
+		}
+		if fsid != "" {
+			if err := e.deprovision(name, fsid); err != nil {
+				return fmt.Errorf("deleting file system %s of volume %s failed, keeping the volume: %s", fsid, name, err.Error())
+			}
+		}
+	}
+	e.provisions.Forget(name)
+	return e.volumeDriver.Remove(r)
+}
+
+// provisioned waits for the file system of a volume created with provision=true and its mount targets to
+// become available.  After a restart, or when provisioning failed, it is checked and completed again.
+func (e efsDriver) provisioned(name string) error {
+	e.m.Lock()
+	provision := e.mountm.GetOptionAsBool(name, ProvisionOpt)
+	e.m.Unlock()
+	if !provision {
+		return nil
+	}
+
+	job := e.provisions.Get(name)
+	if job == nil || job.Failed() {
+		fsid, opts, err := e.provisionedFileSystem(name)
+		if err != nil {
+			return err
+		}
+		if fsid == "" {
+			return fmt.Errorf("the file system of volume %s no longer exists", name)
+		}
+		job = e.startProvision(name, fsid, opts)
+	}
+	return job.Wait(ProvisionMountTimeout)
+}
+
+// provisionedFileSystem returns the file system of a provisioned volume and a copy of its options.  Docker
+// only keeps the options the volume was created with, so after a restart the file system is looked up by
+// its creation token and the share is set again.  The id is empty when there is no file system.
+func (e efsDriver) provisionedFileSystem(name string) (string, map[string]string, error) {
+	e.m.Lock()
+	opts := map[string]string{}
+	for k, v := range e.mountm.GetOptions(name) {
+		opts[k] = v
+	}
+	e.m.Unlock()
+
+	if share := opts[ShareOpt]; share != "" {
+		addr, err := ParseShareAddress(share, EFS)
+		if err != nil {
+			return "", nil, err
+		}
+		return addr.Host(), opts, nil
+	}
+	if err := e.needRegion("looking up the file system of volume " + name); err != nil {
+		return "", nil, err
+	}
+	fs, err := newEFSAPI(e.endpoint, e.region, e.metadata).FindFileSystem(efsCreationToken(name))
+	if err != nil {
+		return "", nil, fmt.Errorf("looking up the file system of volume %s failed: %s", name, err.Error())
+	}
+	if fs == nil || !createdFor(fs, name) {
+		return "", opts, nil
+	}
+	log.Infof("Found file system %s of volume %s", fs.FileSystemID, name)
+	opts[ShareOpt] = fs.FileSystemID + "/"
+
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.mountm.SetOption(name, ShareOpt, opts[ShareOpt])
+	e.mountm.SetStatus(name, StatusFileSystem, fs.FileSystemID)
+	return fs.FileSystemID, opts, nil
+}
+
+// startProvision completes the provisioning of the volume's file system in the background.  The volume's
+// status shows it as pending until it is done, and shows the error when it fails.
+func (e efsDriver) startProvision(name, fsid string, opts map[string]string) *provisionJob {
+	copied := map[string]string{}
+	for k, v := range opts {
+		copied[k] = v
+	}
+	return e.provisions.Start(name, fsid, func() error {
+		e.setProvisionStatus(name, "pending")
+		err := e.completeProvision(name, fsid, copied)
+		if err != nil {
+			log.Errorf("Provisioning file system %s of volume %s failed: %s", fsid, name, err.Error())
+			e.setProvisionStatus(name, err.Error())
+			return err
+		}
+		e.setProvisionStatus(name, "")
+		return nil
+	})
+}
+
+func (e efsDriver) setProvisionStatus(name, state string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if state == "" {
+		e.mountm.DeleteStatus(name, StatusProvisioning)
+		return
+	}
+	e.mountm.SetStatus(name, StatusProvisioning, state)
+}
+
+// createFileSystem creates the file system of the volume, or finds the one an earlier attempt created
+func (e efsDriver) createFileSystem(name string, opts map[string]string) (string, error) {
+	api := newEFSAPI(e.endpoint, e.region, e.metadata)
+	req, err := fileSystemRequest(name, opts)
+	if err != nil {
+		return "", err
+	}
+
+	fs, err := api.CreateFileSystem(req)
+	if apiErr, ok := err.(*efsAPIError); ok && apiErr.ErrorCode == "FileSystemAlreadyExists" && apiErr.FileSystemID != "" {
+		// the creation token makes retries of a failed create pick up the same file system
+		log.Infof("File system %s for volume %s already exists", apiErr.FileSystemID, name)
+		return apiErr.FileSystemID, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("creating a file system for volume %s failed: %s", name, err.Error())
+	}
+	log.Infof("Created file system %s for volume %s", fs.FileSystemID, name)
+	return fs.FileSystemID, nil
+}
+
+// completeProvision waits for the file system to become available and for a mount target in each subnet,
+// creating those which are missing
+func (e efsDriver) completeProvision(name, fsid string, opts map[string]string) error {
+	api := newEFSAPI(e.endpoint, e.region, e.metadata)
+	err := waitFor(fmt.Sprintf("file system %s", fsid), func() (bool, error) {
+		fs, err := api.DescribeFileSystem(fsid)
+		if err != nil {
+			return false, err
+		}
+		return fs.LifeCycleState == "available", nil
+	})
+	if err != nil {
+		return err
+	}
+
+	subnets, groups, err := e.mountTargetNetwork(opts)
+	if err != nil {
+		return err
+	}
+	existing, err := api.DescribeMountTargets(fsid)
+	if err != nil {
+		return err
+	}
+	for _, subnet := range subnets {
+		if hasMountTarget(existing, subnet) {
+			continue
+		}
+		mt, err := api.CreateMountTarget(fsid, subnet, groups)
+		if err != nil {
+			return fmt.Errorf("creating a mount target of %s in %s failed: %s", fsid, subnet, err.Error())
+		}
+		log.Infof("Created mount target %s of %s in %s for volume %s", mt.MountTargetID, fsid, subnet, name)
+	}
+
+	return waitFor(fmt.Sprintf("mount targets of %s", fsid), func() (bool, error) {
+		targets, err := api.DescribeMountTargets(fsid)
+		if err != nil {
+			return false, err
+		}
+		for _, mt := range targets {
+			if mt.LifeCycleState != "available" {
+				return false, nil
+			}
+		}
+		return len(targets) > 0, nil
+	})
+}
+
+// deprovision deletes the mount targets and then the file system.  File systems which are already gone or
+// weren't created for the volume are left alone.
+func (e efsDriver) deprovision(name, fsid string) error {
+	if err := e.needRegion("deleting file system " + fsid); err != nil {
+		return err
+	}
+	api := newEFSAPI(e.endpoint, e.region, e.metadata)
+	fs, err := api.DescribeFileSystem(fsid)
+	if apiErr, ok := err.(*efsAPIError); ok && apiErr.ErrorCode == "FileSystemNotFound" {
+		log.Infof("File system %s of volume %s is already deleted", fsid, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !createdFor(fs, name) {
+		log.Warnf("File system %s was not created for volume %s, leaving it in place", fsid, name)
+		return nil
+	}
+
+	targets, err := api.DescribeMountTargets(fsid)
+	if err != nil {
+		return err
+	}
+	for _, mt := range targets {
+		if mt.LifeCycleState == "deleting" || mt.LifeCycleState == "deleted" {
+			continue
+		}
+		if err := api.DeleteMountTarget(mt.MountTargetID); err != nil {
+			return err
+		}
+		log.Infof("Deleting mount target %s of %s", mt.MountTargetID, fsid)
+	}
+	err = waitFor(fmt.Sprintf("deletion of the mount targets of %s", fsid), func() (bool, error) {
+		targets, err := api.DescribeMountTargets(fsid)
+		return len(targets) == 0, err
+	})
+	if err != nil {
+		return err
+	}
+	if err := api.DeleteFileSystem(fsid); err != nil {
+		return err
+	}
+	log.Infof("Deleted file system %s of volume %s", fsid, name)
+	return nil
+}
+
+// fileSystemRequest builds the CreateFileSystem request from the volume options
+func fileSystemRequest(name string, opts map[string]string) (map[string]interface{}, error) {
+	req := map[string]interface{}{"CreationToken": efsCreationToken(name)}
+	if mode := opts[PerformanceModeOpt]; mode != "" {
+		req["PerformanceMode"] = mode
+	}
+	if mode := opts[ThroughputModeOpt]; mode != "" {
+		req["ThroughputMode"] = mode
+	}
+	if t := opts[ThroughputOpt]; t != "" {
+		mibps, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s, expected MiB/s", ThroughputOpt, t)
+		}
+		req["ThroughputMode"] = "provisioned"
+		req["ProvisionedThroughputInMibps"] = mibps
+	}
+	if isTrue(opts[EncryptedOpt]) || opts[KmsKeyOpt] != "" {
+		req["Encrypted"] = true
+	}
+	if key := opts[KmsKeyOpt]; key != "" {
+		req["KmsKeyId"] = key
+	}
+
+	tags := []efsTag{{Key: "Name", Value: name}, {Key: efsVolumeTag, Value: name}}
+	if t := opts[TagsOpt]; t != "" {
+		for _, pair := range strings.Split(t, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid %s entry %q, expected key=value", TagsOpt, pair)
+			}
+			if kv[0] == "Name" {
+				tags[0].Value = kv[1]
+				continue
+			}
+			tags = append(tags, efsTag{Key: kv[0], Value: kv[1]})
+		}
+	}
+	req["Tags"] = tags
+	return req, nil
+}
+
+// mountTargetNetwork returns the subnets and security groups for mount targets, from the options or the
+// instance's primary network interface
+func (e efsDriver) mountTargetNetwork(opts map[string]string) ([]string, []string, error) {
+	subnets := splitList(opts[SubnetsOpt])
+	groups := splitList(opts[SecurityGroupsOpt])
+	if len(subnets) > 0 {
+		return subnets, groups, nil
+	}
+
+	mac, err := e.metadata.Get("/latest/meta-data/mac")
+	if err != nil {
+		return nil, nil, fmt.Errorf("no %s given and %s", SubnetsOpt, err.Error())
+	}
+	iface := "/latest/meta-data/network/interfaces/macs/" + strings.TrimSpace(mac)
+	subnet, err := e.metadata.Get(iface + "/subnet-id")
+	if err != nil {
+		return nil, nil, fmt.Errorf("no %s given and %s", SubnetsOpt, err.Error())
+	}
+	if len(groups) == 0 {
+		ids, err := e.metadata.Get(iface + "/security-group-ids")
+		if err != nil {
+			return nil, nil, err
+		}
+		groups = strings.Fields(ids)
+	}
+	return []string{strings.TrimSpace(subnet)}, groups, nil
+}
+
+// efsCreationToken identifies the file system of a volume.  The API allows 64 characters, so the name is
+// hashed to keep long names with a common prefix apart.
+func efsCreationToken(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "netshare-" + hex.EncodeToString(sum[:])[:40]
+}
+
+// createdFor reports whether the file system was provisioned for the volume, by its creation token and
+// volume tag
+func createdFor(fs *efsFileSystem, name string) bool {
+	if fs.CreationToken != efsCreationToken(name) {
+		return false
+	}
+	for _, tag := range fs.Tags {
+		if tag.Key == efsVolumeTag {
+			return tag.Value == name
+		}
+	}
+	return false
+}
+
+func hasMountTarget(targets []efsMountTarget, subnet string) bool {
+	for _, mt := range targets {
+		if mt.SubnetID == subnet {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func isTrue(s string) bool {
+	s = strings.ToLower(s)
+	return s == "true" || s == "yes"
+}
+
+// waitFor polls done until it reports true, fails or ProvisionTimeout passes
+func waitFor(what string, done func() (bool, error)) error {
+	deadline := time.Now().Add(ProvisionTimeout)
+	for {
+		ok, err := done()
+		if err != nil {
+			return fmt.Errorf("waiting for %s failed: %s", what, err.Error())
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", what)
+		}
+		time.Sleep(ProvisionPollInterval)
+	}
+}
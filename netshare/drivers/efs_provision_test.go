@@ -0,0 +1,386 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// fakeEFS stands in for the EFS API and the network part of the instance metadata.  File systems and
+// mount targets become available, or disappear, the second time they are described.
+type fakeEFS struct {
+	t           *testing.T
+	m           sync.Mutex
+	next        int
+	fileSystems map[string]*efsFileSystem
+	targets     map[string]*efsMountTarget
+	created     []map[string]interface{}
+}
+
+func newFakeEFS(t *testing.T) *fakeEFS {
+	return &fakeEFS{t: t, fileSystems: map[string]*efsFileSystem{}, targets: map[string]*efsMountTarget{}}
+}
+
+func (f *fakeEFS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	switch r.URL.Path {
+	case metaDataTokenPath:
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case "/latest/meta-data/mac":
+		fmt.Fprint(w, "0a:1b:2c:3d:4e:5f")
+		return
+	case "/latest/meta-data/network/interfaces/macs/0a:1b:2c:3d:4e:5f/subnet-id":
+		fmt.Fprint(w, "subnet-instance")
+		return
+	case "/latest/meta-data/network/interfaces/macs/0a:1b:2c:3d:4e:5f/security-group-ids":
+		fmt.Fprint(w, "sg-instance\n")
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIATEST/") {
+		f.t.Errorf("unsigned request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, efsAPIVersionPrefix)
+	in := map[string]interface{}{}
+	if r.Method == "POST" {
+		json.NewDecoder(r.Body).Decode(&in)
+	}
+	fsid := r.URL.Query().Get("FileSystemId")
+
+	switch {
+	case r.Method == "POST" && path == "/file-systems":
+		f.created = append(f.created, in)
+		token := in["CreationToken"].(string)
+		for _, fs := range f.fileSystems {
+			if fs.CreationToken == token {
+				f.fail(w, http.StatusConflict, "FileSystemAlreadyExists", fs.FileSystemID)
+				return
+			}
+		}
+		f.next++
+		fs := &efsFileSystem{FileSystemID: fmt.Sprintf("fs-%08d", f.next), CreationToken: token, LifeCycleState: "creating"}
+		for _, tag := range in["Tags"].([]interface{}) {
+			kv := tag.(map[string]interface{})
+			fs.Tags = append(fs.Tags, efsTag{Key: kv["Key"].(string), Value: kv["Value"].(string)})
+		}
+		f.fileSystems[fs.FileSystemID] = fs
+		json.NewEncoder(w).Encode(fs)
+	case r.Method == "GET" && path == "/file-systems" && r.URL.Query().Get("CreationToken") != "":
+		found := []efsFileSystem{}
+		for _, fs := range f.fileSystems {
+			if fs.CreationToken == r.URL.Query().Get("CreationToken") {
+				found = append(found, *fs)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"FileSystems": found})
+	case r.Method == "GET" && path == "/file-systems":
+		fs := f.fileSystems[fsid]
+		if fs == nil {
+			f.fail(w, http.StatusNotFound, "FileSystemNotFound", "")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"FileSystems": []efsFileSystem{*fs}})
+		fs.LifeCycleState = "available"
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/file-systems/"):
+		fsid = strings.TrimPrefix(path, "/file-systems/")
+		for _, mt := range f.targets {
+			if mt.FileSystemID == fsid {
+				f.fail(w, http.StatusConflict, "FileSystemInUse", "")
+				return
+			}
+		}
+		delete(f.fileSystems, fsid)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && path == "/mount-targets":
+		f.next++
+		mt := &efsMountTarget{
+			MountTargetID:  fmt.Sprintf("fsmt-%08d", f.next),
+			FileSystemID:   in["FileSystemId"].(string),
+			SubnetID:       in["SubnetId"].(string),
+			LifeCycleState: "creating",
+		}
+		if groups, ok := in["SecurityGroups"].([]interface{}); !ok || len(groups) == 0 {
+			f.t.Errorf("mount target in %s without security groups", mt.SubnetID)
+		}
+		f.targets[mt.MountTargetID] = mt
+		json.NewEncoder(w).Encode(mt)
+	case r.Method == "GET" && path == "/mount-targets":
+		targets := []efsMountTarget{}
+		for id, mt := range f.targets {
+			if mt.FileSystemID != fsid {
+				continue
+			}
+			targets = append(targets, *mt)
+			switch mt.LifeCycleState {
+			case "creating":
+				mt.LifeCycleState = "available"
+			case "deleting":
+				delete(f.targets, id)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"MountTargets": targets})
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/mount-targets/"):
+		mt := f.targets[strings.TrimPrefix(path, "/mount-targets/")]
+		if mt == nil || mt.LifeCycleState == "deleting" {
+			f.fail(w, http.StatusConflict, "IncorrectMountTargetState", "")
+			return
+		}
+		mt.LifeCycleState = "deleting"
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeEFS) fail(w http.ResponseWriter, status int, code, fsid string) {
+	w.Header().Set("X-Amzn-Errortype", code+":http://internal.amazon.com/coral/com.amazonaws.efs/")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"ErrorCode": %q, "Message": "%s", "FileSystemId": %q}`, code, code, fsid)
+}
+
+func (f *fakeEFS) subnets(fsid string) []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	subnets := []string{}
+	for _, mt := range f.targets {
+		if mt.FileSystemID == fsid {
+			subnets = append(subnets, mt.SubnetID)
+		}
+	}
+	return subnets
+}
+
+// setVolumeTag changes the volume a file system is tagged with
+func (f *fakeEFS) setVolumeTag(fsid, name string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.fileSystems[fsid].Tags = []efsTag{{Key: efsVolumeTag, Value: name}}
+}
+
+func (f *fakeEFS) exists(fsid string) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.fileSystems[fsid] != nil
+}
+
+func newProvisionDriver(t *testing.T, f *fakeEFS) (efsDriver, func()) {
+	server := httptest.NewServer(f)
+	restore := setAwsEnv(map[string]string{EnvAwsAccessKeyID: "AKIATEST", EnvAwsSecretAccessKey: "secret"})
+	interval := ProvisionPollInterval
+	ProvisionPollInterval = time.Millisecond
+
+	d, err := NewEFSDriver("/tmp/netshare-efs", "", "eu-west-1", "", server.URL, server.URL, "", false, false, false, false, NewVolumeManager())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, func() {
+		ProvisionPollInterval = interval
+		restore()
+		server.Close()
+	}
+}
+
+// provision creates the volume's file system and waits for its provisioning to finish
+func provision(d efsDriver, name string, opts map[string]string) (string, error) {
+	fsid, err := d.createFileSystem(name, opts)
+	if err != nil {
+		return "", err
+	}
+	return fsid, d.completeProvision(name, fsid, opts)
+}
+
+func TestProvision(t *testing.T) {
+	f := newFakeEFS(t)
+	d, stop := newProvisionDriver(t, f)
+	defer stop()
+
+	opts := map[string]string{
+		ProvisionOpt:      "true",
+		ThroughputOpt:     "64",
+		TagsOpt:           "team=data,Name=scratch-fs",
+		SubnetsOpt:        "subnet-a,subnet-b",
+		SecurityGroupsOpt: "sg-1",
+	}
+	if err := d.Create(&volume.CreateRequest{Name: "scratch", Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+	// the provisioning in the background sets the volume's status meanwhile
+	d.m.Lock()
+	fsid := d.mountm.GetStatusValue("scratch", StatusFileSystem).(string)
+	share := d.mountm.GetOption("scratch", ShareOpt)
+	d.m.Unlock()
+	if share != fsid+"/" {
+		t.Errorf("share = %s, want the new file system %s", share, fsid)
+	}
+	// mounting waits for the provisioning Create started
+	if err := d.provisioned("scratch"); err != nil {
+		t.Fatal(err)
+	}
+	if subnets := f.subnets(fsid); len(subnets) != 2 {
+		t.Errorf("mount targets in %v, want subnet-a and subnet-b", subnets)
+	}
+	if status := d.mountm.GetStatusValue("scratch", StatusProvisioning); status != nil {
+		t.Errorf("provisioning status = %v after it finished", status)
+	}
+	f.m.Lock()
+	req, fs := f.created[0], f.fileSystems[fsid]
+	f.m.Unlock()
+	if req["CreationToken"] != efsCreationToken("scratch") || req["ThroughputMode"] != "provisioned" || req["ProvisionedThroughputInMibps"] != 64.0 {
+		t.Errorf("CreateFileSystem request = %v", req)
+	}
+	if !createdFor(fs, "scratch") {
+		t.Errorf("file system %+v isn't marked for the volume", fs)
+	}
+
+	// a retried create picks up the file system and its mount targets
+	again, err := provision(d, "scratch", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != fsid {
+		t.Errorf("retried provision created %s, want %s", again, fsid)
+	}
+	if subnets := f.subnets(fsid); len(subnets) != 2 {
+		t.Errorf("retried provision left mount targets in %v", subnets)
+	}
+
+	// without subnets the mount target goes into the instance's subnet
+	other, err := provision(d, "other", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subnets := f.subnets(other); fmt.Sprint(subnets) != "[subnet-instance]" {
+		t.Errorf("mount targets in %v, want the instance's subnet", subnets)
+	}
+}
+
+func TestProvisionRestart(t *testing.T) {
+	f := newFakeEFS(t)
+	d, stop := newProvisionDriver(t, f)
+	defer stop()
+
+	// docker restores the options the volume was created with, without the share Create added
+	opts := map[string]string{ProvisionOpt: "true", DeleteOpt: "true", SubnetsOpt: "subnet-a", SecurityGroupsOpt: "sg-1"}
+	fsid, err := d.createFileSystem("scratch", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mountm.AddMount("scratch", "/tmp/netshare-efs/scratch", 0, opts)
+	d.mountm.AddMount("gone", "/tmp/netshare-efs/gone", 0, map[string]string{ProvisionOpt: "true"})
+
+	if err := d.provisioned("scratch"); err != nil {
+		t.Fatal(err)
+	}
+	if share := d.mountm.GetOption("scratch", ShareOpt); share != fsid+"/" {
+		t.Errorf("share = %s, want the file system %s found by its creation token", share, fsid)
+	}
+	if !d.mountm.GetOptionAsBool("scratch", DeleteOpt) {
+		t.Error("delete=true was lost")
+	}
+	if subnets := f.subnets(fsid); fmt.Sprint(subnets) != "[subnet-a]" {
+		t.Errorf("mount targets in %v, want the missing one created", subnets)
+	}
+	if found, _, err := d.provisionedFileSystem("scratch"); err != nil || found != fsid {
+		t.Errorf("provisionedFileSystem = %s, %v, want %s", found, err, fsid)
+	}
+
+	if err := d.provisioned("gone"); err == nil {
+		t.Error("mounting a volume whose file system no longer exists succeeded")
+	}
+	if found, _, err := d.provisionedFileSystem("gone"); err != nil || found != "" {
+		t.Errorf("provisionedFileSystem of a missing file system = %s, %v", found, err)
+	}
+}
+
+func TestProvisionManager(t *testing.T) {
+	p := newProvisionManager()
+	release := make(chan error)
+	job := p.Start("scratch", "fs-1", func() error { return <-release })
+
+	if err := job.Wait(time.Millisecond); err == nil || !strings.Contains(err.Error(), "still being provisioned") {
+		t.Errorf("Wait of a running job = %v", err)
+	}
+	// a running job isn't started twice
+	if p.Start("scratch", "fs-1", func() error { return nil }) != job {
+		t.Error("Start replaced a running job")
+	}
+	release <- fmt.Errorf("mount target failed")
+	if err := job.Wait(time.Second); err == nil || !job.Failed() {
+		t.Errorf("Wait of a failed job = %v", err)
+	}
+
+	// a failed job is started again
+	retried := p.Start("scratch", "fs-1", func() error { return nil })
+	if retried == job {
+		t.Fatal("Start kept the failed job")
+	}
+	if err := retried.Wait(time.Second); err != nil || p.Get("scratch") != retried {
+		t.Errorf("Wait of the retried job = %v", err)
+	}
+	p.Forget("scratch")
+	if p.Get("scratch") != nil {
+		t.Error("Forget kept the job")
+	}
+}
+
+func TestDeprovision(t *testing.T) {
+	f := newFakeEFS(t)
+	d, stop := newProvisionDriver(t, f)
+	defer stop()
+
+	fsid, err := provision(d, "scratch", map[string]string{SubnetsOpt: "subnet-a,subnet-b", SecurityGroupsOpt: "sg-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// file systems of other volumes are left in place
+	if err := d.deprovision("other", fsid); err != nil {
+		t.Fatal(err)
+	}
+	f.setVolumeTag(fsid, "other")
+	if err := d.deprovision("scratch", fsid); err != nil {
+		t.Fatal(err)
+	}
+	if !f.exists(fsid) || len(f.subnets(fsid)) != 2 {
+		t.Fatalf("deprovision deleted %s of another volume", fsid)
+	}
+
+	f.setVolumeTag(fsid, "scratch")
+	if err := d.deprovision("scratch", fsid); err != nil {
+		t.Fatal(err)
+	}
+	if f.exists(fsid) || len(f.subnets(fsid)) != 0 {
+		t.Errorf("deprovision left %s or its mount targets", fsid)
+	}
+	// a repeated removal finds nothing left to delete
+	if err := d.deprovision("scratch", fsid); err != nil {
+		t.Errorf("deprovision of a deleted file system: %s", err)
+	}
+}
+
+func TestEFSCreationToken(t *testing.T) {
+	prefix := strings.Repeat("v", 60)
+	a, b := efsCreationToken(prefix+"-a"), efsCreationToken(prefix+"-b")
+	if a == b {
+		t.Errorf("volumes with a common prefix share the creation token %s", a)
+	}
+	if len(a) > 64 || !strings.HasPrefix(a, "netshare-") {
+		t.Errorf("invalid creation token %s", a)
+	}
+	if efsCreationToken("scratch") != efsCreationToken("scratch") {
+		t.Error("the creation token isn't stable")
+	}
+}
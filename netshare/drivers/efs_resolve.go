@@ -2,77 +2,366 @@ package drivers
 
 import (
 	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
 	ErrorEmpty = fmt.Errorf("Response was empty")
 	ErrorParse = fmt.Errorf("Could not parse A record")
+
+	// NegativeCacheTTL is how long failed lookups are cached when the answer carries no SOA record
+	NegativeCacheTTL = 30 * time.Second
+	// MaxCacheTTL caps the TTL of cached answers
+	MaxCacheTTL = time.Hour
 )
 
+// Resolver asks the configured nameservers in turn, retrying over TCP when an answer is truncated, and
+// follows CNAME chains.  Names with fewer dots than ndots are tried with the search domains first.
 type Resolver struct {
-	serverString string
+	servers []string
+	search  []string
+	ndots   int
+	timeout time.Duration
+	// ipv6 also returns AAAA records, ahead of A records
+	ipv6 bool
 }
 
 type Lookup interface {
 	Lookup(name string) (string, error)
 }
 
+const (
+	// maxCNAMEChain bounds following CNAME records
+	maxCNAMEChain = 8
+	resolvConf    = "/etc/resolv.conf"
+)
+
 func NewDefaultResolver() *Resolver {
-	config, _ := dns.ClientConfigFromFile("/etc/resolv.conf")
-	serverString := config.Servers[0] + ":" + config.Port
-	l := new(Resolver)
-	l.serverString = serverString
+	l := &Resolver{ndots: 1, timeout: 5 * time.Second}
+	config, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil || len(config.Servers) == 0 {
+		l.servers = []string{"127.0.0.1:53"}
+		return l
+	}
+	for _, server := range config.Servers {
+		l.servers = append(l.servers, net.JoinHostPort(server, config.Port))
+	}
+	l.search = config.Search
+	l.ndots = config.Ndots
+	if config.Timeout > 0 {
+		l.timeout = time.Duration(config.Timeout) * time.Second
+	}
 	return l
 }
+
+// NewResolver returns a resolver of the comma separated nameservers in serverString, which may carry a
+// port.  The search domains of /etc/resolv.conf still apply.
 func NewResolver(serverString string) *Resolver {
+	l := NewDefaultResolver()
 	if serverString == "" {
-		return NewDefaultResolver()
+		return l
+	}
+	l.servers = []string{}
+	for _, server := range strings.Split(serverString, ",") {
+		server = strings.TrimSpace(server)
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		l.servers = append(l.servers, server)
 	}
-	l := new(Resolver)
-	l.serverString = serverString + ":53"
 	return l
 }
 
+// SetIPv6 makes lookups return IPv6 addresses first, for IPv6 only networks
+func (l *Resolver) SetIPv6(ipv6 bool) {
+	l.ipv6 = ipv6
+}
+
 func (l *Resolver) Lookup(name string) (string, error) {
-	answer, err := l.lookup(name, "udp")
+	addrs, _, err := l.LookupAll(name)
 	if err != nil {
 		return "", err
 	}
-	return l.parseAnswer(answer)
+	return addrs[0], nil
 }
 
-func (l *Resolver) lookup(name string, connType string) (*dns.Msg, error) {
-	qType := dns.TypeA
-	name = dns.Fqdn(name)
+// LookupAll returns all addresses of name and how long they may be cached.  The TTL of a failed lookup is
+// the negative caching TTL of the zone, or zero when no server could be asked.
+func (l *Resolver) LookupAll(name string) ([]string, time.Duration, error) {
+	var firstErr error
+	var negTTL time.Duration
+	for i, fqdn := range l.candidates(name) {
+		addrs, ttl, err := l.resolve(fqdn)
+		if err == nil {
+			return addrs, ttl, nil
+		}
+		if i == 0 || ttl < negTTL {
+			negTTL = ttl
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, negTTL, firstErr
+}
 
-	client := &dns.Client{Net: connType}
+// candidates lists the names to try for name with the search domains, as the stub resolver does
+func (l *Resolver) candidates(name string) []string {
+	if dns.IsFqdn(name) || len(l.search) == 0 {
+		return []string{dns.Fqdn(name)}
+	}
+	names := []string{}
+	for _, domain := range l.search {
+		names = append(names, dns.Fqdn(name+"."+strings.Trim(domain, ".")))
+	}
+	if strings.Count(name, ".") >= l.ndots {
+		return append([]string{dns.Fqdn(name)}, names...)
+	}
+	return append(names, dns.Fqdn(name))
+}
 
-	msg := &dns.Msg{}
-	msg.SetQuestion(name, qType)
+// resolve looks up the addresses of a fully qualified name
+func (l *Resolver) resolve(fqdn string) ([]string, time.Duration, error) {
+	types := []uint16{dns.TypeA}
+	if l.ipv6 {
+		types = []uint16{dns.TypeAAAA, dns.TypeA}
+	}
+	addrs := []string{}
+	var ttl time.Duration
+	var lastErr error
+	var lastTTL time.Duration
+	for _, qtype := range types {
+		found, t, err := l.resolveType(fqdn, qtype)
+		if err != nil {
+			lastErr, lastTTL = err, t
+			continue
+		}
+		if len(addrs) == 0 || t < ttl {
+			ttl = t
+		}
+		addrs = append(addrs, found...)
+	}
+	if len(addrs) == 0 {
+		return nil, lastTTL, lastErr
+	}
+	return addrs, ttl, nil
+}
 
-	response, _, err := client.Exchange(msg, l.serverString)
+// resolveType follows the CNAME chain of name to records of qtype
+func (l *Resolver) resolveType(name string, qtype uint16) ([]string, time.Duration, error) {
+	var ttl uint32
+	first := true
+	minTTL := func(t uint32) {
+		if first || t < ttl {
+			ttl, first = t, false
+		}
+	}
+	answer, err := l.lookup(name, qtype)
+	for hops := 0; ; hops++ {
+		if err != nil {
+			return nil, 0, err
+		}
+		if answer.Rcode == dns.RcodeNameError {
+			return nil, negativeTTL(answer), fmt.Errorf("Couldn't resolve name '%s' : no such host", name)
+		}
+		if addrs, t := l.parseAnswer(answer, name, qtype); len(addrs) > 0 {
+			minTTL(t)
+			return addrs, time.Duration(ttl) * time.Second, nil
+		}
+		target, t := cnameTarget(answer, name)
+		if target == "" {
+			return nil, negativeTTL(answer), ErrorEmpty
+		}
+		if hops == maxCNAMEChain {
+			return nil, 0, fmt.Errorf("CNAME chain of '%s' is too long", name)
+		}
+		minTTL(t)
+		name = target
+		// servers usually include the rest of the chain, only ask again when it ends here
+		if !ownsRecords(answer, name) {
+			answer, err = l.lookup(name, qtype)
+		}
+	}
+}
 
-	if err != nil {
-		if connType == "" {
-			return l.lookup(name, "tcp")
-		} else {
-			return nil, fmt.Errorf("Couldn't resolve name '%s' : %s", name, err.Error())
+// ownsRecords reports whether the answer has records of name
+func ownsRecords(answer *dns.Msg, name string) bool {
+	for _, rr := range answer.Answer {
+		if strings.EqualFold(rr.Header().Name, name) {
+			return true
 		}
 	}
+	return false
+}
 
+// lookup asks the nameservers in turn until one answers.  Truncated answers are asked again over TCP.
+func (l *Resolver) lookup(name string, qtype uint16) (*dns.Msg, error) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	var lastErr error
+	for _, server := range l.servers {
+		response, err := l.exchange(msg, server, "udp")
+		if err == dns.ErrTruncated || (err == nil && response.Truncated) {
+			response, err = l.exchange(msg, server, "tcp")
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered %s", server, dns.RcodeToString[response.Rcode])
+			continue
+		}
+		return response, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no nameservers configured")
+	}
+	return nil, fmt.Errorf("Couldn't resolve name '%s' : %s", name, lastErr.Error())
+}
+
+func (l *Resolver) exchange(msg *dns.Msg, server, connType string) (*dns.Msg, error) {
+	client := &dns.Client{Net: connType, Timeout: l.timeout}
+	response, _, err := client.Exchange(msg, server)
+	if err != nil {
+		// truncated answers are still returned with the error
+		return response, err
+	}
 	if msg.Id != response.Id {
 		return nil, fmt.Errorf("DNS ID mismatch, request: %d, response: %d", msg.Id, response.Id)
 	}
 	return response, nil
 }
 
-func (l *Resolver) parseAnswer(answer *dns.Msg) (string, error) {
-	if len(answer.Answer) == 0 {
-		return "", ErrorEmpty
+// parseAnswer returns the addresses of qtype records owned by name and their lowest TTL
+func (l *Resolver) parseAnswer(answer *dns.Msg, name string, qtype uint16) ([]string, uint32) {
+	addrs := []string{}
+	var ttl uint32
+	for _, rr := range answer.Answer {
+		if rr.Header().Rrtype != qtype || !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		switch r := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, r.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, r.AAAA.String())
+		default:
+			continue
+		}
+		if len(addrs) == 1 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return addrs, ttl
+}
+
+// cnameTarget returns the target of name's CNAME record in the answer
+func cnameTarget(answer *dns.Msg, name string) (string, uint32) {
+	for _, rr := range answer.Answer {
+		if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+			return c.Target, c.Hdr.Ttl
+		}
+	}
+	return "", 0
+}
+
+// negativeTTL is the SOA minimum of an empty answer (RFC 2308)
+func negativeTTL(answer *dns.Msg) time.Duration {
+	for _, rr := range answer.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return NegativeCacheTTL
+}
+
+type cachedAnswer struct {
+	addrs   []string
+	err     error
+	expires time.Time
+	next    int
+}
+
+// CachingResolver caches the answers of a Resolver for their TTL, including failed lookups, and hands
+// out the addresses of a name in turn.  It is safe for concurrent use, and DefaultCachingResolver is
+// shared by the NFS, CIFS and EFS drivers.
+type CachingResolver struct {
+	resolver *Resolver
+	m        *sync.Mutex
+	entries  map[string]*cachedAnswer
+}
+
+var (
+	defaultCache     *CachingResolver
+	defaultCacheOnce sync.Once
+)
+
+func NewCachingResolver(resolver *Resolver) *CachingResolver {
+	return &CachingResolver{resolver: resolver, m: &sync.Mutex{}, entries: map[string]*cachedAnswer{}}
+}
+
+// DefaultCachingResolver returns the process wide cache of the nameservers in /etc/resolv.conf
+func DefaultCachingResolver() *CachingResolver {
+	defaultCacheOnce.Do(func() {
+		defaultCache = NewCachingResolver(NewDefaultResolver())
+	})
+	return defaultCache
+}
+
+// Lookup returns the next address of name, IP addresses are returned as they are
+func (c *CachingResolver) Lookup(name string) (string, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return name, nil
+	}
+	c.m.Lock()
+	entry, found := c.entries[name]
+	if !found || time.Now().After(entry.expires) {
+		// the lookup is done without the lock so slow names don't hold up others
+		c.m.Unlock()
+		addrs, ttl, err := c.resolver.LookupAll(name)
+		if ttl > MaxCacheTTL {
+			ttl = MaxCacheTTL
+		}
+		c.m.Lock()
+		entry = &cachedAnswer{addrs: addrs, err: err, expires: time.Now().Add(ttl)}
+		c.entries[name] = entry
+	}
+	defer c.m.Unlock()
+
+	if entry.err != nil {
+		return "", entry.err
 	}
-	if a, ok := answer.Answer[0].(*dns.A); ok {
-		return a.A.String(), nil
+	addr := entry.addrs[entry.next%len(entry.addrs)]
+	entry.next++
+	return addr, nil
+}
+
+// Forget drops name from the cache, e.g. after its address stopped answering
+func (c *CachingResolver) Forget(name string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.entries, name)
+}
+
+// resolveHost returns an address of host from the shared cache.  Names the nameservers don't know, such
+// as those in /etc/hosts, are returned as they are and left to the system resolver of the mount helpers.
+func resolveHost(host string) string {
+	addr, err := DefaultCachingResolver().Lookup(host)
+	if err != nil {
+		log.Debugf("Resolving %s failed, leaving it to the mount helper: %s", host, err.Error())
+		return host
 	}
-	return "", ErrorParse
+	return addr
 }
@@ -0,0 +1,392 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone answers like a nameserver of the zone "test." and records the questions it was asked
+type testZone struct {
+	m       sync.Mutex
+	queries []string
+}
+
+func (z *testZone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	network := w.LocalAddr().Network()
+	z.m.Lock()
+	z.queries = append(z.queries, fmt.Sprintf("%s %s %s", network, q.Name, dns.TypeToString[q.Qtype]))
+	z.m.Unlock()
+
+	m := &dns.Msg{}
+	m.SetReply(r)
+	add := func(s string) {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	switch {
+	case q.Name == "multi.test." && q.Qtype == dns.TypeA:
+		add("multi.test. 60 IN A 10.0.0.1")
+		add("multi.test. 30 IN A 10.0.0.2")
+	case q.Name == "big.test." && q.Qtype == dns.TypeA:
+		if network == "udp" {
+			m.Truncated = true
+		} else {
+			add("big.test. 60 IN A 10.0.0.9")
+		}
+	case q.Name == "alias.test.":
+		// the rest of the chain has to be asked for separately
+		add("alias.test. 60 IN CNAME mid.test.")
+	case q.Name == "mid.test.":
+		add("mid.test. 20 IN CNAME multi.test.")
+		if q.Qtype == dns.TypeA {
+			add("multi.test. 60 IN A 10.0.0.1")
+		}
+	case q.Name == "dual.test." && q.Qtype == dns.TypeAAAA:
+		add("dual.test. 60 IN AAAA fd00::1")
+	case q.Name == "dual.test." && q.Qtype == dns.TypeA:
+		add("dual.test. 60 IN A 10.0.0.6")
+	case q.Name == "short.corp.test." && q.Qtype == dns.TypeA:
+		add("short.corp.test. 60 IN A 10.0.0.7")
+	case q.Name == "loop.test.":
+		add("loop.test. 60 IN CNAME loop.test.")
+	case q.Name == "nosoa.test.":
+		m.Rcode = dns.RcodeNameError
+	default:
+		m.Rcode = dns.RcodeNameError
+		soa, _ := dns.NewRR("test. 300 IN SOA ns.test. hostmaster.test. 1 7200 900 1209600 15")
+		m.Ns = append(m.Ns, soa)
+	}
+	w.WriteMsg(m)
+}
+
+// asked returns the queries since the last call
+func (z *testZone) asked() []string {
+	z.m.Lock()
+	defer z.m.Unlock()
+	q := z.queries
+	z.queries = nil
+	return q
+}
+
+// startNameserver serves handler over UDP and TCP on the same port of 127.0.0.1
+func startNameserver(t *testing.T, handler dns.Handler) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	servers := []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}}
+	for _, s := range servers {
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		go s.ActivateAndServe()
+		<-started
+	}
+	return pc.LocalAddr().String(), func() {
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}
+}
+
+// unusedAddress returns a local UDP address nothing listens on
+func unusedAddress(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+func testResolver(servers ...string) *Resolver {
+	return &Resolver{servers: servers, ndots: 1, timeout: time.Second}
+}
+
+func TestResolverFailover(t *testing.T) {
+	zone := &testZone{}
+	addr, stop := startNameserver(t, zone)
+	defer stop()
+	failing := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	})
+	failingAddr, stopFailing := startNameserver(t, failing)
+	defer stopFailing()
+
+	l := testResolver(unusedAddress(t), failingAddr, addr)
+	addrs, ttl, err := l.LookupAll("multi.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(addrs) != "[10.0.0.1 10.0.0.2]" || ttl != 30*time.Second {
+		t.Errorf("LookupAll = %v, %s, want both addresses for the lowest TTL of 30s", addrs, ttl)
+	}
+
+	// no server answering is an error which isn't cached
+	l = testResolver(unusedAddress(t), failingAddr)
+	if _, ttl, err := l.LookupAll("multi.test"); err == nil || ttl != 0 {
+		t.Errorf("LookupAll without a working server = %s, %v", ttl, err)
+	}
+}
+
+func TestResolverTruncated(t *testing.T) {
+	zone := &testZone{}
+	addr, stop := startNameserver(t, zone)
+	defer stop()
+
+	ip, err := testResolver(addr).Lookup("big.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "10.0.0.9" {
+		t.Errorf("Lookup = %s, want the address of the TCP answer", ip)
+	}
+	want := []string{"udp big.test. A", "tcp big.test. A"}
+	if got := zone.asked(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("queries = %v, want %v", got, want)
+	}
+}
+
+func TestResolverCNAMEChain(t *testing.T) {
+	zone := &testZone{}
+	addr, stop := startNameserver(t, zone)
+	defer stop()
+
+	l := testResolver(addr)
+	addrs, ttl, err := l.LookupAll("alias.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lowest TTL along the chain applies
+	if fmt.Sprint(addrs) != "[10.0.0.1]" || ttl != 20*time.Second {
+		t.Errorf("LookupAll = %v, %s, want [10.0.0.1] for 20s", addrs, ttl)
+	}
+	// multi.test came with the answer for mid.test
+	want := []string{"udp alias.test. A", "udp mid.test. A"}
+	if got := zone.asked(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("queries = %v, want %v", got, want)
+	}
+
+	if _, _, err := l.LookupAll("loop.test"); err == nil {
+		t.Error("LookupAll followed a CNAME loop")
+	}
+}
+
+func TestResolverIPv6(t *testing.T) {
+	zone := &testZone{}
+	addr, stop := startNameserver(t, zone)
+	defer stop()
+
+	l := testResolver(addr)
+	if addrs, _, err := l.LookupAll("dual.test"); err != nil || fmt.Sprint(addrs) != "[10.0.0.6]" {
+		t.Errorf("LookupAll = %v, %v, want only the IPv4 address", addrs, err)
+	}
+	l.SetIPv6(true)
+	if addrs, _, err := l.LookupAll("dual.test"); err != nil || fmt.Sprint(addrs) != "[fd00::1 10.0.0.6]" {
+		t.Errorf("LookupAll = %v, %v, want the IPv6 address first", addrs, err)
+	}
+	// names without AAAA records still resolve
+	if addrs, _, err := l.LookupAll("big.test"); err != nil || fmt.Sprint(addrs) != "[10.0.0.9]" {
+		t.Errorf("LookupAll = %v, %v, want the IPv4 address", addrs, err)
+	}
+}
+
+func TestResolverCandidates(t *testing.T) {
+	tests := []struct {
+		name  string
+		ndots int
+		want  []string
+	}{
+		{"short", 1, []string{"short.corp.test.", "short.test.", "short."}},
+		{"fs-1.efs", 1, []string{"fs-1.efs.", "fs-1.efs.corp.test.", "fs-1.efs.test."}},
+		{"fs-1.efs", 2, []string{"fs-1.efs.corp.test.", "fs-1.efs.test.", "fs-1.efs."}},
+		{"absolute.", 5, []string{"absolute."}},
+	}
+	for _, tt := range tests {
+		l := &Resolver{search: []string{"corp.test", ".test."}, ndots: tt.ndots}
+		if got := l.candidates(tt.name); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("candidates(%q) with ndots %d = %v, want %v", tt.name, tt.ndots, got, tt.want)
+		}
+	}
+
+	zone := &testZone{}
+	addr, stop := startNameserver(t, zone)
+	defer stop()
+	l := testResolver(addr)
+	l.search = []string{"corp.test"}
+	if ip, err := l.Lookup("short"); err != nil || ip != "10.0.0.7" {
+		t.Errorf("Lookup = %s, %v, want the address from the search domain", ip, err)
+	}
+	if ip, err := l.Lookup("multi.test"); err != nil || ip != "10.0.0.1" {
+		t.Errorf("Lookup = %s, %v, want the absolute name", ip, err)
+	}
+}
+
+func TestCachingResolverNegativeTTL(t *testing.T) {
+	zone := &testZone{}
+	addr, stop := startNameserver(t, zone)
+	defer stop()
+
+	c := NewCachingResolver(testResolver(addr))
+	for i := 0; i < 2; i++ {
+		if _, err := c.Lookup("missing.test"); err == nil {
+			t.Fatal("Lookup of a missing name succeeded")
+		}
+	}
+	// the failure is cached for the SOA minimum of the zone
+	if got := zone.asked(); len(got) != 1 {
+		t.Errorf("queries = %v, want a single query", got)
+	}
+	if ttl := c.entries["missing.test"].expires.Sub(time.Now()); ttl <= 14*time.Second || ttl > 15*time.Second {
+		t.Errorf("missing.test is cached for %s, want 15s", ttl)
+	}
+
+	// without a SOA record the default applies
+	if _, err := c.Lookup("nosoa.test"); err == nil {
+		t.Fatal("Lookup of a missing name succeeded")
+	}
+	if ttl := c.entries["nosoa.test"].expires.Sub(time.Now()); ttl <= NegativeCacheTTL-time.Second || ttl > NegativeCacheTTL {
+		t.Errorf("nosoa.test is cached for %s, want %s", ttl, NegativeCacheTTL)
+	}
+
+	// addresses are handed out in turn until forgotten
+	zone.asked()
+	got := []string{}
+	for i := 0; i < 3; i++ {
+		ip, err := c.Lookup("multi.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ip)
+	}
+	if fmt.Sprint(got) != "[10.0.0.1 10.0.0.2 10.0.0.1]" {
+		t.Errorf("Lookup returned %v, want the addresses in turn", got)
+	}
+	c.Forget("multi.test")
+	c.Lookup("multi.test")
+	if queries := zone.asked(); len(queries) != 2 {
+		t.Errorf("queries = %v, want one before and one after Forget", queries)
+	}
+}
+
+func TestCachingResolverExpiry(t *testing.T) {
+	zone := &testZone{}
+	addr, stop := startNameserver(t, zone)
+	defer stop()
+
+	c := NewCachingResolver(testResolver(addr))
+	if _, err := c.Lookup("multi.test"); err != nil {
+		t.Fatal(err)
+	}
+	// the lowest TTL of the records applies
+	if ttl := c.entries["multi.test"].expires.Sub(time.Now()); ttl <= 29*time.Second || ttl > 30*time.Second {
+		t.Errorf("multi.test is cached for %s, want 30s", ttl)
+	}
+	c.Lookup("multi.test")
+	if queries := zone.asked(); len(queries) != 1 {
+		t.Errorf("queries = %v, want a single query before the TTL expires", queries)
+	}
+
+	c.m.Lock()
+	c.entries["multi.test"].expires = time.Now().Add(-time.Second)
+	c.m.Unlock()
+	// the new answer starts with the first address again
+	if ip, err := c.Lookup("multi.test"); err != nil || ip != "10.0.0.1" {
+		t.Errorf("Lookup after the TTL = %s, %v, want 10.0.0.1", ip, err)
+	}
+	if queries := zone.asked(); len(queries) != 1 {
+		t.Errorf("queries = %v, want the name asked again after the TTL", queries)
+	}
+
+	// IP addresses aren't looked up or cached
+	if ip, err := c.Lookup("fd00::2"); err != nil || ip != "fd00::2" {
+		t.Errorf("Lookup of an address = %s, %v", ip, err)
+	}
+	if _, found := c.entries["fd00::2"]; found || len(zone.asked()) != 0 {
+		t.Error("an IP address was looked up")
+	}
+}
+
+func TestCachingResolverConcurrent(t *testing.T) {
+	zone := &testZone{}
+	addr, stop := startNameserver(t, zone)
+	defer stop()
+
+	c := NewCachingResolver(testResolver(addr))
+	c.Lookup("multi.test")
+	zone.asked()
+
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				ip, err := c.Lookup("multi.test")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.Lookup("missing.test")
+				m.Lock()
+				counts[ip]++
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the first lookup handed out 10.0.0.1, so the two addresses come up equally often afterwards
+	if counts["10.0.0.1"] != 100 || counts["10.0.0.2"] != 100 {
+		t.Errorf("addresses handed out %v, want 100 of each", counts)
+	}
+	for _, q := range zone.asked() {
+		if q != "udp missing.test. A" {
+			t.Errorf("cached name asked again: %s", q)
+		}
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	zone := &testZone{}
+	addr, stop := startNameserver(t, zone)
+	defer stop()
+
+	DefaultCachingResolver()
+	cache := defaultCache
+	defaultCache = NewCachingResolver(testResolver(addr))
+	defer func() { defaultCache = cache }()
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"big.test", "10.0.0.9"},
+		{"192.0.2.10", "192.0.2.10"},
+		// names only the system resolver knows are left alone
+		{"missing.test", "missing.test"},
+	}
+	for _, tt := range tests {
+		if got := resolveHost(tt.host); got != tt.want {
+			t.Errorf("resolveHost(%q) = %s, want %s", tt.host, got, tt.want)
+		}
+	}
+}
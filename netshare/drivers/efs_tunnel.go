@@ -0,0 +1,326 @@
+package drivers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TLSOpt    = "tls"
+	StatusTLS = "tls"
+)
+
+var (
+	// TunnelCheckInterval is how often the tunnels check that their mount target accepts TLS connections
+	TunnelCheckInterval = 30 * time.Second
+	// TunnelDialTimeout bounds connecting and handshaking with a mount target
+	TunnelDialTimeout = 10 * time.Second
+)
+
+// tlsTunnel forwards NFS connections made to a local port over TLS to an EFS mount target, so mounts
+// are encrypted in transit without stunnel or efs-utils.  The local port stays the same for the life
+// of the tunnel since mounts are pinned to it.
+type tlsTunnel struct {
+	fsid     string
+	target   string
+	config   *tls.Config
+	identity *efsIdentity
+	port     int
+	// listener is nil while the local port isn't accepting connections
+	listener net.Listener
+	volumes  map[string]bool
+	conns    map[net.Conn]bool
+	m        *sync.Mutex
+	// healthy is whether the mount target accepted the last TLS connection check
+	healthy bool
+	stop    chan struct{}
+}
+
+// tunnelManager runs one tunnel per file system, shared by all of its volumes
+type tunnelManager struct {
+	m       *sync.Mutex
+	tunnels map[string]*tlsTunnel
+}
+
+func newTunnelManager() *tunnelManager {
+	return &tunnelManager{m: &sync.Mutex{}, tunnels: map[string]*tlsTunnel{}}
+}
+
+// Acquire returns the local port of the tunnel to the file system's mount target, starting it for the
+// first volume on port, or on a free one when port is 0.  serverName is verified against the mount
+// target's certificate.  Tunnels with an identity present its client certificate for IAM authorization
+// and are only shared by volumes using the same profile.
+func (t *tunnelManager) Acquire(volume, fsid, target, serverName string, identity *efsIdentity, port int) (int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	key := fsid
+	if identity != nil {
+		key = fsid + "#" + identity.Key()
+	}
+	if tun, found := t.tunnels[key]; found {
+		tun.m.Lock()
+		tun.volumes[volume] = true
+		tun.m.Unlock()
+		return tun.port, nil
+	}
+
+	tun := &tlsTunnel{
+		fsid:     fsid,
+		target:   target,
+		config:   &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12},
+		identity: identity,
+		port:     port,
+		volumes:  map[string]bool{volume: true},
+		conns:    map[net.Conn]bool{},
+		m:        &sync.Mutex{},
+		stop:     make(chan struct{}),
+	}
+	if identity != nil {
+		if err := tun.sign(); err != nil {
+			return 0, fmt.Errorf("signing IAM client certificate for %s failed: %s", fsid, err.Error())
+		}
+	}
+	if err := tun.checkTarget(); err != nil {
+		return 0, fmt.Errorf("TLS connection to %s for %s failed: %s", target, fsid, err.Error())
+	}
+	tun.healthy = true
+	if err := tun.listen(); err != nil {
+		return 0, err
+	}
+	log.Infof("Started TLS tunnel for %s on 127.0.0.1:%d to %s", fsid, tun.port, target)
+	go tun.watch(TunnelCheckInterval)
+	t.tunnels[key] = tun
+	return tun.port, nil
+}
+
+// Release removes volume from the tunnels and stops those without volumes
+func (t *tunnelManager) Release(volume string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for key, tun := range t.tunnels {
+		tun.m.Lock()
+		if tun.volumes[volume] {
+			delete(tun.volumes, volume)
+		}
+		unused := len(tun.volumes) == 0
+		tun.m.Unlock()
+		if unused {
+			delete(t.tunnels, key)
+			tun.close()
+			log.Infof("Stopped TLS tunnel for %s", tun.fsid)
+		}
+	}
+}
+
+// Has reports whether a tunnel serves the volume
+func (t *tunnelManager) Has(volume string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, tun := range t.tunnels {
+		tun.m.Lock()
+		used := tun.volumes[volume]
+		tun.m.Unlock()
+		if used {
+			return true
+		}
+	}
+	return false
+}
+
+// Status describes the tunnel a volume uses
+func (t *tunnelManager) Status(volume string) string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, tun := range t.tunnels {
+		tun.m.Lock()
+		used, healthy := tun.volumes[volume], tun.healthy && tun.listener != nil
+		tun.m.Unlock()
+		if used {
+			state := "healthy"
+			if !healthy {
+				state = "unhealthy"
+			}
+			if tun.identity != nil {
+				state += ", iam: " + tun.identity.Source()
+			}
+			return fmt.Sprintf("127.0.0.1:%d -> %s (%s)", tun.port, tun.target, state)
+		}
+	}
+	return ""
+}
+
+func (tun *tlsTunnel) listen() error {
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tun.port)))
+	if err != nil {
+		return err
+	}
+	tun.m.Lock()
+	tun.listener = l
+	tun.port = l.Addr().(*net.TCPAddr).Port
+	tun.m.Unlock()
+	go tun.accept(l)
+	return nil
+}
+
+// accept serves l until it fails, leaving it to watch to listen again
+func (tun *tlsTunnel) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-tun.stop:
+			default:
+				tun.m.Lock()
+				if l == tun.listener {
+					log.Warnf("TLS tunnel for %s stopped accepting connections: %s", tun.fsid, err.Error())
+					tun.listener = nil
+				}
+				tun.m.Unlock()
+			}
+			return
+		}
+		go tun.forward(conn)
+	}
+}
+
+// forward connects a local NFS connection to the mount target
+func (tun *tlsTunnel) forward(local net.Conn) {
+	remote, err := tls.DialWithDialer(&net.Dialer{Timeout: TunnelDialTimeout}, "tcp", tun.target, tun.tlsConfig())
+	if err != nil {
+		log.Warnf("TLS tunnel for %s can't reach %s: %s", tun.fsid, tun.target, err.Error())
+		local.Close()
+		return
+	}
+	tun.track(local, true)
+	tun.track(remote, true)
+	defer tun.track(local, false)
+	defer tun.track(remote, false)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+	go pipe(remote, local)
+	go pipe(local, remote)
+	<-done
+	<-done
+}
+
+func (tun *tlsTunnel) track(conn net.Conn, open bool) {
+	tun.m.Lock()
+	defer tun.m.Unlock()
+	if open {
+		tun.conns[conn] = true
+	} else {
+		delete(tun.conns, conn)
+	}
+}
+
+// watch checks the mount target and listens on the tunnel's port again if the listener died.  A mount
+// target which is unreachable for a while only marks the tunnel unhealthy, the listener keeps running so
+// the NFS client's reconnects succeed as soon as the target is back.
+func (tun *tlsTunnel) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tun.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if tun.identity != nil && tun.identity.Expired() {
+			if err := tun.sign(); err != nil {
+				log.Warnf("Renewing IAM client certificate for %s failed: %s", tun.fsid, err.Error())
+			}
+		}
+		err := tun.checkTarget()
+		tun.m.Lock()
+		wasHealthy, listening := tun.healthy, tun.listener != nil
+		tun.healthy = err == nil
+		tun.m.Unlock()
+
+		switch {
+		case err != nil && wasHealthy:
+			log.Warnf("TLS tunnel for %s: mount target %s is unreachable: %s", tun.fsid, tun.target, err.Error())
+		case err == nil && !wasHealthy:
+			log.Infof("TLS tunnel for %s: mount target %s is reachable again", tun.fsid, tun.target)
+		}
+		if !listening {
+			if err := tun.listen(); err != nil {
+				log.Warnf("Restarting TLS tunnel for %s on port %d failed: %s", tun.fsid, tun.port, err.Error())
+				continue
+			}
+			log.Infof("TLS tunnel for %s is listening on port %d again", tun.fsid, tun.port)
+		}
+	}
+}
+
+func (tun *tlsTunnel) tlsConfig() *tls.Config {
+	tun.m.Lock()
+	defer tun.m.Unlock()
+	return tun.config
+}
+
+// sign replaces the client certificate with one signed by the identity's current credentials, new
+// connections use it while established ones keep theirs
+func (tun *tlsTunnel) sign() error {
+	cert, err := tun.identity.Certificate()
+	if err != nil {
+		return err
+	}
+	tun.m.Lock()
+	defer tun.m.Unlock()
+	tun.config = &tls.Config{
+		ServerName:   tun.config.ServerName,
+		MinVersion:   tun.config.MinVersion,
+		Certificates: []tls.Certificate{cert},
+	}
+	return nil
+}
+
+func (tun *tlsTunnel) checkTarget() error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: TunnelDialTimeout}, "tcp", tun.target, tun.tlsConfig())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (tun *tlsTunnel) close() {
+	close(tun.stop)
+	tun.m.Lock()
+	defer tun.m.Unlock()
+	if tun.listener != nil {
+		tun.listener.Close()
+	}
+	for conn := range tun.conns {
+		conn.Close()
+	}
+}
+
+// tunnelPort returns the local port of the TLS tunnel an NFS mount from /proc/mounts goes through
+func tunnelPort(source, fstype, options string) (int, bool) {
+	if !strings.HasPrefix(fstype, "nfs") || !strings.HasPrefix(source, "127.0.0.1:") {
+		return 0, false
+	}
+	for _, o := range strings.Split(options, ",") {
+		if strings.HasPrefix(o, "port=") {
+			port, err := strconv.Atoi(strings.TrimPrefix(o, "port="))
+			return port, err == nil && port > 0
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,27 @@
+package drivers
+
+import "testing"
+
+func TestTunnelPort(t *testing.T) {
+	tests := []struct {
+		source  string
+		fstype  string
+		options string
+		port    int
+		ok      bool
+	}{
+		{"127.0.0.1:/data", "nfs4", "rw,relatime,vers=4.1,port=20049,addr=127.0.0.1", 20049, true},
+		{"127.0.0.1:/", "nfs", "rw,vers=4.1,port=20050", 20050, true},
+		// mounted from the mount target
+		{"10.0.1.5:/", "nfs4", "rw,vers=4.1,port=2049", 0, false},
+		{"127.0.0.1:/", "nfs4", "rw,vers=4.1", 0, false},
+		{"127.0.0.1:/", "nfs4", "rw,port=0", 0, false},
+		{"tmpfs", "tmpfs", "rw", 0, false},
+	}
+	for _, tt := range tests {
+		port, ok := tunnelPort(tt.source, tt.fstype, tt.options)
+		if port != tt.port || ok != tt.ok {
+			t.Errorf("tunnelPort(%q, %q, %q) = %d, %v, want %d, %v", tt.source, tt.fstype, tt.options, port, ok, tt.port, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EfsZoneTemplateURI = "%s.%s.efs.%s.amazonaws.com"
+	StatusAvailZone    = "az"
+)
+
+var (
+	// MountTargetTimeout bounds checking that a mount target accepts connections
+	MountTargetTimeout = 3 * time.Second
+	// zoneSuffixes are tried for mount targets in other availability zones of the region
+	zoneSuffixes = []string{"a", "b", "c", "d", "e", "f"}
+)
+
+// zoneMountTarget returns the address of a mount target of the file system, preferring the one in the
+// instance's availability zone to avoid cross zone charges and latency.  Other zones of the region are
+// tried when it doesn't resolve or answer, the regional name is the last resort.  The zone chosen for a
+// file system is remembered, the others are only probed again when its target stops answering.
+func (e efsDriver) zoneMountTarget(fsid string) string {
+	regional := fmt.Sprintf(EfsTemplateURI, fsid, e.region)
+	var fallback, failed string
+	if az := e.zones[fsid]; az != "" {
+		ip, err := e.zoneTarget(fsid, az)
+		if err == nil {
+			log.Debugf("Using mount target %s of %s in %s", ip, fsid, az)
+			return ip
+		}
+		log.Warnf("Mount target of %s in %s failed, probing the other zones: %s", fsid, az, err.Error())
+		delete(e.zones, fsid)
+		fallback, failed = ip, az
+	}
+
+	for _, az := range e.candidateZones() {
+		if az == failed {
+			continue
+		}
+		ip, err := e.zoneTarget(fsid, az)
+		if err != nil {
+			if ip == "" {
+				log.Debugf("No mount target of %s in %s: %s", fsid, az, err.Error())
+				continue
+			}
+			log.Warnf("Mount target %s of %s in %s is not answering: %s", ip, fsid, az, err.Error())
+			if fallback == "" {
+				fallback = ip
+			}
+			continue
+		}
+		if az != e.availZone {
+			log.Warnf("Using mount target %s of %s in %s, outside of the instance's zone %s", ip, fsid, az, e.availZone)
+		} else {
+			log.Infof("Using mount target %s of %s in %s", ip, fsid, az)
+		}
+		e.zones[fsid] = az
+		return ip
+	}
+
+	ip, err := e.lookupTarget(regional)
+	if err != nil {
+		log.Errorf("Error during resolve: %s", err.Error())
+		if fallback != "" {
+			return fallback
+		}
+		return regional
+	}
+	log.Infof("Using mount target %s of %s from %s", ip, fsid, regional)
+	return ip
+}
+
+// zoneTarget resolves the mount target of the file system in az and checks that it accepts connections.
+// The address is returned with the error when the target resolves but doesn't answer.
+func (e efsDriver) zoneTarget(fsid, az string) (string, error) {
+	name := fmt.Sprintf(EfsZoneTemplateURI, az, fsid, e.region)
+	ip, err := e.lookupTarget(name)
+	if err != nil {
+		return "", err
+	}
+	if err := probeMountTarget(ip); err != nil {
+		// resolve it again next time in case the target moved
+		e.resolver.Forget(name)
+		return ip, err
+	}
+	return ip, nil
+}
+
+// candidateZones lists the instance's zone followed by the other zones of the region
+func (e efsDriver) candidateZones() []string {
+	zones := []string{}
+	if e.availZone == "" {
+		return zones
+	}
+	zones = append(zones, e.availZone)
+	if !strings.HasPrefix(e.availZone, e.region) {
+		return zones
+	}
+	for _, suffix := range zoneSuffixes {
+		if az := e.region + suffix; az != e.availZone {
+			zones = append(zones, az)
+		}
+	}
+	return zones
+}
+
+func probeMountTarget(ip string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(EfsNfsPort)), MountTargetTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -21,6 +21,7 @@ type mount struct {
 	hostdir     string
 	connections int
 	opts        map[string]string
+	status      map[string]interface{}
 	managed     bool
 }
 
@@ -80,6 +81,66 @@ func (m *MountManager) GetOptionAsBool(name, key string) bool {
 	return false
 }
 
+// Names returns the names of all known volumes
+func (m *MountManager) Names() []string {
+	names := []string{}
+	for name := range m.mounts {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (m *MountManager) GetHostDir(name string) string {
+	if c, found := m.mounts[name]; found {
+		return c.hostdir
+	}
+	return ""
+}
+
+// SetOption sets an option the driver determined after the volume was created
+func (m *MountManager) SetOption(name, key, value string) {
+	c, found := m.mounts[name]
+	if !found {
+		return
+	}
+	if c.opts == nil {
+		c.opts = map[string]string{}
+	}
+	c.opts[key] = value
+}
+
+// SetStatus records driver specific state which is reported back to docker in the volume's status
+func (m *MountManager) SetStatus(name, key string, value interface{}) {
+	c, found := m.mounts[name]
+	if !found {
+		return
+	}
+	if c.status == nil {
+		c.status = map[string]interface{}{}
+	}
+	c.status[key] = value
+}
+
+func (m *MountManager) DeleteStatus(name, key string) {
+	if c, found := m.mounts[name]; found {
+		delete(c.status, key)
+	}
+}
+
+func (m *MountManager) GetStatus(name string) map[string]interface{} {
+	if c, found := m.mounts[name]; found && len(c.status) > 0 {
+		return c.status
+	}
+	return nil
+}
+
+func (m *MountManager) GetStatusValue(name, key string) interface{} {
+	if c, found := m.mounts[name]; found && c.status != nil {
+		return c.status[key]
+	}
+	return nil
+}
+
 func (m *MountManager) IsActiveMount(name string) bool {
 	c, found := m.mounts[name]
 	return found && c.connections > 0
@@ -129,6 +190,11 @@ func (m *MountManager) Delete(name string) error {
 	return nil
 }
 
+// InUse reports whether the volume is mounted or still referenced by a container
+func (m *MountManager) InUse(name string) bool {
+	return m.HasMount(name) && (m.Count(name) > 0 || checkReferences(name) > 0)
+}
+
 func (m *MountManager) DeleteIfNotManaged(name string) error {
 	if m.HasMount(name) && !m.IsActiveMount(name) && !m.mounts[name].managed {
 		log.Infof("Removing un-managed volume")
@@ -170,8 +236,9 @@ func (m *MountManager) GetVolumes(rootPath string) []*volume.Volume {
 	return volumes
 }
 
-func (m *MountManager) AddMount(name string, hostdir string, connections int) {
-	m.mounts[name] = &mount{name: name, hostdir: hostdir, managed: true, connections: connections}
+// AddMount restores a volume docker knows about with the options it was created with
+func (m *MountManager) AddMount(name string, hostdir string, connections int, opts map[string]string) {
+	m.mounts[name] = &mount{name: name, hostdir: hostdir, managed: true, opts: opts, connections: connections}
 }
 
 //Checking volume references with started and stopped containers as well.
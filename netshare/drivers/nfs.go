@@ -2,8 +2,11 @@ package drivers
 
 import (
 	"fmt"
+	"net"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 	log "github.com/sirupsen/logrus"
@@ -11,29 +14,47 @@ import (
 
 const (
 	NfsOptions   = "nfsopts"
+	ServersOpt   = "servers"
 	DefaultNfsV3 = "port=2049,nolock,proto=tcp"
+	NfsPort      = 2049
+
+	// volume status keys
+	StatusServer  = "server"
+	StatusServers = "servers"
+	StatusFailed  = "failed"
+)
+
+var (
+	ReplicaCheckInterval = 30 * time.Second
+	ReplicaProbeTimeout  = 2 * time.Second
 )
 
 type nfsDriver struct {
 	volumeDriver
 	version int
 	nfsopts map[string]string
+	shares  *shareManager
 }
 
 var (
 	EmptyMap = map[string]string{}
 )
 
-func NewNFSDriver(root string, version int, nfsopts string, mounts *MountManager) nfsDriver {
+func NewNFSDriver(root string, version int, nfsopts string, sharemounts bool, mounts *MountManager) nfsDriver {
 	d := nfsDriver{
 		volumeDriver: newVolumeDriver(root, mounts),
 		version:      version,
 		nfsopts:      map[string]string{},
 	}
 
+	if sharemounts {
+		d.shares = newShareManager(root)
+	}
+
 	if len(nfsopts) > 0 {
 		d.nfsopts[NfsOptions] = nfsopts
 	}
+	go d.watchReplicas(ReplicaCheckInterval)
 	return d
 }
 
@@ -42,65 +63,51 @@ func (n nfsDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error)
 	n.m.Lock()
 	defer n.m.Unlock()
 
-	resolvedName, resOpts := resolveName(r.Name)
-
-	hostdir := mountpoint(n.root, resolvedName)
-	source := n.fixSource(resolvedName)
+	resolvedName, resOpts, hostdir := n.resolveVolume(r.Name)
 
 	// Support adhoc mounts (outside of docker volume create)
 	// need to adjust source for ShareOpt
-	if resOpts != nil {
-		if share, found := resOpts[ShareOpt]; found {
-			source = n.fixSource(share)
-		}
+	source, err := n.shareAddress(resolvedName, resOpts)
+	if err != nil {
+		return nil, err
 	}
 
-	if n.mountm.HasMount(resolvedName) {
-		log.Infof("Using existing NFS volume mount: %s", hostdir)
-		n.mountm.Increment(resolvedName)
-		if err := run(fmt.Sprintf("grep -c %s /proc/mounts", hostdir)); err != nil {
-			log.Infof("Existing NFS volume not mounted, force remount.")
-			// maintain count
-			if n.mountm.Count(resolvedName) > 0 {
-				n.mountm.Decrement(resolvedName)
-			}
-		} else {
-			//n.mountm.Increment(resolvedName)
-			return &volume.MountResponse{Mountpoint: hostdir}, nil
-		}
+	if len(source.Hosts) > 1 && n.shares != nil {
+		return nil, fmt.Errorf("volume %s lists several servers, which is not supported with shared mounts", resolvedName)
+	}
+
+	if failed, _ := n.mountm.GetStatusValue(resolvedName, StatusFailed).(string); failed != "" {
+		// the server died under running containers, the new one gets another replica
+		n.moveReplica(resolvedName, source, failed, hostdir)
+	}
+
+	if n.existingMount(resolvedName, hostdir) {
+		return n.mountResponse(resolvedName, hostdir)
 	}
 
 	log.Infof("Mounting NFS volume %s on %s", source, hostdir)
 
 	if err := createDest(hostdir); err != nil {
-		if n.mountm.Count(resolvedName) > 0 {
-			n.mountm.Decrement(resolvedName)
-		}
 		return nil, err
 	}
 
-	if n.mountm.HasMount(resolvedName) == false {
-		n.mountm.Create(resolvedName, hostdir, resOpts)
-	}
-
-	n.mountm.Add(resolvedName, hostdir)
+	n.addMount(resolvedName, hostdir, resOpts)
 
-	if err := n.mountVolume(resolvedName, source, hostdir, n.version); err != nil {
+	if err := n.mountSource(resolvedName, source, hostdir); err != nil {
 		n.mountm.Decrement(resolvedName)
 		return nil, err
 	}
 
-	if n.mountm.GetOption(resolvedName, ShareOpt) != "" && n.mountm.GetOptionAsBool(resolvedName, CreateOpt) {
-		log.Infof("Mount: Share and Create options enabled - using %s as sub-dir mount", resolvedName)
-		datavol := filepath.Join(hostdir, resolvedName)
-		if err := createDest(filepath.Join(hostdir, resolvedName)); err != nil {
-			n.mountm.Decrement(resolvedName)
-			return nil, err
-		}
-		hostdir = datavol
-	}
+	return n.mountResponse(resolvedName, hostdir)
+}
 
-	return &volume.MountResponse{Mountpoint: hostdir}, nil
+func (n nfsDriver) mountResponse(name, hostdir string) (*volume.MountResponse, error) {
+	dir, err := n.volumeDir(name, hostdir, n.shares != nil)
+	if err != nil {
+		n.mountm.Decrement(name)
+		return nil, err
+	}
+	return &volume.MountResponse{Mountpoint: dir}, nil
 }
 
 func (n nfsDriver) Unmount(r *volume.UnmountRequest) error {
@@ -109,27 +116,24 @@ func (n nfsDriver) Unmount(r *volume.UnmountRequest) error {
 	n.m.Lock()
 	defer n.m.Unlock()
 
-	resolvedName, _ := resolveName(r.Name)
-
-	hostdir := mountpoint(n.root, resolvedName)
+	resolvedName, _, hostdir := n.resolveVolume(r.Name)
 
-	if n.mountm.HasMount(resolvedName) {
-		if n.mountm.Count(resolvedName) > 1 {
-			log.Printf("Skipping unmount for %s - in use by other containers", resolvedName)
-			n.mountm.Decrement(resolvedName)
-			return nil
-		}
-		n.mountm.Decrement(resolvedName)
+	if n.releaseMount(resolvedName) {
+		return nil
 	}
 
 	log.Infof("Unmounting volume name %s from %s", resolvedName, hostdir)
+	return n.unmountVolume(resolvedName, hostdir)
+}
 
-	if err := run(fmt.Sprintf("umount %s", hostdir)); err != nil {
+// unmountVolume unmounts the volume from hostdir and removes hostdir unless files were left in it
+func (n nfsDriver) unmountVolume(name, hostdir string) error {
+	if err := n.unmountSource(name, hostdir); err != nil {
 		log.Errorf("Error unmounting volume from host: %s", err.Error())
 		return err
 	}
 
-	n.mountm.DeleteIfNotManaged(resolvedName)
+	n.mountm.DeleteIfNotManaged(name)
 
 	// Check if directory is empty. This command will return "err" if empty
 	if err := run(fmt.Sprintf("ls -1 %s | grep .", hostdir)); err == nil {
@@ -143,20 +147,243 @@ func (n nfsDriver) Unmount(r *volume.UnmountRequest) error {
 	return nil
 }
 
-func (n nfsDriver) fixSource(name string) string {
-	if n.mountm.HasOption(name, ShareOpt) {
-		return addShareColon(n.mountm.GetOption(name, ShareOpt))
+// shareAddress parses the volume's share.  Servers listed in the servers option replace the share's hosts.
+func (n nfsDriver) shareAddress(name string, resOpts map[string]string) (*ShareAddress, error) {
+	addr, err := ParseShareAddress(n.volumeShare(name, resOpts), NFS)
+	if err != nil {
+		return nil, err
+	}
+	if servers := n.mountm.GetOption(name, ServersOpt); servers != "" {
+		addr.Hosts = nil
+		if err := addr.parseHosts(servers); err != nil {
+			return nil, fmt.Errorf("servers %s: %s", servers, err.Error())
+		}
+	}
+	return addr, nil
+}
+
+// mountSource mounts the volume on hostdir, either directly or as a bind mount from a shared mount of its export
+func (n nfsDriver) mountSource(name string, addr *ShareAddress, hostdir string) error {
+	key := shareKey(NFS.String(), addr.String(), strconv.Itoa(n.version), n.mountOptions(name))
+	return n.mountShared(name, key, hostdir, func(dest string) error {
+		return n.mountReplica(name, addr, orderByHealth(addr, addr.Hosts), dest)
+	})
+}
+
+// mountShared runs mount on hostdir, or with shared mounts binds hostdir to the shared mount for key,
+// running mount for the first volume of the share
+func (n nfsDriver) mountShared(name, key, hostdir string, mount func(dest string) error) error {
+	if n.shares == nil {
+		return mount(hostdir)
+	}
+
+	subdir, create := "", false
+	if n.mountm.GetOption(name, ShareOpt) != "" && n.mountm.GetOptionAsBool(name, CreateOpt) {
+		subdir, create = name, true
+	}
+	return n.shares.Mount(name, key, subdir, hostdir, create, mount)
+}
+
+// mountOptions returns the volume's nfsopts, or the daemon's when it has none
+func (n nfsDriver) mountOptions(name string) string {
+	return merge(n.mountm.GetOptions(name), n.nfsopts)[NfsOptions]
+}
+
+func (n nfsDriver) unmountSource(name, hostdir string) error {
+	if n.shares == nil {
+		return run(fmt.Sprintf("umount %s", hostdir))
+	}
+	return n.shares.Unmount(name, hostdir)
+}
+
+// mountReplica mounts the first of hosts that works.  Replicated exports list several servers in the
+// share (nfs1,nfs2:/export) or the servers option.
+func (n nfsDriver) mountReplica(name string, addr *ShareAddress, hosts []string, hostdir string) error {
+	var lastErr error
+	for _, host := range hosts {
+		if err := n.checkExport(name, host, addr.Path); err != nil {
+			lastErr = err
+			continue
+		}
+		if err := n.mountVolume(name, addr, host, hostdir, n.version); err != nil {
+			log.Warnf("Mounting %s failed: %s", addr.NfsSource(host), err.Error())
+			lastErr = err
+			continue
+		}
+		n.mountm.DeleteStatus(name, StatusFailed)
+		if len(addr.Hosts) > 1 {
+			log.Infof("Volume %s is served by %s", name, host)
+			n.mountm.SetStatus(name, StatusServers, strings.Join(addr.Hosts, ","))
+			n.mountm.SetStatus(name, StatusServer, host)
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// failover detaches the mount of a dead server from hostdir and mounts the volume from the first of hosts
+// that works.  Running containers keep their own bind of the old mount, so only containers started
+// afterwards get the new server.
+func (n nfsDriver) failover(name string, addr *ShareAddress, hosts []string, hostdir string) error {
+	if err := run(fmt.Sprintf("umount -f -l %s", hostdir)); err != nil {
+		return err
 	}
-	return addShareColon(name)
+	return n.mountReplica(name, addr, hosts, hostdir)
 }
 
-func (n nfsDriver) mountVolume(name, source, dest string, version int) error {
+// moveReplica fails over a volume whose server died while containers were using it, so a new container
+// doesn't get the dead mount.  When no other replica can be mounted, Mount mounts the volume afresh.
+func (n nfsDriver) moveReplica(name string, addr *ShareAddress, failed, hostdir string) {
+	if _, _, _, mounted := procMount(hostdir); !mounted {
+		return
+	}
+	others := []string{}
+	for _, h := range addr.Hosts {
+		if h != failed {
+			others = append(others, h)
+		}
+	}
+	log.Infof("NFS server %s of volume %s is not responding, mounting it from another replica - %d running containers stay on %s",
+		failed, name, n.mountm.Count(name), failed)
+	if err := n.failover(name, addr, orderByHealth(addr, others), hostdir); err != nil {
+		log.Warnf("Moving volume %s off %s failed: %s", name, failed, err.Error())
+	}
+}
+
+// replicaCheck is a mounted replicated volume whose servers are probed outside the driver lock
+type replicaCheck struct {
+	name    string
+	addr    *ShareAddress
+	active  string
+	healthy []string
+}
+
+// watchReplicas periodically probes the active server of replicated volumes.  A volume no container uses is
+// moved to a healthy replica right away, one in use is marked failed and moved by its next Mount.  A probe of
+// a dead server takes ReplicaProbeTimeout, so the driver lock is only held to read and update the volumes
+// and Mount and Unmount go ahead meanwhile.
+func (n nfsDriver) watchReplicas(interval time.Duration) {
+	for range time.Tick(interval) {
+		n.m.Lock()
+		checks := n.replicaChecks()
+		n.m.Unlock()
+
+		for _, c := range checks {
+			up := probeNfsServer(c.addr, c.active)
+			if !up {
+				for _, h := range c.addr.Hosts {
+					if h != c.active && probeNfsServer(c.addr, h) {
+						c.healthy = append(c.healthy, h)
+					}
+				}
+			}
+			n.m.Lock()
+			n.updateReplica(c, up)
+			n.m.Unlock()
+		}
+	}
+}
+
+// replicaChecks returns the mounted replicated volumes with the server each is mounted from
+func (n nfsDriver) replicaChecks() []replicaCheck {
+	checks := []replicaCheck{}
+	for _, name := range n.mountm.Names() {
+		source, _, _, found := procMount(n.mountm.GetHostDir(name))
+		if !found {
+			continue
+		}
+		addr, err := n.shareAddress(name, nil)
+		if err != nil || len(addr.Hosts) < 2 {
+			continue
+		}
+		active, _ := n.mountm.GetStatusValue(name, StatusServer).(string)
+		if active == "" {
+			if cur, err := ParseShareAddress(source, NFS); err == nil {
+				active = cur.Host()
+			}
+		}
+		checks = append(checks, replicaCheck{name: name, addr: addr, active: active})
+	}
+	return checks
+}
+
+// updateReplica acts on the probe of a volume's active server.  A volume without containers is mounted
+// from a healthy replica.  One in use can't be moved for the containers holding it, so it is marked
+// failed and the next Mount moves it.
+func (n nfsDriver) updateReplica(c replicaCheck, up bool) {
+	hostdir := n.mountm.GetHostDir(c.name)
+	if _, _, _, mounted := procMount(hostdir); !mounted {
+		return
+	}
+	if active, _ := n.mountm.GetStatusValue(c.name, StatusServer).(string); active != "" && active != c.active {
+		// remounted from another server while probing
+		return
+	}
+	failed, _ := n.mountm.GetStatusValue(c.name, StatusFailed).(string)
+	switch {
+	case up:
+		if failed != "" {
+			log.Infof("NFS server %s for volume %s is responding again", c.active, c.name)
+			n.mountm.DeleteStatus(c.name, StatusFailed)
+		}
+	case n.mountm.Count(c.name) == 0 && len(c.healthy) > 0:
+		log.Infof("NFS server %s for volume %s is not responding, moving the volume to %s", c.active, c.name, c.healthy[0])
+		if err := n.failover(c.name, c.addr, c.healthy, hostdir); err != nil {
+			log.Errorf("Failing over volume %s: %s", c.name, err.Error())
+			n.mountm.SetStatus(c.name, StatusFailed, c.active)
+		}
+	case failed == "":
+		log.Warnf("NFS server %s for volume %s is not responding - running containers stay on it, new mounts use another replica", c.active, c.name)
+		n.mountm.SetStatus(c.name, StatusFailed, c.active)
+	}
+}
+
+// orderByHealth moves servers that don't answer on the NFS port to the end, keeping the given order otherwise
+func orderByHealth(addr *ShareAddress, hosts []string) []string {
+	if len(hosts) < 2 {
+		return hosts
+	}
+	healthy, down := []string{}, []string{}
+	for _, h := range hosts {
+		if probeNfsServer(addr, h) {
+			healthy = append(healthy, h)
+		} else {
+			down = append(down, h)
+		}
+	}
+	return append(healthy, down...)
+}
+
+func probeNfsServer(addr *ShareAddress, host string) bool {
+	port := NfsPort
+	if addr.Port != 0 {
+		port = addr.Port
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(resolveHost(host), strconv.Itoa(port)), ReplicaProbeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// checkExport asks the server's mountd whether dir is exported to us, unless disabled with exportcheck=false.
+func (n nfsDriver) checkExport(name, host, dir string) error {
+	if n.mountm.HasOption(name, ExportCheckOpt) && !n.mountm.GetOptionAsBool(name, ExportCheckOpt) {
+		return nil
+	}
+	return checkNfsExport(resolveHost(host), dir, n.version)
+}
+
+func (n nfsDriver) mountVolume(name string, addr *ShareAddress, host, dest string, version int) error {
 	var cmd string
 
 	options := merge(n.mountm.GetOptions(name), n.nfsopts)
-	opts := ""
-	if val, ok := options[NfsOptions]; ok {
-		opts = val
+	opts := options[NfsOptions]
+	source := addr.NfsSource(host)
+	if !strings.Contains(","+opts, ",sec=krb5") {
+		// Kerberos needs the server's name for its service principal
+		source = addr.NfsSource(resolveHost(host))
 	}
 
 	mountCmd := "mount"
@@ -171,9 +398,24 @@ func (n nfsDriver) mountVolume(name, source, dest string, version int) error {
 		if len(opts) < 1 {
 			opts = DefaultNfsV3
 		}
-		cmd = fmt.Sprintf("%s -t nfs -o %s %s %s", mountCmd, opts, source, dest)
+		if addr.Port != 0 {
+			opts = setMountOption(opts, "port", strconv.Itoa(addr.Port))
+		}
+		lockOpts, locking, err := nfsLockingOptions(options[LockingOpt], host, opts)
+		if err != nil {
+			return err
+		}
+		if locking != "nlm" && strings.EqualFold(options[LockingOpt], LockingAuto) {
+			log.Warnf("Volume %s is mounted without NFS locking (%s) - locks are not coordinated with other clients", name, locking)
+		}
+		n.mountm.SetStatus(name, StatusLocking, locking)
+		cmd = fmt.Sprintf("%s -t nfs -o %s %s %s", mountCmd, lockOpts, source, dest)
 	default:
 		log.Debugf("Mounting with NFSv4 - src: %s, dest: %s", source, dest)
+		n.mountm.SetStatus(name, StatusLocking, "nfsv4")
+		if addr.Port != 0 {
+			opts = setMountOption(opts, "port", strconv.Itoa(addr.Port))
+		}
 		if len(opts) > 0 {
 			cmd = fmt.Sprintf("%s -t nfs4 -o %s %s %s", mountCmd, opts, source, dest)
 		} else {
@@ -0,0 +1,251 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MountProgram     = 100005
+	MountVersion     = 3
+	ExportCheckOpt   = "exportcheck"
+	EveryoneGroup    = "(everyone)"
+	mountProcExport  = 5
+	maxExportEntries = 4096
+)
+
+var (
+	// ExportCheckTimeout bounds asking a server's mountd for its exports before mounting
+	ExportCheckTimeout = 2 * time.Second
+	// ExportCacheTTL is how long the export list of a server is reused
+	ExportCacheTTL = time.Minute
+
+	exportCache  = map[string]*exportList{}
+	exportCacheM = &sync.Mutex{}
+)
+
+// NfsExport is a single entry of a server's export list, as shown by `showmount -e`.
+type NfsExport struct {
+	Dir    string
+	Groups []string
+}
+
+// AllowsEveryone reports whether the export is open to any client.
+func (e NfsExport) AllowsEveryone() bool {
+	if len(e.Groups) == 0 {
+		return true
+	}
+	for _, g := range e.Groups {
+		if g == "*" || g == EveryoneGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// NfsExports queries the MOUNT v3 EXPORT procedure on server, locating mountd through the portmapper.
+func NfsExports(server string) ([]NfsExport, error) {
+	exports, _, err := queryExports(server, DefaultRPCTimeout)
+	return exports, err
+}
+
+// queryExports returns the export list along with the local address used to reach server, which is
+// the address the server will see when we mount.
+func queryExports(server string, timeout time.Duration) ([]NfsExport, net.IP, error) {
+	c, err := dialRPCProgram(server, MountProgram, MountVersion, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+
+	r, err := c.Call(mountProcExport, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exports := []NfsExport{}
+	for r.Bool() {
+		if len(exports) >= maxExportEntries {
+			return nil, nil, fmt.Errorf("export list from %s exceeds %d entries", server, maxExportEntries)
+		}
+		e := NfsExport{Dir: r.String(), Groups: []string{}}
+		for r.Bool() {
+			e.Groups = append(e.Groups, r.String())
+		}
+		exports = append(exports, e)
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	var local net.IP
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		local = addr.IP
+	}
+	return exports, local, nil
+}
+
+// exportList is the cached answer of a server's mountd
+type exportList struct {
+	exports []NfsExport
+	local   net.IP
+	err     error
+	expires time.Time
+}
+
+// cachedExports returns the export list of server, asking its mountd at most once per ExportCacheTTL
+// unless refresh is set.  Failures are cached as well, so servers without mountd don't delay every mount.
+// The second result reports whether the list came from the cache.
+func cachedExports(server string, refresh bool) (*exportList, bool) {
+	exportCacheM.Lock()
+	defer exportCacheM.Unlock()
+	if list, found := exportCache[server]; found && !refresh && time.Now().Before(list.expires) {
+		return list, true
+	}
+	exports, local, err := queryExports(server, ExportCheckTimeout)
+	list := &exportList{exports: exports, local: local, err: err, expires: time.Now().Add(ExportCacheTTL)}
+	exportCache[server] = list
+	return list, false
+}
+
+// checkNfsExport confirms that dir is exported by server.  Errors talking to mountd are not fatal (NFSv4-only
+// servers often don't run it), so only a definitive "not exported" answer is returned.  An export whose
+// client list doesn't seem to name this host only logs a warning: behind NAT, with netgroups or DNS aliases
+// the server may know it by a name that can't be seen from here.
+func checkNfsExport(server, dir string, version int) error {
+	dir = path.Clean("/" + dir)
+	list, cached := cachedExports(server, false)
+	if list.err == nil && cached && len(matchingExports(list.exports, dir, version)) == 0 {
+		// the path may have been exported since the list was cached
+		list, _ = cachedExports(server, true)
+	}
+	if list.err != nil {
+		log.Debugf("Skipping export check for %s:%s - %s", server, dir, list.err.Error())
+		return nil
+	}
+
+	matched := matchingExports(list.exports, dir, version)
+	if len(matched) == 0 {
+		return fmt.Errorf("%s is not exported by %s (exports: %s)", dir, server, exportDirs(list.exports))
+	}
+	if names, groups, ok := exportedTo(matched, list.local); !ok {
+		log.Warnf("%s:%s is exported to %s, which doesn't seem to include this host (%s) - mounting anyway",
+			server, dir, strings.Join(groups, ","), strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// exportedTo reports whether one of the exports lists this host as a client.  Otherwise the names this
+// host was looked for under and the allowed clients are returned.
+func exportedTo(exports []NfsExport, local net.IP) ([]string, []string, bool) {
+	groups := []string{}
+	for _, e := range exports {
+		if e.AllowsEveryone() {
+			return nil, nil, true
+		}
+		groups = append(groups, e.Groups...)
+	}
+	names := localClientNames(local)
+	for _, g := range groups {
+		// netgroups can't be evaluated from here, let the server decide
+		if strings.HasPrefix(g, "@") || exportGroupMatches(g, local, names) {
+			return nil, nil, true
+		}
+	}
+	return names, groups, false
+}
+
+// matchingExports returns the exports that dir can be mounted from.  A sub-directory of an export
+// is mountable, and with NFSv4 the path may be relative to a pseudo root (fsid=0) export.
+func matchingExports(exports []NfsExport, dir string, version int) []NfsExport {
+	matched := []NfsExport{}
+	for _, e := range exports {
+		if pathWithin(dir, e.Dir) {
+			matched = append(matched, e)
+			continue
+		}
+		if version != 3 {
+			for _, root := range exports {
+				if root.Dir != "/" && pathWithin(path.Join(root.Dir, dir), e.Dir) {
+					matched = append(matched, e)
+					break
+				}
+			}
+		}
+	}
+	return matched
+}
+
+func pathWithin(dir, parent string) bool {
+	parent = path.Clean(parent)
+	return parent == "/" || dir == parent || strings.HasPrefix(dir, parent+"/")
+}
+
+func exportDirs(exports []NfsExport) string {
+	if len(exports) == 0 {
+		return "none"
+	}
+	dirs := make([]string, len(exports))
+	for i, e := range exports {
+		dirs[i] = e.Dir
+	}
+	return strings.Join(dirs, ", ")
+}
+
+// localClientNames lists the identities the server may know this host by: the source address of the
+// connection, its reverse DNS names and the local hostname.
+func localClientNames(local net.IP) []string {
+	names := []string{}
+	if local != nil {
+		names = append(names, local.String())
+		if rev, err := net.LookupAddr(local.String()); err == nil {
+			for _, n := range rev {
+				names = append(names, strings.TrimSuffix(n, "."))
+			}
+		}
+	}
+	if hn, err := os.Hostname(); err == nil {
+		names = append(names, hn)
+	}
+	return names
+}
+
+// exportGroupMatches evaluates one client specification from an export list: an address, a CIDR or
+// address/netmask network, or a (possibly wildcarded) host name.
+func exportGroupMatches(group string, local net.IP, names []string) bool {
+	group = strings.ToLower(group)
+	if local != nil {
+		if ip := net.ParseIP(group); ip != nil {
+			return ip.Equal(local)
+		}
+		if _, network, err := net.ParseCIDR(group); err == nil {
+			return network.Contains(local)
+		}
+		if i := strings.Index(group, "/"); i > 0 {
+			ip, mask := net.ParseIP(group[:i]), net.ParseIP(group[i+1:])
+			if ip != nil && mask != nil && ip.To4() != nil && mask.To4() != nil {
+				m := net.IPMask(mask.To4())
+				return ip.Mask(m).Equal(local.Mask(m))
+			}
+		}
+	}
+	for _, n := range names {
+		n = strings.ToLower(n)
+		if ok, _ := path.Match(group, n); ok {
+			return true
+		}
+		// unqualified names in exports match our FQDN and vice versa
+		if !strings.Contains(group, "*") && strings.SplitN(group, ".", 2)[0] == strings.SplitN(n, ".", 2)[0] &&
+			(!strings.Contains(group, ".") || !strings.Contains(n, ".")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package drivers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// serveExports makes the fake server's mountd answer EXPORT with exports
+func serveExports(s *fakeRPCServer, exports []NfsExport) {
+	s.handle(MountProgram, mountProcExport, func(w *xdrWriter) {
+		for _, e := range exports {
+			w.PutUint32(1)
+			w.PutString(e.Dir)
+			for _, g := range e.Groups {
+				w.PutUint32(1)
+				w.PutString(g)
+			}
+			w.PutUint32(0)
+		}
+		w.PutUint32(0)
+	})
+}
+
+func resetExportCache() {
+	exportCacheM.Lock()
+	defer exportCacheM.Unlock()
+	exportCache = map[string]*exportList{}
+}
+
+func TestQueryExports(t *testing.T) {
+	s, stop := startRPCServer(t, MountProgram)
+	defer stop()
+	serveExports(s, []NfsExport{{"/export", []string{"*"}}, {"/private", []string{"10.0.0.0/8", "@admins"}}})
+
+	exports, local, err := queryExports("127.0.0.1", ExportCheckTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(exports); got != "[{/export [*]} {/private [10.0.0.0/8 @admins]}]" {
+		t.Errorf("exports = %s", got)
+	}
+	if local.String() != "127.0.0.1" {
+		t.Errorf("local address = %s, want 127.0.0.1", local)
+	}
+}
+
+func TestCheckNfsExport(t *testing.T) {
+	s, stop := startRPCServer(t, MountProgram)
+	defer stop()
+	serveExports(s, []NfsExport{
+		{"/export", []string{"192.0.2.1"}},
+		{"/export/data", []string{"*"}},
+		{"/export/other", []string{"192.0.2.1"}},
+		{"/export/team", []string{"127.0.0.0/8"}},
+	})
+
+	tests := []struct {
+		dir     string
+		version int
+		ok      bool
+	}{
+		{"/export/data", 3, true},
+		{"export/data/sub/", 3, true},
+		{"/export/team", 4, true},
+		// exported to another client only warns
+		{"/export/other", 3, true},
+		{"/missing", 3, false},
+		// relative to the NFSv4 pseudo root
+		{"/data", 4, true},
+		{"/data", 3, false},
+	}
+	for _, tt := range tests {
+		resetExportCache()
+		err := checkNfsExport("127.0.0.1", tt.dir, tt.version)
+		if tt.ok && err != nil {
+			t.Errorf("checkNfsExport(%q, %d): %s", tt.dir, tt.version, err)
+		}
+		if !tt.ok && (err == nil || !strings.Contains(err.Error(), "not exported")) {
+			t.Errorf("checkNfsExport(%q, %d) = %v, want it not to be exported", tt.dir, tt.version, err)
+		}
+	}
+}
+
+func TestCheckNfsExportCache(t *testing.T) {
+	s, stop := startRPCServer(t, MountProgram)
+	defer stop()
+	serveExports(s, []NfsExport{{"/export", []string{"*"}}})
+	resetExportCache()
+	defer resetExportCache()
+
+	for i := 0; i < 3; i++ {
+		if err := checkNfsExport("127.0.0.1", "/export", 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.called(MountProgram, mountProcExport); n != 1 {
+		t.Errorf("EXPORT called %d times, want 1", n)
+	}
+
+	// a path missing from the cached list is looked up again
+	serveExports(s, []NfsExport{{"/export", []string{"*"}}, {"/new", []string{"*"}}})
+	if err := checkNfsExport("127.0.0.1", "/new", 3); err != nil {
+		t.Errorf("checkNfsExport of a new export: %s", err)
+	}
+	if n := s.called(MountProgram, mountProcExport); n != 2 {
+		t.Errorf("EXPORT called %d times, want 2", n)
+	}
+
+	// without mountd the check is skipped, and the failure is remembered
+	stop()
+	resetExportCache()
+	for i := 0; i < 2; i++ {
+		if err := checkNfsExport("127.0.0.1", "/export", 3); err != nil {
+			t.Errorf("checkNfsExport without mountd: %s", err)
+		}
+	}
+	exportCacheM.Lock()
+	list := exportCache["127.0.0.1"]
+	exportCacheM.Unlock()
+	if list == nil || list.err == nil {
+		t.Errorf("the failed query isn't cached: %+v", list)
+	}
+}
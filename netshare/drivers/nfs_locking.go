@@ -0,0 +1,94 @@
+package drivers
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	LockingOpt = "locking"
+
+	LockingAuto   = "auto"
+	LockingLocal  = "local"
+	LockingNone   = "nolock"
+	LockingLockd  = "lockd"
+	StatusLocking = "locking"
+
+	StatdProgram = 100024
+	StatdVersion = 1
+	NlmProgram   = 100021
+	NlmVersion   = 4
+)
+
+// lockOptions are the mount.nfs options which decide how NFSv3 locks are handled
+var lockOptions = []string{"lock", "nolock", "local_lock"}
+
+// nfsLockingOptions applies the locking mode to the NFSv3 mount options and returns them along with the
+// status reported for the volume: "nlm" (locks are coordinated by the server), "local" (locks only
+// exclude other processes on this host) or "none".  Without a mode the options are used as-is, so
+// volumes created before the locking option keep the nolock of DefaultNfsV3.
+func nfsLockingOptions(mode, host, opts string) (string, string, error) {
+	if mode == "" {
+		if status, explicit := explicitLocking(opts); explicit {
+			return opts, status, nil
+		}
+		// mount.nfs locks unless told otherwise
+		return opts, "nlm", nil
+	}
+	for _, o := range lockOptions {
+		opts = removeMountOption(opts, o)
+	}
+
+	switch strings.ToLower(mode) {
+	case LockingAuto:
+		if statdAvailable() && nlmAvailable(host) {
+			return setMountOption(opts, "lock", ""), "nlm", nil
+		}
+		log.Debugf("rpc.statd or the NLM service on %s is not available, mounting without locks", host)
+		return setMountOption(opts, "nolock", ""), "none", nil
+	case LockingLocal:
+		return setMountOption(opts, "local_lock", "all"), "local", nil
+	case LockingNone:
+		return setMountOption(opts, "nolock", ""), "none", nil
+	case LockingLockd:
+		if !statdAvailable() {
+			log.Infof("rpc.statd is not running, starting it for NFSv3 locking")
+			if err := run("rpc.statd"); err != nil || !statdAvailable() {
+				return "", "", fmt.Errorf("locking=lockd requires rpc.statd, which could not be started")
+			}
+		}
+		if !nlmAvailable(host) {
+			return "", "", fmt.Errorf("locking=lockd requested but %s does not offer the NLM service", host)
+		}
+		return setMountOption(opts, "lock", ""), "nlm", nil
+	default:
+		return "", "", fmt.Errorf("invalid locking mode %s, expected one of %s|%s|%s|%s", mode, LockingAuto, LockingLocal, LockingNone, LockingLockd)
+	}
+}
+
+// explicitLocking reports the locking status when nfsopts already decide it
+func explicitLocking(opts string) (string, bool) {
+	for _, o := range strings.Split(opts, ",") {
+		switch {
+		case o == "nolock":
+			return "none", true
+		case strings.HasPrefix(o, "local_lock=") && o != "local_lock=none":
+			return "local", true
+		case o == "lock":
+			return "nlm", true
+		}
+	}
+	return "", false
+}
+
+func statdAvailable() bool {
+	port, err := portmapGetPort("127.0.0.1", StatdProgram, StatdVersion, DefaultRPCTimeout)
+	return err == nil && port > 0
+}
+
+func nlmAvailable(host string) bool {
+	port, err := portmapGetPort(host, NlmProgram, NlmVersion, DefaultRPCTimeout)
+	return err == nil && port > 0
+}
@@ -0,0 +1,48 @@
+package drivers
+
+import "testing"
+
+func TestNfsLockingOptions(t *testing.T) {
+	statd, nlm := uint32(StatdProgram), uint32(NlmProgram)
+	tests := []struct {
+		mode     string
+		opts     string
+		programs []uint32
+		want     string
+		status   string
+		fails    bool
+	}{
+		// without a mode the options decide
+		{"", DefaultNfsV3, nil, DefaultNfsV3, "none", false},
+		{"", "vers=3,lock", nil, "vers=3,lock", "nlm", false},
+		{"", "local_lock=all", nil, "local_lock=all", "local", false},
+		{"", "tcp", nil, "tcp", "nlm", false},
+
+		{"auto", "tcp,nolock", []uint32{statd, nlm}, "tcp,lock", "nlm", false},
+		{"auto", "tcp,lock", []uint32{statd}, "tcp,nolock", "none", false},
+		{"auto", "tcp", []uint32{nlm}, "tcp,nolock", "none", false},
+		{"local", "tcp,lock", nil, "tcp,local_lock=all", "local", false},
+		{"nolock", "local_lock=posix,tcp", nil, "tcp,nolock", "none", false},
+		{"lockd", "tcp", []uint32{statd, nlm}, "tcp,lock", "nlm", false},
+		{"lockd", "tcp", []uint32{statd}, "", "", true},
+		{"flock", "tcp", nil, "", "", true},
+	}
+	for _, tt := range tests {
+		_, stop := startRPCServer(t, tt.programs...)
+		opts, status, err := nfsLockingOptions(tt.mode, "127.0.0.1", tt.opts)
+		stop()
+		if tt.fails {
+			if err == nil {
+				t.Errorf("nfsLockingOptions(%q, %q) with %v succeeded", tt.mode, tt.opts, tt.programs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("nfsLockingOptions(%q, %q) with %v: %s", tt.mode, tt.opts, tt.programs, err)
+			continue
+		}
+		if opts != tt.want || status != tt.status {
+			t.Errorf("nfsLockingOptions(%q, %q) with %v = %q, %s, want %q, %s", tt.mode, tt.opts, tt.programs, opts, status, tt.want, tt.status)
+		}
+	}
+}
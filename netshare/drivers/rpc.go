@@ -0,0 +1,278 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Minimal ONC RPC (RFC 5531) client over TCP, enough to talk to the portmapper
+// and the NFS MOUNT service without relying on rpcbind/showmount binaries.
+
+const (
+	PortmapProgram = 100000
+	PortmapVersion = 2
+
+	rpcVersion      = 2
+	rpcCall         = 0
+	rpcReply        = 1
+	rpcMsgAccepted  = 0
+	rpcMsgDenied    = 1
+	rpcSuccess      = 0
+	rpcLastFragment = 0x80000000
+	rpcMaxRecord    = 1 << 20
+
+	portmapProcGetPort = 3
+	ipProtoTCP         = 6
+)
+
+var (
+	DefaultRPCTimeout = 5 * time.Second
+	// PortmapPort is where the portmapper of a server is asked for the port of a program
+	PortmapPort = 111
+
+	rpcAcceptErrors = []string{
+		"success",
+		"program unavailable",
+		"program version mismatch",
+		"procedure unavailable",
+		"garbage arguments",
+		"system error",
+	}
+)
+
+// rpcClient is a single TCP connection to one RPC program on a server.
+type rpcClient struct {
+	conn    net.Conn
+	program uint32
+	version uint32
+	timeout time.Duration
+}
+
+func dialRPC(host string, port int, program, version uint32, timeout time.Duration) (*rpcClient, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcClient{conn: conn, program: program, version: version, timeout: timeout}, nil
+}
+
+// dialRPCProgram asks the portmapper on host where program/version listens over TCP and connects to it.
+func dialRPCProgram(host string, program, version uint32, timeout time.Duration) (*rpcClient, error) {
+	port, err := portmapGetPort(host, program, version, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("rpc program %d version %d is not registered on %s", program, version, host)
+	}
+	return dialRPC(host, port, program, version, timeout)
+}
+
+func (c *rpcClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *rpcClient) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Call invokes proc with already XDR-encoded args and returns a reader positioned at the procedure results.
+func (c *rpcClient) Call(proc uint32, args []byte) (*xdrReader, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	xid := rand.Uint32()
+
+	w := &xdrWriter{}
+	w.PutUint32(xid)
+	w.PutUint32(rpcCall)
+	w.PutUint32(rpcVersion)
+	w.PutUint32(c.program)
+	w.PutUint32(c.version)
+	w.PutUint32(proc)
+	// AUTH_NONE credentials and verifier
+	w.PutUint32(0)
+	w.PutUint32(0)
+	w.PutUint32(0)
+	w.PutUint32(0)
+	w.buf.Write(args)
+
+	record := make([]byte, 4, 4+w.buf.Len())
+	binary.BigEndian.PutUint32(record, rpcLastFragment|uint32(w.buf.Len()))
+	record = append(record, w.buf.Bytes()...)
+	if _, err := c.conn.Write(record); err != nil {
+		return nil, err
+	}
+
+	for {
+		reply, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		r := &xdrReader{r: bytes.NewReader(reply)}
+		if r.Uint32() != xid {
+			// stale reply from an earlier call, keep reading
+			continue
+		}
+		if err := c.parseReplyHeader(r); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+func (c *rpcClient) readRecord() ([]byte, error) {
+	var record []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(hdr[:])
+		size := h &^ rpcLastFragment
+		if len(record)+int(size) > rpcMaxRecord {
+			return nil, fmt.Errorf("rpc reply exceeds %d bytes", rpcMaxRecord)
+		}
+		frag := make([]byte, size)
+		if _, err := io.ReadFull(c.conn, frag); err != nil {
+			return nil, err
+		}
+		record = append(record, frag...)
+		if h&rpcLastFragment != 0 {
+			return record, nil
+		}
+	}
+}
+
+func (c *rpcClient) parseReplyHeader(r *xdrReader) error {
+	if r.Uint32() != rpcReply {
+		return errors.New("rpc: response is not a reply")
+	}
+	switch r.Uint32() {
+	case rpcMsgAccepted:
+		// verifier
+		r.Uint32()
+		r.Opaque()
+		stat := r.Uint32()
+		if r.err != nil {
+			return r.err
+		}
+		if stat != rpcSuccess {
+			msg := "unknown error"
+			if int(stat) < len(rpcAcceptErrors) {
+				msg = rpcAcceptErrors[stat]
+			}
+			return fmt.Errorf("rpc program %d version %d: %s", c.program, c.version, msg)
+		}
+		return nil
+	case rpcMsgDenied:
+		if r.Uint32() == 0 {
+			return fmt.Errorf("rpc version mismatch")
+		}
+		return fmt.Errorf("rpc authentication error (%d)", r.Uint32())
+	default:
+		if r.err != nil {
+			return r.err
+		}
+		return errors.New("rpc: malformed reply")
+	}
+}
+
+// portmapGetPort implements PMAPPROC_GETPORT for TCP transports.
+func portmapGetPort(host string, program, version uint32, timeout time.Duration) (int, error) {
+	c, err := dialRPC(host, PortmapPort, PortmapProgram, PortmapVersion, timeout)
+	if err != nil {
+		return 0, fmt.Errorf("portmapper on %s unreachable: %s", host, err.Error())
+	}
+	defer c.Close()
+
+	args := &xdrWriter{}
+	args.PutUint32(program)
+	args.PutUint32(version)
+	args.PutUint32(ipProtoTCP)
+	args.PutUint32(0)
+
+	r, err := c.Call(portmapProcGetPort, args.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	port := r.Uint32()
+	return int(port), r.err
+}
+
+// xdrWriter encodes XDR (RFC 4506) primitives.
+type xdrWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *xdrWriter) PutUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *xdrWriter) PutOpaque(b []byte) {
+	w.PutUint32(uint32(len(b)))
+	w.buf.Write(b)
+	if pad := (4 - len(b)%4) % 4; pad > 0 {
+		w.buf.Write(make([]byte, pad))
+	}
+}
+
+func (w *xdrWriter) PutString(s string) {
+	w.PutOpaque([]byte(s))
+}
+
+func (w *xdrWriter) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// xdrReader decodes XDR primitives.  The first error is sticky so callers can
+// decode a whole structure and check err once.
+type xdrReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (x *xdrReader) Uint32() uint32 {
+	if x.err != nil {
+		return 0
+	}
+	var b [4]byte
+	if _, err := io.ReadFull(x.r, b[:]); err != nil {
+		x.err = fmt.Errorf("xdr: short read: %s", err.Error())
+		return 0
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func (x *xdrReader) Bool() bool {
+	return x.Uint32() != 0
+}
+
+func (x *xdrReader) Opaque() []byte {
+	n := x.Uint32()
+	if x.err != nil {
+		return nil
+	}
+	if int64(n) > int64(x.r.Len()) {
+		x.err = errors.New("xdr: opaque length exceeds message")
+		return nil
+	}
+	b := make([]byte, n)
+	io.ReadFull(x.r, b)
+	if pad := (4 - n%4) % 4; pad > 0 {
+		x.r.Seek(int64(pad), io.SeekCurrent)
+	}
+	return b
+}
+
+func (x *xdrReader) String() string {
+	return string(x.Opaque())
+}
@@ -0,0 +1,259 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRPCServer speaks ONC RPC over TCP on 127.0.0.1.  The portmapper answers GETPORT with the server's
+// own port for the registered programs, other calls go to the handler of their program and procedure.
+type fakeRPCServer struct {
+	t        *testing.T
+	l        net.Listener
+	port     int
+	m        sync.Mutex
+	programs map[uint32]bool
+	handlers map[[2]uint32]func(w *xdrWriter)
+	calls    map[[2]uint32]int
+
+	// fragment splits replies into fragments of this size, stale sends a reply to another call first,
+	// status is the accept status and denied rejects calls
+	fragment int
+	stale    bool
+	status   uint32
+	denied   bool
+}
+
+// startRPCServer serves on a free port and points the portmapper client at it until stop is called
+func startRPCServer(t *testing.T, programs ...uint32) (*fakeRPCServer, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRPCServer{
+		t:        t,
+		l:        l,
+		port:     l.Addr().(*net.TCPAddr).Port,
+		programs: map[uint32]bool{},
+		handlers: map[[2]uint32]func(w *xdrWriter){},
+		calls:    map[[2]uint32]int{},
+	}
+	for _, p := range programs {
+		s.programs[p] = true
+	}
+	go s.serve()
+
+	port := PortmapPort
+	PortmapPort = s.port
+	return s, func() {
+		PortmapPort = port
+		l.Close()
+	}
+}
+
+func (s *fakeRPCServer) handle(program, proc uint32, h func(w *xdrWriter)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.handlers[[2]uint32{program, proc}] = h
+}
+
+// called returns how often a procedure was called
+func (s *fakeRPCServer) called(program, proc uint32) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.calls[[2]uint32{program, proc}]
+}
+
+func (s *fakeRPCServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *fakeRPCServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	c := &rpcClient{conn: conn}
+	for {
+		call, err := c.readRecord()
+		if err != nil {
+			return
+		}
+		r := &xdrReader{r: bytes.NewReader(call)}
+		xid, msgType, version, program, _, proc := r.Uint32(), r.Uint32(), r.Uint32(), r.Uint32(), r.Uint32(), r.Uint32()
+		r.Uint32()
+		r.Opaque()
+		r.Uint32()
+		r.Opaque()
+		if r.err != nil || msgType != rpcCall || version != rpcVersion {
+			s.t.Errorf("malformed call: %v", r.err)
+			return
+		}
+
+		results := &xdrWriter{}
+		s.m.Lock()
+		s.calls[[2]uint32{program, proc}]++
+		if program == PortmapProgram && proc == portmapProcGetPort {
+			if s.programs[r.Uint32()] {
+				results.PutUint32(uint32(s.port))
+			} else {
+				results.PutUint32(0)
+			}
+		} else if h := s.handlers[[2]uint32{program, proc}]; h != nil {
+			h(results)
+		}
+		stale, fragment, status, denied := s.stale, s.fragment, s.status, s.denied
+		s.m.Unlock()
+
+		if stale {
+			s.reply(conn, xid+1, fragment, rpcSuccess, false, nil)
+		}
+		s.reply(conn, xid, fragment, status, denied, results.Bytes())
+	}
+}
+
+func (s *fakeRPCServer) reply(conn net.Conn, xid uint32, fragment int, status uint32, denied bool, results []byte) {
+	w := &xdrWriter{}
+	w.PutUint32(xid)
+	w.PutUint32(rpcReply)
+	if denied {
+		w.PutUint32(rpcMsgDenied)
+		// AUTH_ERROR, AUTH_TOOWEAK
+		w.PutUint32(1)
+		w.PutUint32(5)
+	} else {
+		w.PutUint32(rpcMsgAccepted)
+		w.PutUint32(0)
+		w.PutOpaque(nil)
+		w.PutUint32(status)
+		w.buf.Write(results)
+	}
+
+	body := w.Bytes()
+	if fragment <= 0 {
+		fragment = len(body)
+	}
+	record := []byte{}
+	for len(body) > 0 {
+		n := fragment
+		if n > len(body) {
+			n = len(body)
+		}
+		hdr := uint32(n)
+		if n == len(body) {
+			hdr |= rpcLastFragment
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], hdr)
+		record = append(append(record, b[:]...), body[:n]...)
+		body = body[n:]
+	}
+	conn.Write(record)
+}
+
+func TestXDR(t *testing.T) {
+	w := &xdrWriter{}
+	w.PutUint32(7)
+	w.PutString("abcde")
+	w.PutOpaque([]byte{1, 2, 3, 4})
+	w.PutOpaque(nil)
+	// strings are padded to four bytes
+	if n := len(w.Bytes()); n != 4+4+8+4+4+4 {
+		t.Errorf("encoded %d bytes, want 28", n)
+	}
+
+	r := &xdrReader{r: bytes.NewReader(w.Bytes())}
+	if v := r.Uint32(); v != 7 {
+		t.Errorf("Uint32 = %d, want 7", v)
+	}
+	if s := r.String(); s != "abcde" {
+		t.Errorf("String = %q, want abcde", s)
+	}
+	if b := r.Opaque(); !bytes.Equal(b, []byte{1, 2, 3, 4}) {
+		t.Errorf("Opaque = %v", b)
+	}
+	if b := r.Opaque(); len(b) != 0 || r.err != nil {
+		t.Errorf("empty Opaque = %v, %v", b, r.err)
+	}
+	// reading past the end fails and the error sticks
+	if r.Bool() || r.err == nil {
+		t.Error("Bool at the end of the message succeeded")
+	}
+
+	w = &xdrWriter{}
+	w.PutUint32(100)
+	w.PutUint32(42)
+	r = &xdrReader{r: bytes.NewReader(w.Bytes())}
+	if b := r.Opaque(); b != nil || r.err == nil {
+		t.Errorf("Opaque longer than the message = %v, %v", b, r.err)
+	}
+	if v := r.Uint32(); v != 0 {
+		t.Errorf("Uint32 after an error = %d, want 0", v)
+	}
+}
+
+func TestPortmapGetPort(t *testing.T) {
+	s, stop := startRPCServer(t, MountProgram)
+	defer stop()
+
+	port, err := portmapGetPort("127.0.0.1", MountProgram, MountVersion, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != s.port {
+		t.Errorf("GETPORT = %d, want %d", port, s.port)
+	}
+	if port, err := portmapGetPort("127.0.0.1", NlmProgram, NlmVersion, time.Second); err != nil || port != 0 {
+		t.Errorf("GETPORT of an unregistered program = %d, %v, want 0", port, err)
+	}
+	if _, err := dialRPCProgram("127.0.0.1", NlmProgram, NlmVersion, time.Second); err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("dialRPCProgram of an unregistered program: %v", err)
+	}
+
+	stop()
+	if _, err := portmapGetPort("127.0.0.1", MountProgram, MountVersion, time.Second); err == nil {
+		t.Error("GETPORT succeeded without a portmapper")
+	}
+}
+
+func TestRPCReplies(t *testing.T) {
+	s, stop := startRPCServer(t, MountProgram)
+	defer stop()
+
+	// replies split into fragments and preceded by a stale one are put back together
+	s.m.Lock()
+	s.fragment, s.stale = 3, true
+	s.m.Unlock()
+	port, err := portmapGetPort("127.0.0.1", MountProgram, MountVersion, time.Second)
+	if err != nil || port != s.port {
+		t.Errorf("GETPORT with fragmented replies = %d, %v, want %d", port, err, s.port)
+	}
+
+	tests := []struct {
+		status uint32
+		denied bool
+		want   string
+	}{
+		{1, false, "program unavailable"},
+		{5, false, "system error"},
+		{9, false, "unknown error"},
+		{0, true, "authentication error (5)"},
+	}
+	for _, tt := range tests {
+		s.m.Lock()
+		s.fragment, s.stale, s.status, s.denied = 0, false, tt.status, tt.denied
+		s.m.Unlock()
+		_, err := portmapGetPort("127.0.0.1", MountProgram, MountVersion, time.Second)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("reply with status %d, denied %v: %v, want %q", tt.status, tt.denied, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package drivers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SecretRefOpt    = "secretref"
+	PasswordFileOpt = "password_file"
+	PasswordEnvOpt  = "password_env"
+	DockerSecrets   = "/run/secrets"
+	CredentialsDir  = ".credentials"
+)
+
+// SecretProvider resolves the name part of a secret reference (<provider>:<name>) to the secret
+type SecretProvider interface {
+	Secret(name string) (string, error)
+}
+
+// SecretProviderFunc adapts a function to a SecretProvider
+type SecretProviderFunc func(name string) (string, error)
+
+func (f SecretProviderFunc) Secret(name string) (string, error) {
+	return f(name)
+}
+
+var (
+	secretsLock     = &sync.Mutex{}
+	secretProviders = map[string]SecretProvider{
+		"file":   SecretProviderFunc(fileSecret),
+		"env":    SecretProviderFunc(envSecret),
+		"docker": SecretProviderFunc(dockerSecret),
+	}
+)
+
+// RegisterSecretProvider makes provider available to references of the form name:<secret>
+func RegisterSecretProvider(name string, provider SecretProvider) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	secretProviders[name] = provider
+}
+
+// resolveSecretRef resolves a reference such as file:/run/secrets/x, env:VAR or docker:x.  Errors
+// only name the reference, never the secret.
+func resolveSecretRef(ref string) (string, error) {
+	i := strings.Index(ref, ":")
+	if i < 1 {
+		return "", fmt.Errorf("invalid secret reference %s, expected <provider>:<name>", ref)
+	}
+	secretsLock.Lock()
+	provider, found := secretProviders[ref[:i]]
+	secretsLock.Unlock()
+	if !found {
+		return "", fmt.Errorf("unknown secret provider %s in %s", ref[:i], ref)
+	}
+	secret, err := provider.Secret(ref[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("error resolving secret %s: %s", ref, err.Error())
+	}
+	return secret, nil
+}
+
+// optionSecret resolves a secret given by reference in volume options: a <prefix>_file or <prefix>_env
+// option, or the generic secretref.  It returns "" when none is set.
+func optionSecret(opts map[string]string, fileOpt, envOpt string) (string, error) {
+	switch {
+	case fileOpt != "" && opts[fileOpt] != "":
+		return resolveSecretRef("file:" + opts[fileOpt])
+	case envOpt != "" && opts[envOpt] != "":
+		return resolveSecretRef("env:" + opts[envOpt])
+	case opts[SecretRefOpt] != "":
+		return resolveSecretRef(opts[SecretRefOpt])
+	}
+	return "", nil
+}
+
+func fileSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func envSecret(name string) (string, error) {
+	v, found := os.LookupEnv(name)
+	if !found {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+func dockerSecret(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid docker secret name %s", name)
+	}
+	return fileSecret(filepath.Join(DockerSecrets, name))
+}
+
+// credentialsDir returns the private directory under root credential files are written to.  A small
+// tmpfs is mounted on it so credentials never reach the disk.
+func credentialsDir(root string) (string, error) {
+	dir := filepath.Join(root, CredentialsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	if _, fstype, _, found := procMount(dir); !found || fstype != "tmpfs" {
+		if err := run(fmt.Sprintf("mount -t tmpfs -o size=1m,mode=0700,nodev,noexec,nosuid tmpfs %s", dir)); err != nil {
+			log.Warnf("Could not mount tmpfs on %s, credential files are written to disk: %s", dir, err.Error())
+		}
+	}
+	return dir, nil
+}
+
+// writeCredentialsFile writes content to a new file readable only by root in the credentials directory
+// and returns its path.  The caller removes it once the mount is done.
+func writeCredentialsFile(root, prefix, content string) (string, error) {
+	dir, err := credentialsDir(root)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := f.Chmod(0600); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// redactOptions returns a copy of opts fit for logging
+func redactOptions(opts map[string]string) map[string]string {
+	redacted := map[string]string{}
+	for k, v := range opts {
+		if k == PasswordOpt {
+			v = "****"
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
@@ -0,0 +1,178 @@
+package drivers
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SharesDir = ".shares"
+)
+
+// shareMount is a single kernel mount of a (server, export, options) tuple which backs one or more volumes
+type shareMount struct {
+	dir     string
+	volumes map[string]bool
+}
+
+// shareManager mounts each distinct share once under a hidden directory of the driver root and
+// bind mounts volumes from it.  The share is unmounted when its last volume goes away.
+type shareManager struct {
+	root   string
+	dir    string
+	shares map[string]*shareMount
+}
+
+func newShareManager(root string) *shareManager {
+	return &shareManager{
+		root:   root,
+		dir:    filepath.Join(root, SharesDir),
+		shares: map[string]*shareMount{},
+	}
+}
+
+// shareKey builds the identity of a share mount.  It is hashed for the directory name so it may hold
+// anything that distinguishes mounts, but never secrets since it is logged.
+func shareKey(elems ...string) string {
+	return strings.Join(elems, "|")
+}
+
+// optionsKey serializes opts in a stable order, leaving out the excluded keys
+func optionsKey(opts map[string]string, exclude ...string) string {
+	keys := []string{}
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+next:
+	for _, k := range keys {
+		for _, e := range exclude {
+			if k == e {
+				continue next
+			}
+		}
+		parts = append(parts, k+"="+opts[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// Mount makes subdir of the share identified by key available at hostdir, mounting the share through
+// mount first if it is not mounted yet.
+func (s *shareManager) Mount(volume, key, subdir, hostdir string, create bool, mount func(dest string) error) error {
+	sm, found := s.shares[key]
+	if !found {
+		sm = &shareMount{
+			dir:     filepath.Join(s.dir, fmt.Sprintf("%x", sha1.Sum([]byte(key)))[:16]),
+			volumes: map[string]bool{},
+		}
+	}
+
+	if _, _, _, mounted := procMount(sm.dir); !mounted {
+		if err := createDest(sm.dir); err != nil {
+			return err
+		}
+		log.Infof("Mounting share %s on %s", key, sm.dir)
+		if err := mount(sm.dir); err != nil {
+			os.Remove(sm.dir)
+			return err
+		}
+	} else {
+		log.Infof("Using existing share mount %s for %s", sm.dir, volume)
+	}
+	s.shares[key] = sm
+
+	src := filepath.Join(sm.dir, subdir)
+	if create {
+		if err := createDest(src); err != nil {
+			s.release(key, sm)
+			return err
+		}
+	}
+
+	if err := createDest(hostdir); err != nil {
+		s.release(key, sm)
+		return err
+	}
+	if err := run(fmt.Sprintf("mount --bind %s %s", src, hostdir)); err != nil {
+		s.release(key, sm)
+		return err
+	}
+	sm.volumes[volume] = true
+	return nil
+}
+
+// Dir returns the share directory volume is bound from
+func (s *shareManager) Dir(volume string) (string, bool) {
+	for _, sm := range s.shares {
+		if sm.volumes[volume] {
+			return sm.dir, true
+		}
+	}
+	return "", false
+}
+
+// Unmount removes the bind mount of volume and the share behind it when no other volume uses it
+func (s *shareManager) Unmount(volume, hostdir string) error {
+	dev := mountDevices("/proc/self/mountinfo")[filepath.Clean(hostdir)]
+	if err := run(fmt.Sprintf("umount %s", hostdir)); err != nil {
+		return err
+	}
+
+	for key, sm := range s.shares {
+		if sm.volumes[volume] {
+			delete(sm.volumes, volume)
+			return s.release(key, sm)
+		}
+	}
+
+	// volume was mounted before a restart, look for the share by device
+	if dev != "" {
+		s.releaseOrphans(dev)
+	}
+	return nil
+}
+
+func (s *shareManager) release(key string, sm *shareMount) error {
+	if len(sm.volumes) > 0 {
+		return nil
+	}
+	delete(s.shares, key)
+	log.Infof("Last volume of share %s is gone, unmounting %s", key, sm.dir)
+	if err := run(fmt.Sprintf("umount %s", sm.dir)); err != nil {
+		return err
+	}
+	return os.Remove(sm.dir)
+}
+
+// releaseOrphans unmounts share directories on device dev that no longer back any volume
+func (s *shareManager) releaseOrphans(dev string) {
+	devs := mountDevices("/proc/self/mountinfo")
+	inUse := false
+	shares := []string{}
+	for mp, d := range devs {
+		if d != dev || !strings.HasPrefix(mp, s.root+"/") {
+			continue
+		}
+		if strings.HasPrefix(mp, s.dir+"/") {
+			shares = append(shares, mp)
+		} else {
+			inUse = true
+		}
+	}
+	if inUse {
+		return
+	}
+	for _, dir := range shares {
+		log.Infof("Unmounting unused share %s", dir)
+		if err := run(fmt.Sprintf("umount %s", dir)); err == nil {
+			os.Remove(dir)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package drivers
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	SmbPort = 445
+
+	smb2Negotiate      = 0x0000
+	smb2SessionSetup   = 0x0001
+	smb2Logoff         = 0x0002
+	smb2TreeConnect    = 0x0003
+	smb2TreeDisconnect = 0x0004
+	smb2Create         = 0x0005
+	smb2Close          = 0x0006
+	smb2Read           = 0x0008
+	smb2Write          = 0x0009
+
+	smb2FlagsResponse = 0x00000001
+	smb2FlagsAsync    = 0x00000002
+	smb2FlagsSigned   = 0x00000008
+
+	smb2SigningEnabled  = 0x0001
+	smb2SigningRequired = 0x0002
+
+	smb2SessionGuest = 0x0001
+	smb2SessionNull  = 0x0002
+
+	smb2HeaderSize = 64
+	smb2MaxMessage = 1 << 20
+)
+
+// NT status codes the SMB client acts on
+const (
+	statusSuccess             = 0x00000000
+	statusPending             = 0x00000103
+	statusBufferOverflow      = 0x80000005
+	statusMoreProcessing      = 0xc0000016
+	statusAccessDenied        = 0xc0000022
+	statusLogonFailure        = 0xc000006d
+	statusAccountRestriction  = 0xc000006e
+	statusPasswordExpired     = 0xc0000071
+	statusAccountDisabled     = 0xc0000072
+	statusNotSupported        = 0xc00000bb
+	statusBadNetworkName      = 0xc00000cc
+	statusPasswordMustChange  = 0xc0000224
+	statusAccountLockedOut    = 0xc0000234
+	statusUserSessionDeleted  = 0xc0000203
+	statusNetworkSessionExpir = 0xc000035c
+)
+
+var smbStatusText = map[uint32]string{
+	statusAccessDenied:        "access denied",
+	statusLogonFailure:        "logon failure (unknown user or bad password)",
+	statusAccountRestriction:  "account restriction",
+	statusPasswordExpired:     "password expired",
+	statusAccountDisabled:     "account disabled",
+	statusNotSupported:        "not supported",
+	statusBadNetworkName:      "bad network name",
+	statusPasswordMustChange:  "password must change",
+	statusAccountLockedOut:    "account locked out",
+	statusUserSessionDeleted:  "session deleted",
+	statusNetworkSessionExpir: "session expired",
+}
+
+// smbDialects are offered in the negotiate request, newest last
+var smbDialects = []uint16{0x0202, 0x0210, 0x0300, 0x0302, 0x0311}
+
+// smbStatusError is an NT status returned by the server
+type smbStatusError uint32
+
+func (e smbStatusError) Error() string {
+	if s, found := smbStatusText[uint32(e)]; found {
+		return s
+	}
+	return fmt.Sprintf("NT status 0x%08x", uint32(e))
+}
+
+// isSmbStatus reports whether err is the NT status code
+func isSmbStatus(err error, code uint32) bool {
+	s, ok := err.(smbStatusError)
+	return ok && uint32(s) == code
+}
+
+// smbDialectName returns a dialect as mount.cifs's vers option spells it
+func smbDialectName(d uint16) string {
+	switch d {
+	case 0x0202:
+		return "2.0"
+	case 0x0210:
+		return "2.1"
+	case 0x0300:
+		return "3.0"
+	case 0x0302:
+		return "3.02"
+	case 0x0311:
+		return "3.1.1"
+	}
+	return fmt.Sprintf("0x%04x", d)
+}
+
+// smbConn is a minimal SMB2/3 client connection: enough to authenticate, connect to a share and talk
+// to a named pipe.  It signs once a session is established but does not support encryption.
+type smbConn struct {
+	conn       net.Conn
+	host       string
+	dialect    uint16
+	messageID  uint64
+	sessionID  uint64
+	signingKey []byte
+	guest      bool
+	// preauth is the SMB 3.1.1 pre-authentication integrity hash
+	preauth []byte
+}
+
+type smbResponse struct {
+	status    uint32
+	flags     uint32
+	treeID    uint32
+	sessionID uint64
+	msg       []byte
+	body      []byte
+}
+
+// dialSMB connects to host and negotiates the dialect.  All calls on the connection must finish
+// within timeout.
+func dialSMB(host string, port int, timeout time.Duration) (*smbConn, error) {
+	if port == 0 {
+		port = SmbPort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c := &smbConn{conn: conn, host: host}
+	if err := c.negotiate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *smbConn) Close() error {
+	if c.sessionID != 0 {
+		c.call(smb2Logoff, 0, []byte{4, 0, 0, 0})
+	}
+	return c.conn.Close()
+}
+
+// Dialect returns the negotiated dialect
+func (c *smbConn) Dialect() string {
+	return smbDialectName(c.dialect)
+}
+
+func (c *smbConn) negotiate() error {
+	body := make([]byte, 36)
+	binary.LittleEndian.PutUint16(body, 36)
+	binary.LittleEndian.PutUint16(body[2:], uint16(len(smbDialects)))
+	binary.LittleEndian.PutUint16(body[4:], smb2SigningEnabled)
+	rand.Read(body[12:28])
+	for _, d := range smbDialects {
+		body = append(body, byte(d), byte(d>>8))
+	}
+	for (smb2HeaderSize+len(body))%8 != 0 {
+		body = append(body, 0)
+	}
+
+	// SMB 3.1.1 requires the pre-authentication integrity context, SHA-512 with a random salt
+	binary.LittleEndian.PutUint32(body[28:], uint32(smb2HeaderSize+len(body)))
+	binary.LittleEndian.PutUint16(body[32:], 1)
+	ctx := make([]byte, 8+6+32)
+	binary.LittleEndian.PutUint16(ctx, 1)
+	binary.LittleEndian.PutUint16(ctx[2:], 6+32)
+	binary.LittleEndian.PutUint16(ctx[8:], 1)
+	binary.LittleEndian.PutUint16(ctx[10:], 32)
+	binary.LittleEndian.PutUint16(ctx[12:], 1)
+	rand.Read(ctx[14:])
+	body = append(body, ctx...)
+
+	c.preauth = make([]byte, 64)
+	req, err := c.send(smb2Negotiate, 0, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if resp.status != statusSuccess {
+		return smbStatusError(resp.status)
+	}
+	if len(resp.body) < 64 {
+		return fmt.Errorf("short negotiate response from %s", c.host)
+	}
+	c.dialect = binary.LittleEndian.Uint16(resp.body[4:])
+	if c.dialect == 0x0311 {
+		c.updatePreauth(req)
+		c.updatePreauth(resp.msg)
+	}
+	return nil
+}
+
+// sessionSetup authenticates with NTLMv2 wrapped in SPNEGO.  An empty user logs on anonymously.
+func (c *smbConn) sessionSetup(user, pass, domain string) error {
+	ntlm := &ntlmClient{user: user, pass: pass, domain: domain}
+	token := spnegoInit(ntlm.negotiate())
+	connPreauth := c.preauth
+
+	for round := 0; round < 2; round++ {
+		body := make([]byte, 24)
+		binary.LittleEndian.PutUint16(body, 25)
+		body[3] = smb2SigningEnabled
+		binary.LittleEndian.PutUint16(body[12:], smb2HeaderSize+24)
+		binary.LittleEndian.PutUint16(body[14:], uint16(len(token)))
+		body = append(body, token...)
+
+		req, err := c.send(smb2SessionSetup, 0, body)
+		if err != nil {
+			return err
+		}
+		resp, err := c.receive()
+		if err != nil {
+			return err
+		}
+		c.sessionID = resp.sessionID
+
+		if len(resp.body) < 8 {
+			return fmt.Errorf("short session setup response from %s", c.host)
+		}
+		if resp.status == statusSuccess {
+			flags := binary.LittleEndian.Uint16(resp.body[2:])
+			c.guest = flags&(smb2SessionGuest|smb2SessionNull) != 0
+			if c.dialect == 0x0311 {
+				c.updatePreauth(req)
+			}
+			if !c.guest && !ntlm.anonymous() {
+				c.signingKey = c.deriveSigningKey(ntlm.sessionKey)
+			}
+			c.preauth = connPreauth
+			return nil
+		}
+		if resp.status != statusMoreProcessing || round > 0 {
+			c.sessionID = 0
+			return smbStatusError(resp.status)
+		}
+		if c.dialect == 0x0311 {
+			c.updatePreauth(req)
+			c.updatePreauth(resp.msg)
+		}
+
+		challenge, err := spnegoToken(smbBuffer(resp.msg, resp.body, 4))
+		if err != nil {
+			return err
+		}
+		auth, err := ntlm.authenticate(challenge)
+		if err != nil {
+			return err
+		}
+		token = spnegoResponse(auth)
+	}
+	return fmt.Errorf("session setup with %s did not complete", c.host)
+}
+
+// treeConnect connects to \\host\share and returns the tree id
+func (c *smbConn) treeConnect(share string) (uint32, error) {
+	path := utf16le(`\\` + c.host + `\` + share)
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body, 9)
+	binary.LittleEndian.PutUint16(body[4:], smb2HeaderSize+8)
+	binary.LittleEndian.PutUint16(body[6:], uint16(len(path)))
+	body = append(body, path...)
+
+	resp, err := c.call(smb2TreeConnect, 0, body)
+	if err != nil {
+		return 0, err
+	}
+	return resp.treeID, nil
+}
+
+func (c *smbConn) treeDisconnect(treeID uint32) {
+	c.call(smb2TreeDisconnect, treeID, []byte{4, 0, 0, 0})
+}
+
+// openPipe opens a named pipe on the IPC$ tree
+func (c *smbConn) openPipe(treeID uint32, name string) ([]byte, error) {
+	fname := utf16le(name)
+	body := make([]byte, 56)
+	binary.LittleEndian.PutUint16(body, 57)
+	binary.LittleEndian.PutUint32(body[4:], 2)           // impersonation
+	binary.LittleEndian.PutUint32(body[24:], 0x0012019f) // read, write, attributes, synchronize
+	binary.LittleEndian.PutUint32(body[32:], 7)          // share read, write, delete
+	binary.LittleEndian.PutUint32(body[36:], 1)          // FILE_OPEN
+	binary.LittleEndian.PutUint16(body[44:], smb2HeaderSize+56)
+	binary.LittleEndian.PutUint16(body[46:], uint16(len(fname)))
+	body = append(body, fname...)
+
+	resp, err := c.call(smb2Create, treeID, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.body) < 80 {
+		return nil, fmt.Errorf("short create response from %s", c.host)
+	}
+	return append([]byte{}, resp.body[64:80]...), nil
+}
+
+func (c *smbConn) closeFile(treeID uint32, fileID []byte) {
+	body := make([]byte, 8, 24)
+	binary.LittleEndian.PutUint16(body, 24)
+	c.call(smb2Close, treeID, append(body, fileID...))
+}
+
+func (c *smbConn) write(treeID uint32, fileID, data []byte) error {
+	body := make([]byte, 48)
+	binary.LittleEndian.PutUint16(body, 49)
+	binary.LittleEndian.PutUint16(body[2:], smb2HeaderSize+48)
+	binary.LittleEndian.PutUint32(body[4:], uint32(len(data)))
+	copy(body[16:], fileID)
+	_, err := c.call(smb2Write, treeID, append(body, data...))
+	return err
+}
+
+// read reads one message from a pipe, following STATUS_BUFFER_OVERFLOW for messages larger than a read
+func (c *smbConn) read(treeID uint32, fileID []byte) ([]byte, error) {
+	data := []byte{}
+	for {
+		body := make([]byte, 49)
+		binary.LittleEndian.PutUint16(body, 49)
+		body[2] = 0x50
+		binary.LittleEndian.PutUint32(body[4:], 65536)
+		copy(body[16:], fileID)
+
+		if _, err := c.send(smb2Read, treeID, body); err != nil {
+			return nil, err
+		}
+		resp, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		if resp.status != statusSuccess && resp.status != statusBufferOverflow {
+			return nil, smbStatusError(resp.status)
+		}
+		if len(resp.body) < 16 {
+			return nil, fmt.Errorf("short read response from %s", c.host)
+		}
+		off, l := int(resp.body[2]), int(binary.LittleEndian.Uint32(resp.body[4:]))
+		if off+l > len(resp.msg) {
+			return nil, fmt.Errorf("invalid read response from %s", c.host)
+		}
+		data = append(data, resp.msg[off:off+l]...)
+		if resp.status == statusSuccess {
+			return data, nil
+		}
+	}
+}
+
+// call sends a request and returns its response, turning an error status into an error
+func (c *smbConn) call(command uint16, treeID uint32, body []byte) (*smbResponse, error) {
+	if _, err := c.send(command, treeID, body); err != nil {
+		return nil, err
+	}
+	resp, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != statusSuccess {
+		return nil, smbStatusError(resp.status)
+	}
+	return resp, nil
+}
+
+// send writes a request and returns the message as sent
+func (c *smbConn) send(command uint16, treeID uint32, body []byte) ([]byte, error) {
+	msg := make([]byte, smb2HeaderSize, smb2HeaderSize+len(body))
+	copy(msg, []byte{0xfe, 'S', 'M', 'B'})
+	binary.LittleEndian.PutUint16(msg[4:], smb2HeaderSize)
+	if c.dialect > 0x0202 {
+		binary.LittleEndian.PutUint16(msg[6:], 1)
+	}
+	binary.LittleEndian.PutUint16(msg[12:], command)
+	binary.LittleEndian.PutUint16(msg[14:], 31)
+	binary.LittleEndian.PutUint64(msg[24:], c.messageID)
+	binary.LittleEndian.PutUint32(msg[36:], treeID)
+	binary.LittleEndian.PutUint64(msg[40:], c.sessionID)
+	msg = append(msg, body...)
+	c.messageID++
+
+	if c.signingKey != nil && command != smb2SessionSetup {
+		binary.LittleEndian.PutUint32(msg[16:], smb2FlagsSigned)
+		copy(msg[48:64], c.sign(msg))
+	}
+
+	frame := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	_, err := c.conn.Write(append(frame, msg...))
+	return msg, err
+}
+
+// receive reads the next response, skipping interim responses of async operations
+func (c *smbConn) receive() (*smbResponse, error) {
+	for {
+		frame := make([]byte, 4)
+		if _, err := io.ReadFull(c.conn, frame); err != nil {
+			return nil, err
+		}
+		l := binary.BigEndian.Uint32(frame) & 0xffffff
+		if l < smb2HeaderSize || l > smb2MaxMessage {
+			return nil, fmt.Errorf("invalid SMB2 message length %d from %s", l, c.host)
+		}
+		msg := make([]byte, l)
+		if _, err := io.ReadFull(c.conn, msg); err != nil {
+			return nil, err
+		}
+		if msg[0] != 0xfe || msg[1] != 'S' || msg[2] != 'M' || msg[3] != 'B' {
+			return nil, fmt.Errorf("%s does not speak SMB2", c.host)
+		}
+
+		resp := &smbResponse{
+			status:    binary.LittleEndian.Uint32(msg[8:]),
+			flags:     binary.LittleEndian.Uint32(msg[16:]),
+			sessionID: binary.LittleEndian.Uint64(msg[40:]),
+			msg:       msg,
+			body:      msg[smb2HeaderSize:],
+		}
+		if resp.flags&smb2FlagsAsync != 0 {
+			if resp.status == statusPending {
+				continue
+			}
+		} else {
+			resp.treeID = binary.LittleEndian.Uint32(msg[36:])
+		}
+		return resp, nil
+	}
+}
+
+// smbBuffer returns the variable part of a response given the offset of its offset/length fields
+func smbBuffer(msg, body []byte, field int) []byte {
+	if len(body) < field+4 {
+		return nil
+	}
+	off := int(binary.LittleEndian.Uint16(body[field:]))
+	l := int(binary.LittleEndian.Uint16(body[field+2:]))
+	if off+l > len(msg) {
+		return nil
+	}
+	return msg[off : off+l]
+}
+
+func (c *smbConn) updatePreauth(msg []byte) {
+	h := sha512.New()
+	h.Write(c.preauth)
+	h.Write(msg)
+	c.preauth = h.Sum(nil)
+}
+
+// deriveSigningKey derives the signing key from the session key as the dialect requires
+func (c *smbConn) deriveSigningKey(sessionKey []byte) []byte {
+	switch {
+	case c.dialect < 0x0300:
+		return sessionKey
+	case c.dialect == 0x0311:
+		return smb3KDF(sessionKey, []byte("SMBSigningKey\x00"), c.preauth)
+	default:
+		return smb3KDF(sessionKey, []byte("SMB2AESCMAC\x00"), []byte("SmbSign\x00"))
+	}
+}
+
+// sign computes the signature of msg: HMAC-SHA256 for SMB 2.x, AES-CMAC for SMB 3
+func (c *smbConn) sign(msg []byte) []byte {
+	if c.dialect < 0x0300 {
+		h := hmac.New(sha256.New, c.signingKey)
+		h.Write(msg)
+		return h.Sum(nil)[:16]
+	}
+	return aesCMAC(c.signingKey, msg)
+}
+
+// smb3KDF is the SP800-108 counter mode KDF with HMAC-SHA256 which SMB 3 derives its keys with
+func smb3KDF(key, label, context []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(label)
+	h.Write([]byte{0})
+	h.Write(context)
+	h.Write([]byte{0, 0, 0, 128})
+	return h.Sum(nil)[:16]
+}
+
+// aesCMAC implements AES-CMAC (RFC 4493)
+func aesCMAC(key, msg []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	subkey := func(b []byte) []byte {
+		k := make([]byte, 16)
+		for i := 0; i < 15; i++ {
+			k[i] = b[i]<<1 | b[i+1]>>7
+		}
+		k[15] = b[15] << 1
+		if b[0]&0x80 != 0 {
+			k[15] ^= 0x87
+		}
+		return k
+	}
+	l := make([]byte, 16)
+	block.Encrypt(l, l)
+	k1 := subkey(l)
+	k2 := subkey(k1)
+
+	n := (len(msg) + 15) / 16
+	last := make([]byte, 16)
+	if n > 0 && len(msg)%16 == 0 {
+		copy(last, msg[(n-1)*16:])
+		for i := range last {
+			last[i] ^= k1[i]
+		}
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		rest := msg[(n-1)*16:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		for i := range last {
+			last[i] ^= k2[i]
+		}
+	}
+
+	x := make([]byte, 16)
+	for i := 0; i < n-1; i++ {
+		for j := 0; j < 16; j++ {
+			x[j] ^= msg[i*16+j]
+		}
+		block.Encrypt(x, x)
+	}
+	for j := range x {
+		x[j] ^= last[j]
+	}
+	block.Encrypt(x, x)
+	return x
+}
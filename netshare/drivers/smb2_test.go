@@ -0,0 +1,60 @@
+package drivers
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// RFC 4493 section 4
+func TestAESCMAC(t *testing.T) {
+	key := "2b7e151628aed2a6abf7158809cf4f3c"
+	msg := "6bc1bee22e409f96e93d7e117393172a" + "ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52ef" + "f69f2445df4f9b17ad2b417be66c3710"
+	tests := []struct {
+		length int
+		want   string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(aesCMAC(unhex(t, key), unhex(t, msg)[:tt.length]))
+		if got != tt.want {
+			t.Errorf("aesCMAC of %d bytes = %s, want %s", tt.length, got, tt.want)
+		}
+	}
+}
+
+// SP800-108 counter mode with HMAC-SHA256 as used by SMB 3.0 signing, the vector Microsoft published
+// for "SMB2AESCMAC"/"SmbSign"
+func TestSMB3KDF(t *testing.T) {
+	sessionKey := unhex(t, "7cd451825d0450d235424e44ba6e78cc")
+	got := hex.EncodeToString(smb3KDF(sessionKey, []byte("SMB2AESCMAC\x00"), []byte("SmbSign\x00")))
+	if want := "0b7e9c5cac36c0f6ea9ab275298cedce"; got != want {
+		t.Errorf("smb3KDF = %s, want %s", got, want)
+	}
+}
+
+func TestDeriveSigningKey(t *testing.T) {
+	sessionKey := unhex(t, "7cd451825d0450d235424e44ba6e78cc")
+	c := &smbConn{dialect: 0x0202}
+	if got := hex.EncodeToString(c.deriveSigningKey(sessionKey)); got != "7cd451825d0450d235424e44ba6e78cc" {
+		t.Errorf("SMB 2.0.2 signing key = %s, want the session key", got)
+	}
+	c.dialect = 0x0300
+	if got := hex.EncodeToString(c.deriveSigningKey(sessionKey)); got != "0b7e9c5cac36c0f6ea9ab275298cedce" {
+		t.Errorf("SMB 3.0 signing key = %s", got)
+	}
+
+	// SMB 3.1.1 uses the preauth integrity hash as context, the answer is from OpenSSL's KBKDF
+	c.dialect = 0x0311
+	c.preauth = make([]byte, 64)
+	for i := range c.preauth {
+		c.preauth[i] = byte(i)
+	}
+	if got := hex.EncodeToString(c.deriveSigningKey(sessionKey)); got != "481642b8b0d9374628a7bc43f6def7b8" {
+		t.Errorf("SMB 3.1.1 signing key = %s", got)
+	}
+}
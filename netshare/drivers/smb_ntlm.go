@@ -0,0 +1,298 @@
+package drivers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	ntlmNegotiateUnicode         = 0x00000001
+	ntlmRequestTarget            = 0x00000004
+	ntlmNegotiateSign            = 0x00000010
+	ntlmNegotiateNTLM            = 0x00000200
+	ntlmNegotiateAnonymous       = 0x00000800
+	ntlmNegotiateAlwaysSign      = 0x00008000
+	ntlmNegotiateExtendedSession = 0x00080000
+	ntlmNegotiateTargetInfo      = 0x00800000
+	ntlmNegotiate128             = 0x20000000
+	ntlmNegotiate56              = 0x80000000
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var (
+	ntlmSignature = []byte("NTLMSSP\x00")
+	// OIDs of SPNEGO and the NTLMSSP mechanism, DER encoded
+	spnegoOID = []byte{0x06, 0x06, 0x2b, 0x06, 0x01, 0x05, 0x05, 0x02}
+	ntlmOID   = []byte{0x06, 0x0a, 0x2b, 0x06, 0x01, 0x04, 0x01, 0x82, 0x37, 0x02, 0x02, 0x0a}
+)
+
+// ntlmClient authenticates with NTLMv2.  An empty user authenticates anonymously.
+type ntlmClient struct {
+	user       string
+	pass       string
+	domain     string
+	flags      uint32
+	sessionKey []byte
+}
+
+func (n *ntlmClient) anonymous() bool {
+	return n.user == ""
+}
+
+// negotiate returns the NEGOTIATE_MESSAGE
+func (n *ntlmClient) negotiate() []byte {
+	n.flags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateSign | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign |
+		ntlmNegotiateExtendedSession | ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+	if n.anonymous() {
+		n.flags |= ntlmNegotiateAnonymous
+	}
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], n.flags)
+	return msg
+}
+
+// authenticate answers the server's CHALLENGE_MESSAGE with the AUTHENTICATE_MESSAGE
+func (n *ntlmClient) authenticate(challenge []byte) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, fmt.Errorf("invalid NTLM challenge")
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:]) & n.flags
+	serverChallenge := challenge[24:32]
+	targetInfo, err := ntlmField(challenge, 40)
+	if err != nil {
+		return nil, err
+	}
+
+	var lmResponse, ntResponse []byte
+	if n.anonymous() {
+		lmResponse = []byte{0}
+	} else {
+		clientChallenge := make([]byte, 8)
+		if _, err := rand.Read(clientChallenge); err != nil {
+			return nil, err
+		}
+		timestamp, found := ntlmAvPair(targetInfo, ntlmAvTimestamp)
+		if !found {
+			timestamp = make([]byte, 8)
+			binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+		}
+
+		ntResponse, n.sessionKey = ntlmv2Response(ntowfv2(n.user, n.pass, n.domain), serverChallenge, clientChallenge, timestamp, targetInfo)
+		// with a timestamp from the server the LMv2 response is zeroed
+		lmResponse = make([]byte, 24)
+	}
+
+	fields := [][]byte{lmResponse, ntResponse, utf16le(n.domain), utf16le(n.user), utf16le(""), nil}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	for i, f := range fields {
+		hdr := msg[12+8*i:]
+		binary.LittleEndian.PutUint16(hdr, uint16(len(f)))
+		binary.LittleEndian.PutUint16(hdr[2:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(len(msg)))
+		msg = append(msg, f...)
+	}
+	return msg, nil
+}
+
+// ntlmField returns the payload described by the len/maxlen/offset field at off
+func ntlmField(msg []byte, off int) ([]byte, error) {
+	l := int(binary.LittleEndian.Uint16(msg[off:]))
+	o := int(binary.LittleEndian.Uint32(msg[off+4:]))
+	if o+l > len(msg) {
+		return nil, fmt.Errorf("invalid NTLM message field")
+	}
+	return msg[o : o+l], nil
+}
+
+func ntlmAvPair(info []byte, id uint16) ([]byte, bool) {
+	for len(info) >= 4 {
+		avID, l := binary.LittleEndian.Uint16(info), int(binary.LittleEndian.Uint16(info[2:]))
+		if avID == ntlmAvEOL || len(info) < 4+l {
+			break
+		}
+		if avID == id {
+			return info[4 : 4+l], true
+		}
+		info = info[4+l:]
+	}
+	return nil, false
+}
+
+// ntlmv2Response computes the NTLMv2 response and the session base key (MS-NLMP 3.3.2)
+func ntlmv2Response(responseKey, serverChallenge, clientChallenge, timestamp, targetInfo []byte) ([]byte, []byte) {
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	proof := hmacMD5(responseKey, append(append([]byte{}, serverChallenge...), temp...))
+	return append(proof, temp...), hmacMD5(responseKey, proof)
+}
+
+func ntowfv2(user, pass, domain string) []byte {
+	return hmacMD5(md4Sum(utf16le(pass)), utf16le(strings.ToUpper(user)+domain))
+}
+
+func hmacMD5(key, data []byte) []byte {
+	h := hmac.New(md5.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func fromUTF16le(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+}
+
+// spnegoInit wraps the first NTLM token in a SPNEGO NegTokenInit
+func spnegoInit(token []byte) []byte {
+	mechTypes := derTLV(0xa0, derTLV(0x30, ntlmOID))
+	mechToken := derTLV(0xa2, derTLV(0x04, token))
+	init := derTLV(0xa0, derTLV(0x30, append(mechTypes, mechToken...)))
+	return derTLV(0x60, append(append([]byte{}, spnegoOID...), init...))
+}
+
+// spnegoResponse wraps a subsequent NTLM token in a SPNEGO NegTokenResp
+func spnegoResponse(token []byte) []byte {
+	return derTLV(0xa1, derTLV(0x30, derTLV(0xa2, derTLV(0x04, token))))
+}
+
+// spnegoToken extracts the responseToken of the server's NegTokenResp.  Servers which answer with a
+// bare NTLMSSP message are accepted as well.
+func spnegoToken(b []byte) ([]byte, error) {
+	if bytes.HasPrefix(b, ntlmSignature) {
+		return b, nil
+	}
+	tag, resp, _, err := derParse(b)
+	if err != nil || tag != 0xa1 {
+		return nil, fmt.Errorf("invalid SPNEGO response")
+	}
+	if tag, resp, _, err = derParse(resp); err != nil || tag != 0x30 {
+		return nil, fmt.Errorf("invalid SPNEGO response")
+	}
+	for len(resp) > 0 {
+		var field []byte
+		if tag, field, resp, err = derParse(resp); err != nil {
+			return nil, err
+		}
+		if tag == 0xa2 {
+			if _, token, _, err := derParse(field); err == nil {
+				return token, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func derTLV(tag byte, content []byte) []byte {
+	b := []byte{tag}
+	switch l := len(content); {
+	case l < 0x80:
+		b = append(b, byte(l))
+	case l < 0x100:
+		b = append(b, 0x81, byte(l))
+	default:
+		b = append(b, 0x82, byte(l>>8), byte(l))
+	}
+	return append(b, content...)
+}
+
+func derParse(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("short DER value")
+	}
+	tag, l, hdr := b[0], int(b[1]), 2
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 3 || len(b) < 2+n {
+			return 0, nil, nil, fmt.Errorf("invalid DER length")
+		}
+		l = 0
+		for _, c := range b[2 : 2+n] {
+			l = l<<8 | int(c)
+		}
+		hdr += n
+	}
+	if len(b) < hdr+l {
+		return 0, nil, nil, fmt.Errorf("short DER value")
+	}
+	return tag, b[hdr : hdr+l], b[hdr+l:], nil
+}
+
+// md4Sum implements MD4 (RFC 1320), which NTLM still hashes passwords with
+func md4Sum(msg []byte) []byte {
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+
+	l := uint64(len(msg)) * 8
+	msg = append(append([]byte{}, msg...), 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], l)
+
+	rotl := func(x uint32, s uint) uint32 { return x<<s | x>>(32-s) }
+	var x [16]uint32
+	for off := 0; off < len(msg); off += 64 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(msg[off+4*i:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+
+		for _, i := range []int{0, 4, 8, 12} {
+			a = rotl(a+(b&c|^b&d)+x[i], 3)
+			d = rotl(d+(a&b|^a&c)+x[i+1], 7)
+			c = rotl(c+(d&a|^d&b)+x[i+2], 11)
+			b = rotl(b+(c&d|^c&a)+x[i+3], 19)
+		}
+		for _, i := range []int{0, 1, 2, 3} {
+			a = rotl(a+(b&c|b&d|c&d)+x[i]+0x5a827999, 3)
+			d = rotl(d+(a&b|a&c|b&c)+x[i+4]+0x5a827999, 5)
+			c = rotl(c+(d&a|d&b|a&b)+x[i+8]+0x5a827999, 9)
+			b = rotl(b+(c&d|c&a|d&a)+x[i+12]+0x5a827999, 13)
+		}
+		for _, i := range []int{0, 2, 1, 3} {
+			a = rotl(a+(b^c^d)+x[i]+0x6ed9eba1, 3)
+			d = rotl(d+(a^b^c)+x[i+8]+0x6ed9eba1, 9)
+			c = rotl(c+(d^a^b)+x[i+4]+0x6ed9eba1, 11)
+			b = rotl(b+(c^d^a)+x[i+12]+0x6ed9eba1, 15)
+		}
+
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+
+	sum := make([]byte, 16)
+	binary.LittleEndian.PutUint32(sum, a)
+	binary.LittleEndian.PutUint32(sum[4:], b)
+	binary.LittleEndian.PutUint32(sum[8:], c)
+	binary.LittleEndian.PutUint32(sum[12:], d)
+	return sum
+}
@@ -0,0 +1,119 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 1320 appendix A.5
+func TestMD4(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{"a", "bde52cb31de33e46245e05fbdbd6fb24"},
+		{"abc", "a448017aaf21d8525fc10ae87aa6729d"},
+		{"message digest", "d9130a8164549fe818874806e1c7014b"},
+		{"abcdefghijklmnopqrstuvwxyz", "d79e1c308aa5bbcdeea8ed63df412da9"},
+		{"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", "043f8582f241db351ce627e153e7f0e4"},
+		{"12345678901234567890123456789012345678901234567890123456789012345678901234567890", "e33b4ddc9c38f2199c3e7b164fcc0536"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(md4Sum([]byte(tt.msg))); got != tt.want {
+			t.Errorf("md4Sum(%q) = %s, want %s", tt.msg, got, tt.want)
+		}
+	}
+}
+
+// MS-NLMP 4.2.4, user "User" of "Domain" with password "Password"
+var (
+	nlmpServerChallenge = "0123456789abcdef"
+	nlmpClientChallenge = "aaaaaaaaaaaaaaaa"
+	nlmpTimestamp       = "0000000000000000"
+	// MsvAvNbDomainName "Domain", MsvAvNbComputerName "Server", MsvAvEOL
+	nlmpTargetInfo = "02000c0044006f006d00610069006e00" + "01000c005300650072007600650072000000" + "0000"
+)
+
+func TestNTOWFv2(t *testing.T) {
+	want := "0c868a403bfd7a93a3001ef22ef02e3f"
+	if got := hex.EncodeToString(ntowfv2("User", "Password", "Domain")); got != want {
+		t.Errorf("ntowfv2 = %s, want %s", got, want)
+	}
+}
+
+func TestNTLMv2Response(t *testing.T) {
+	response, sessionKey := ntlmv2Response(ntowfv2("User", "Password", "Domain"), unhex(t, nlmpServerChallenge),
+		unhex(t, nlmpClientChallenge), unhex(t, nlmpTimestamp), unhex(t, nlmpTargetInfo))
+
+	if got, want := hex.EncodeToString(response[:16]), "68cd0ab851e51c96aabc927bebef6a1c"; got != want {
+		t.Errorf("NTProofStr = %s, want %s", got, want)
+	}
+	temp := "0101000000000000" + nlmpTimestamp + nlmpClientChallenge + "00000000" + nlmpTargetInfo + "00000000"
+	if got := hex.EncodeToString(response[16:]); got != temp {
+		t.Errorf("temp = %s, want %s", got, temp)
+	}
+	if got, want := hex.EncodeToString(sessionKey), "8de40ccadbc14a82f15cb0ad0de95ca3"; got != want {
+		t.Errorf("session base key = %s, want %s", got, want)
+	}
+}
+
+// TestAuthenticate answers a CHALLENGE_MESSAGE and checks the NT response in the AUTHENTICATE_MESSAGE
+// against the proof recomputed from the client challenge it carries
+func TestAuthenticate(t *testing.T) {
+	n := &ntlmClient{user: "User", pass: "Password", domain: "Domain"}
+	n.negotiate()
+
+	targetInfo := unhex(t, nlmpTargetInfo)
+	challenge := make([]byte, 48)
+	copy(challenge, ntlmSignature)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	binary.LittleEndian.PutUint32(challenge[20:], n.flags)
+	copy(challenge[24:], unhex(t, nlmpServerChallenge))
+	binary.LittleEndian.PutUint16(challenge[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(challenge[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(challenge[44:], uint32(len(challenge)))
+	challenge = append(challenge, targetInfo...)
+
+	msg, err := n.authenticate(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		t.Fatalf("not an AUTHENTICATE_MESSAGE: %x", msg[:12])
+	}
+	ntResponse, err := ntlmField(msg, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ntResponse) < 48 {
+		t.Fatalf("NT response too short: %d bytes", len(ntResponse))
+	}
+	timestamp, clientChallenge := ntResponse[24:32], ntResponse[32:40]
+	want, sessionKey := ntlmv2Response(ntowfv2("User", "Password", "Domain"), unhex(t, nlmpServerChallenge), clientChallenge, timestamp, targetInfo)
+	if !bytes.Equal(ntResponse, want) {
+		t.Errorf("NT response = %x, want %x", ntResponse, want)
+	}
+	if !bytes.Equal(n.sessionKey, sessionKey) {
+		t.Errorf("session key = %x, want %x", n.sessionKey, sessionKey)
+	}
+	for i, field := range []struct {
+		off  int
+		want string
+	}{{28, "Domain"}, {36, "User"}} {
+		b, err := ntlmField(msg, field.off)
+		if err != nil || fromUTF16le(b) != field.want {
+			t.Errorf("field %d = %q, want %q", i, fromUTF16le(b), field.want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package drivers
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	dcerpcRequest  = 0
+	dcerpcResponse = 2
+	dcerpcFault    = 3
+	dcerpcBind     = 11
+	dcerpcBindAck  = 12
+
+	dcerpcFirstFrag = 0x01
+	dcerpcLastFrag  = 0x02
+	dcerpcMaxFrag   = 4280
+
+	srvsvcNetrShareEnum = 15
+
+	// share types as returned by NetrShareEnum
+	STypeDisk    = 0
+	STypePrinter = 1
+	STypeDevice  = 2
+	STypeIPC     = 3
+	STypeSpecial = 0x80000000
+)
+
+var (
+	// srvsvc 4b324fc8-1670-01d3-1278-5a47bf6ee188 v3.0 and NDR 8a885d04-1ceb-11c9-9fe8-08002b104860 v2,
+	// in their little endian wire form
+	srvsvcSyntax = []byte{0xc8, 0x4f, 0x32, 0x4b, 0x70, 0x16, 0xd3, 0x01, 0x12, 0x78, 0x5a, 0x47, 0xbf, 0x6e, 0xe1, 0x88, 3, 0, 0, 0}
+	ndrSyntax    = []byte{0x04, 0x5d, 0x88, 0x8a, 0xeb, 0x1c, 0xc9, 0x11, 0x9f, 0xe8, 0x08, 0x00, 0x2b, 0x10, 0x48, 0x60, 2, 0, 0, 0}
+)
+
+// SmbShare is an entry of a server's share list
+type SmbShare struct {
+	Name    string
+	Type    uint32
+	Comment string
+}
+
+// TypeName describes the share type
+func (s SmbShare) TypeName() string {
+	names := map[uint32]string{STypeDisk: "disk", STypePrinter: "printer", STypeDevice: "device", STypeIPC: "ipc"}
+	name, found := names[s.Type&^STypeSpecial&0xffff]
+	if !found {
+		name = fmt.Sprintf("0x%x", s.Type)
+	}
+	if s.Type&STypeSpecial != 0 {
+		name = name + " (special)"
+	}
+	return name
+}
+
+// enumShares lists the shares of the server through the srvsvc pipe (NetrShareEnum, level 1)
+func (c *smbConn) enumShares() ([]SmbShare, error) {
+	treeID, err := c.treeConnect("IPC$")
+	if err != nil {
+		return nil, err
+	}
+	defer c.treeDisconnect(treeID)
+
+	pipe, err := c.openPipe(treeID, "srvsvc")
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeFile(treeID, pipe)
+
+	bind := make([]byte, 12)
+	binary.LittleEndian.PutUint16(bind, dcerpcMaxFrag)
+	binary.LittleEndian.PutUint16(bind[2:], dcerpcMaxFrag)
+	bind[8] = 1 // one presentation context
+	bind = append(bind, 0, 0, 1, 0)
+	bind = append(bind, srvsvcSyntax...)
+	bind = append(bind, ndrSyntax...)
+	if err := c.write(treeID, pipe, dcerpcPDU(dcerpcBind, 1, bind)); err != nil {
+		return nil, err
+	}
+	ack, err := c.read(treeID, pipe)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBindAck(ack); err != nil {
+		return nil, err
+	}
+
+	stub, err := c.dcerpcCall(treeID, pipe, srvsvcNetrShareEnum, netrShareEnumRequest(c.host))
+	if err != nil {
+		return nil, err
+	}
+	return parseNetrShareEnum(stub)
+}
+
+// dcerpcCall sends a request and collects the stub data of all response fragments
+func (c *smbConn) dcerpcCall(treeID uint32, pipe []byte, opnum uint16, stub []byte) ([]byte, error) {
+	req := make([]byte, 8)
+	binary.LittleEndian.PutUint32(req, uint32(len(stub)))
+	binary.LittleEndian.PutUint16(req[6:], opnum)
+	if err := c.write(treeID, pipe, dcerpcPDU(dcerpcRequest, 2, append(req, stub...))); err != nil {
+		return nil, err
+	}
+
+	data := []byte{}
+	for {
+		pdu, err := c.read(treeID, pipe)
+		if err != nil {
+			return nil, err
+		}
+		if len(pdu) < 24 {
+			return nil, fmt.Errorf("short DCE/RPC response")
+		}
+		switch pdu[2] {
+		case dcerpcResponse:
+		case dcerpcFault:
+			return nil, fmt.Errorf("DCE/RPC fault 0x%08x", binary.LittleEndian.Uint32(pdu[24:]))
+		default:
+			return nil, fmt.Errorf("unexpected DCE/RPC packet type %d", pdu[2])
+		}
+		l := int(binary.LittleEndian.Uint16(pdu[8:]))
+		if l > len(pdu) {
+			return nil, fmt.Errorf("truncated DCE/RPC response")
+		}
+		data = append(data, pdu[24:l]...)
+		if pdu[3]&dcerpcLastFrag != 0 {
+			return data, nil
+		}
+	}
+}
+
+func dcerpcPDU(ptype byte, callID uint32, body []byte) []byte {
+	pdu := []byte{5, 0, ptype, dcerpcFirstFrag | dcerpcLastFrag, 0x10, 0, 0, 0}
+	pdu = append(pdu, make([]byte, 8)...)
+	binary.LittleEndian.PutUint16(pdu[8:], uint16(16+len(body)))
+	binary.LittleEndian.PutUint32(pdu[12:], callID)
+	return append(pdu, body...)
+}
+
+func checkBindAck(pdu []byte) error {
+	if len(pdu) < 26 || pdu[2] != dcerpcBindAck {
+		return fmt.Errorf("srvsvc bind was rejected")
+	}
+	// the secondary address is followed by padding to 4 bytes and the result list
+	off := 24 + 2 + int(binary.LittleEndian.Uint16(pdu[24:]))
+	off = (off + 3) &^ 3
+	if len(pdu) < off+6 || pdu[off] == 0 {
+		return fmt.Errorf("invalid srvsvc bind acknowledgement")
+	}
+	if result := binary.LittleEndian.Uint16(pdu[off+4:]); result != 0 {
+		return fmt.Errorf("srvsvc bind was rejected (result %d)", result)
+	}
+	return nil
+}
+
+// ndrWriter encodes NDR with the alignment measured from the start of the stub
+type ndrWriter struct {
+	b        []byte
+	referent uint32
+}
+
+func (w *ndrWriter) align(n int) {
+	for len(w.b)%n != 0 {
+		w.b = append(w.b, 0)
+	}
+}
+
+func (w *ndrWriter) uint32(v uint32) {
+	w.align(4)
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	w.b = append(w.b, b...)
+}
+
+func (w *ndrWriter) pointer() {
+	w.referent += 4
+	w.uint32(0x00020000 + w.referent)
+}
+
+// stringPtr writes a unique pointer to a conformant varying, null terminated UTF-16 string
+func (w *ndrWriter) stringPtr(s string) {
+	w.pointer()
+	chars := utf16le(s + "\x00")
+	n := uint32(len(chars) / 2)
+	w.uint32(n)
+	w.uint32(0)
+	w.uint32(n)
+	w.b = append(w.b, chars...)
+	w.align(4)
+}
+
+func netrShareEnumRequest(host string) []byte {
+	w := &ndrWriter{}
+	w.stringPtr(`\\` + host)
+	w.uint32(1) // level
+	w.uint32(1) // union switch
+	w.pointer() // SHARE_INFO_1_CONTAINER
+	w.uint32(0) // entries read
+	w.uint32(0) // null buffer
+	w.uint32(0xffffffff)
+	w.pointer() // resume handle
+	w.uint32(0)
+	return w.b
+}
+
+// ndrReader decodes NDR, keeping the first error
+type ndrReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *ndrReader) uint32() uint32 {
+	r.off = (r.off + 3) &^ 3
+	if r.err != nil || r.off+4 > len(r.b) {
+		r.err = fmt.Errorf("short NetrShareEnum response")
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(r.b[r.off:])
+	r.off += 4
+	return v
+}
+
+func (r *ndrReader) string() string {
+	r.uint32() // max count
+	r.uint32() // offset
+	n := int(r.uint32())
+	if r.err != nil || r.off+2*n > len(r.b) {
+		r.err = fmt.Errorf("short NetrShareEnum response")
+		return ""
+	}
+	s := fromUTF16le(r.b[r.off : r.off+2*n])
+	r.off += 2 * n
+	return s
+}
+
+func parseNetrShareEnum(stub []byte) ([]SmbShare, error) {
+	r := &ndrReader{b: stub}
+	if level := r.uint32(); level != 1 && r.err == nil {
+		return nil, fmt.Errorf("unexpected NetrShareEnum level %d", level)
+	}
+	r.uint32() // union switch
+	shares := []SmbShare{}
+	if r.uint32() != 0 {
+		r.uint32() // entries read
+		if r.uint32() != 0 {
+			n := int(r.uint32())
+			if n > (len(stub)-r.off)/12 {
+				return nil, fmt.Errorf("invalid NetrShareEnum entry count %d", n)
+			}
+			ptrs := make([][2]uint32, n)
+			for i := 0; i < n; i++ {
+				name := r.uint32()
+				shares = append(shares, SmbShare{Type: r.uint32()})
+				ptrs[i] = [2]uint32{name, r.uint32()}
+			}
+			for i := range shares {
+				if ptrs[i][0] != 0 {
+					shares[i].Name = r.string()
+				}
+				if ptrs[i][1] != 0 {
+					shares[i].Comment = r.string()
+				}
+			}
+		}
+	}
+	r.uint32() // total entries
+	if r.uint32() != 0 {
+		r.uint32() // resume handle
+	}
+	status := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("NetrShareEnum failed with error %d", status)
+	}
+	return shares, nil
+}
@@ -2,6 +2,7 @@ package drivers
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -47,13 +48,33 @@ func shareDefinedWithVolume(name string) bool {
 	return strings.Contains(name, ShareSplitIndentifer)
 }
 
-func addShareColon(share string) string {
-	if strings.Contains(share, ":") {
-		return share
+// setMountOption sets key to value in a comma separated mount option string, replacing an existing value
+func setMountOption(opts, key, value string) string {
+	entry := key
+	if value != "" {
+		entry = key + "=" + value
 	}
-	source := strings.Split(share, "/")
-	source[0] = source[0] + ":"
-	return strings.Join(source, "/")
+	if opts == "" {
+		return entry
+	}
+	parts := strings.Split(opts, ",")
+	for i, p := range parts {
+		if p == key || strings.HasPrefix(p, key+"=") {
+			parts[i] = entry
+			return strings.Join(parts, ",")
+		}
+	}
+	return opts + "," + entry
+}
+
+// hasMountOption reports whether key is set in a comma separated mount option string
+func hasMountOption(opts, key string) bool {
+	for _, p := range strings.Split(opts, ",") {
+		if p == key || strings.HasPrefix(p, key+"=") {
+			return true
+		}
+	}
+	return false
 }
 
 func mountpoint(elem ...string) string {
@@ -61,13 +82,75 @@ func mountpoint(elem ...string) string {
 }
 
 func run(cmd string) error {
-	if out, err := exec.Command("sh", "-c", cmd).CombinedOutput(); err != nil {
-		log.Println(string(out))
+	return runEnv(cmd, nil)
+}
+
+// runEnv runs cmd with env added to the plugin's environment
+func runEnv(cmd string, env []string) error {
+	if out, err := runOutput(cmd, env); err != nil {
+		log.Println(out)
 		return err
 	}
 	return nil
 }
 
+// runOutput runs cmd with env added to the plugin's environment and returns its combined output
+func runOutput(cmd string, env []string) (string, error) {
+	c := exec.Command("sh", "-c", cmd)
+	if len(env) > 0 {
+		c.Env = append(os.Environ(), env...)
+	}
+	out, err := c.CombinedOutput()
+	return string(out), err
+}
+
+// procMount looks up dest in /proc/mounts and returns its source, file system type and options
+func procMount(dest string) (source, fstype, options string, found bool) {
+	data, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return "", "", "", false
+	}
+	dest = filepath.Clean(dest)
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 {
+			continue
+		}
+		// the last matching entry is the one on top
+		if unescapeMountField(f[1]) == dest {
+			source, fstype, options, found = unescapeMountField(f[0]), f[2], f[3], true
+		}
+	}
+	return
+}
+
+func unescapeMountField(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// mountDevices maps mount points to their major:minor device from a mountinfo file
+func mountDevices(mountinfo string) map[string]string {
+	devs := map[string]string{}
+	data, _ := ioutil.ReadFile(mountinfo)
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) > 4 {
+			devs[unescapeMountField(f[4])] = f[2]
+		}
+	}
+	return devs
+}
+
+// removeMountOption drops key, with or without a value, from a comma separated mount option string
+func removeMountOption(opts, key string) string {
+	kept := []string{}
+	for _, p := range strings.Split(opts, ",") {
+		if p != "" && p != key && !strings.HasPrefix(p, key+"=") {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, ",")
+}
+
 func merge(src, src2 map[string]string) map[string]string {
 	if len(src) == 0 && len(src2) == 0 {
 		return EmptyMap
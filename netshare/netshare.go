@@ -6,7 +6,9 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 
 	"github.com/ContainX/docker-volume-netshare/netshare/drivers"
 	"github.com/docker/docker/api/types"
@@ -30,12 +32,23 @@ const (
 	VerboseFlag      = "verbose"
 	AvailZoneFlag    = "az"
 	NoResolveFlag    = "noresolve"
+	TLSFlag          = "tls"
+	RegionFlag       = "region"
+	MetaDataFlag     = "metadata-url"
+	IPv6Flag         = "ipv6"
+	EfsEndpointFlag  = "efs-endpoint"
 	NetRCFlag        = "netrc"
+	ShareMountsFlag  = "sharemounts"
+	KeytabFlag       = "keytab"
+	PrincipalFlag    = "principal"
+	SmbVersionFlag   = "smbversion"
 	TCPFlag          = "tcp"
 	PortFlag         = "port"
 	NameServerFlag   = "nameserver"
 	NameFlag         = "name"
 	SecretFlag       = "secret"
+	SecretRefFlag    = "secretref"
+	SecretFileFlag   = "secretfile"
 	ContextFlag      = "context"
 	CephMount        = "sorcemount"
 	CephPort         = "port"
@@ -48,6 +61,10 @@ const (
 	EnvSambaSec      = "NETSHARE_CIFS_SECURITY"
 	EnvSambaFileMode = "NETSHARE_CIFS_FILEMODE"
 	EnvSambaDirMode  = "NETSHARE_CIFS_DIRMODE"
+	EnvSambaKeytab   = "NETSHARE_CIFS_KEYTAB"
+	EnvSambaPrinc    = "NETSHARE_CIFS_PRINCIPAL"
+	EnvSambaVersion  = "NETSHARE_CIFS_VERSION"
+	EnvSambaSecret   = "NETSHARE_CIFS_SECRETREF"
 	EnvNfsVers       = "NETSHARE_NFS_VERSION"
 	EnvTCP           = "NETSHARE_TCP_ENABLED"
 	EnvTCPAddr       = "NETSHARE_TCP_ADDR"
@@ -83,6 +100,20 @@ var (
 		Run:   execNFS,
 	}
 
+	nfsExportsCmd = &cobra.Command{
+		Use:   "exports <server>",
+		Short: "List the exports of an NFS server (like showmount -e)",
+		Args:  cobra.ExactArgs(1),
+		Run:   execNFSExports,
+	}
+
+	cifsSharesCmd = &cobra.Command{
+		Use:   "shares <host>",
+		Short: "List the shares of a CIFS server, testing the credentials mounts would use",
+		Args:  cobra.ExactArgs(1),
+		Run:   execCIFSShares,
+	}
+
 	efsCmd = &cobra.Command{
 		Use:   "efs",
 		Short: "run plugin in AWS EFS mode",
@@ -110,6 +141,8 @@ var (
 func Execute() {
 	setupFlags()
 	rootCmd.Long = fmt.Sprintf(NetshareHelp, Version, BuildDate)
+	nfsCmd.AddCommand(nfsExportsCmd)
+	cifsCmd.AddCommand(cifsSharesCmd)
 	rootCmd.AddCommand(versionCmd, cifsCmd, nfsCmd, efsCmd, cephCmd)
 	rootCmd.Execute()
 }
@@ -121,24 +154,39 @@ func setupFlags() {
 	rootCmd.PersistentFlags().Bool(VerboseFlag, false, "Turns on verbose logging")
 	rootCmd.PersistentFlags().StringP(DockerEngineAPI, "a", "", "Docker Engine API Version. Default to latest stable.")
 
-	cifsCmd.Flags().StringP(UsernameFlag, "u", "", "Username to use for mounts.  Can also set environment NETSHARE_CIFS_USERNAME")
-	cifsCmd.Flags().StringP(PasswordFlag, "p", "", "Password to use for mounts.  Can also set environment NETSHARE_CIFS_PASSWORD")
-	cifsCmd.Flags().StringP(DomainFlag, "d", "", "Domain to use for mounts.  Can also set environment NETSHARE_CIFS_DOMAIN")
-	cifsCmd.Flags().StringP(SecurityFlag, "s", "", "Security mode to use for mounts (mount.cifs's sec option). Can also set environment NETSHARE_CIFS_SECURITY.")
-	cifsCmd.Flags().StringP(FileModeFlag, "f", "", "Setting access rights for files (mount.cifs's file_mode option). Can also set environment NETSHARE_CIFS_FILEMODE.")
-	cifsCmd.Flags().StringP(DirModeFlag, "z", "", "Setting access rights for folders (mount.cifs's dir_mode option). Can also set environment NETSHARE_CIFS_DIRMODE.")
-	cifsCmd.Flags().StringP(NetRCFlag, "", os.Getenv("HOME"), "The default .netrc location.  Default is the user.home directory")
+	cifsCmd.PersistentFlags().StringP(UsernameFlag, "u", "", "Username to use for mounts.  Can also set environment NETSHARE_CIFS_USERNAME")
+	cifsCmd.PersistentFlags().StringP(PasswordFlag, "p", "", "Password to use for mounts.  Can also set environment NETSHARE_CIFS_PASSWORD")
+	cifsCmd.PersistentFlags().StringP(DomainFlag, "d", "", "Domain to use for mounts.  Can also set environment NETSHARE_CIFS_DOMAIN")
+	cifsCmd.PersistentFlags().StringP(SecurityFlag, "s", "", "Security mode to use for mounts (mount.cifs's sec option). Can also set environment NETSHARE_CIFS_SECURITY.")
+	cifsCmd.PersistentFlags().StringP(FileModeFlag, "f", "", "Setting access rights for files (mount.cifs's file_mode option). Can also set environment NETSHARE_CIFS_FILEMODE.")
+	cifsCmd.PersistentFlags().StringP(DirModeFlag, "z", "", "Setting access rights for folders (mount.cifs's dir_mode option). Can also set environment NETSHARE_CIFS_DIRMODE.")
+	cifsCmd.PersistentFlags().StringP(NetRCFlag, "", os.Getenv("HOME"), "The default .netrc location.  Default is the user.home directory")
 	cifsCmd.Flags().StringP(OptionsFlag, "o", "", "Options passed to Cifs mounts (ex: nounix,uid=433)")
+	cifsCmd.PersistentFlags().String(KeytabFlag, "", "Kerberos keytab used to mount with sec=krb5.  Can also set environment NETSHARE_CIFS_KEYTAB")
+	cifsCmd.PersistentFlags().String(PrincipalFlag, "", "Kerberos principal to obtain tickets for from the keytab.  Can also set environment NETSHARE_CIFS_PRINCIPAL")
+	cifsCmd.PersistentFlags().String(SecretRefFlag, "", "Secret reference (file:<path>, env:<var> or docker:<name>) to read the password from whenever it is needed, so rotated passwords are picked up.  Can also set environment NETSHARE_CIFS_SECRETREF")
+	cifsCmd.Flags().String(SmbVersionFlag, "", "SMB protocol version (mount.cifs's vers option) or auto to try 3.1.1, 3.0 and 2.1.  Can also set environment NETSHARE_CIFS_VERSION")
+	cifsCmd.Flags().Bool(ShareMountsFlag, false, "Mount each share once and bind mount volumes from it")
 
 	nfsCmd.Flags().IntP(VersionFlag, "v", 4, "NFS Version to use [3 | 4]. Can also be set with NETSHARE_NFS_VERSION")
 	nfsCmd.Flags().StringP(OptionsFlag, "o", "", fmt.Sprintf("Options passed to nfs mounts (ex: %s)", drivers.DefaultNfsV3))
+	nfsCmd.Flags().Bool(ShareMountsFlag, false, "Mount each export once and bind mount volumes from it")
 
 	efsCmd.Flags().String(AvailZoneFlag, "", "AWS Availability zone [default: \"\", looks up via metadata]")
-	efsCmd.Flags().String(NameServerFlag, "", "Custom DNS nameserver.  [default \"\", uses /etc/resolv.conf]")
+	efsCmd.Flags().String(RegionFlag, "", "AWS Region.  Can also be set with AWS_REGION [default: \"\", looks up via metadata]")
+	efsCmd.Flags().String(MetaDataFlag, "", "Base URL of the instance metadata service.  Can also be set with AWS_EC2_METADATA_SERVICE_ENDPOINT [default: http://169.254.169.254]")
+	efsCmd.Flags().String(NameServerFlag, "", "Custom DNS nameservers, comma separated and tried in turn.  [default \"\", uses /etc/resolv.conf]")
+	efsCmd.Flags().Bool(IPv6Flag, false, "Resolve mount targets to IPv6 addresses first")
+	efsCmd.Flags().String(EfsEndpointFlag, "", "EFS API endpoint used to provision file systems.  Can also be set with AWS_ENDPOINT_URL_EFS [default: the regional endpoint]")
 	efsCmd.Flags().Bool(NoResolveFlag, false, "Indicates EFS mount sources are IP Addresses vs File System ID")
-
-	cephCmd.Flags().StringP(NameFlag, "n", "admin", "Username to use for ceph mount.")
-	cephCmd.Flags().StringP(SecretFlag, "s", "NoneProvided", "Password to use for Ceph Mount.")
+	efsCmd.Flags().Bool(TLSFlag, false, "Encrypt mounts in transit through a local TLS tunnel to the mount target.  Volumes can override with the tls option")
+	efsCmd.Flags().StringP(OptionsFlag, "o", "", fmt.Sprintf("Options passed to nfs mounts of EFS [default: %s]", drivers.DefaultEfsOptions))
+	efsCmd.Flags().Bool(ShareMountsFlag, false, "Mount each file system once and bind mount volumes from it")
+
+	cephCmd.Flags().StringP(NameFlag, "n", "admin", "Cephx client to mount as, volumes can override with the name option.")
+	cephCmd.Flags().StringP(SecretFlag, "s", "", "Cephx key of the client.  Prefer --secretfile or --secretref, flags are visible in the process list.")
+	cephCmd.Flags().String(SecretRefFlag, "", "Secret reference (file:<path>, env:<var> or docker:<name>) to read the Ceph secret from at mount time. Overrides --secret.")
+	cephCmd.Flags().String(SecretFileFlag, "", "File holding the cephx key of the client, passed to mount.ceph.  Overrides --secretref and --secret [default: the key from /etc/ceph/ceph.client.<name>.keyring]")
 	cephCmd.Flags().StringP(ContextFlag, "c", "system_u:object_r:tmp_t:s0", "SELinux  Context of Ceph Mount.")
 	cephCmd.Flags().StringP(CephMount, "m", "10.0.0.1", "Address of Ceph source mount.")
 	cephCmd.Flags().StringP(CephPort, "p", "6789", "Port to use for ceph mount.")
@@ -164,24 +212,23 @@ func setDockerEnv() {
 
 func execCEPH(cmd *cobra.Command, args []string) {
 	username, _ := cmd.Flags().GetString(NameFlag)
-	password, _ := cmd.Flags().GetString(SecretFlag)
+	secret, _ := cmd.Flags().GetString(SecretFlag)
+	secretref, _ := cmd.Flags().GetString(SecretRefFlag)
+	secretfile, _ := cmd.Flags().GetString(SecretFileFlag)
 	context, _ := cmd.Flags().GetString(ContextFlag)
 	cephmount, _ := cmd.Flags().GetString(CephMount)
 	cephport, _ := cmd.Flags().GetString(CephPort)
 	servermount, _ := cmd.Flags().GetString(ServerMount)
 	cephopts, _ := cmd.Flags().GetString(CephOpts)
 	setDockerEnv()
-	if len(username) > 0 {
-		username = "name=" + username
-	}
-	if len(password) > 0 {
-		password = "secret=" + password
+	if len(secret) > 0 {
+		log.Warnf("--%s is visible in the process list, consider --%s or --%s", SecretFlag, SecretFileFlag, SecretRefFlag)
 	}
 	if len(context) > 0 {
 		context = "context=" + "\"" + context + "\""
 	}
 	mount := syncDockerState("ceph")
-	d := drivers.NewCephDriver(rootForType(drivers.CEPH), username, password, context, cephmount, cephport, servermount, cephopts, mount)
+	d := drivers.NewCephDriver(rootForType(drivers.CEPH), username, secret, secretref, secretfile, context, cephmount, cephport, servermount, cephopts, mount)
 	start(drivers.CEPH, d)
 }
 
@@ -196,45 +243,101 @@ func execNFS(cmd *cobra.Command, args []string) {
 		}
 	}
 	options, _ := cmd.Flags().GetString(OptionsFlag)
+	sharemounts, _ := cmd.Flags().GetBool(ShareMountsFlag)
 	mount := syncDockerState("nfs")
-	d := drivers.NewNFSDriver(rootForType(drivers.NFS), version, options, mount)
-	startOutput(fmt.Sprintf("NFS Version %d :: options: '%s'", version, options))
+	d := drivers.NewNFSDriver(rootForType(drivers.NFS), version, options, sharemounts, mount)
+	startOutput(fmt.Sprintf("NFS Version %d :: options: '%s', sharemounts: %v", version, options, sharemounts))
 	start(drivers.NFS, d)
 }
 
+func execCIFSShares(cmd *cobra.Command, args []string) {
+	netrc, _ := cmd.Flags().GetString(NetRCFlag)
+	creds, envCreds := cifsCredentials(cmd)
+	probe, err := drivers.ProbeCifsServer(args[0], creds, envCreds, netrc)
+	if probe != nil {
+		user := probe.User
+		if user == "" || probe.Guest {
+			user = "guest"
+		}
+		fmt.Printf("Connected to %s with SMB %s as %s (credentials: %s)\n", args[0], probe.Dialect, user, probe.CredentialSource)
+	}
+	if err != nil {
+		log.Fatalf("Error listing shares for %s: %s", args[0], err.Error())
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	for _, s := range probe.Shares {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, s.TypeName(), s.Comment)
+	}
+	w.Flush()
+}
+
+func execNFSExports(cmd *cobra.Command, args []string) {
+	exports, err := drivers.NfsExports(args[0])
+	if err != nil {
+		log.Fatalf("Error listing exports for %s: %s", args[0], err.Error())
+	}
+	fmt.Printf("Export list for %s:\n", args[0])
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	for _, e := range exports {
+		groups := drivers.EveryoneGroup
+		if len(e.Groups) > 0 {
+			groups = strings.Join(e.Groups, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\n", e.Dir, groups)
+	}
+	w.Flush()
+}
+
 func execEFS(cmd *cobra.Command, args []string) {
 	resolve, _ := cmd.Flags().GetBool(NoResolveFlag)
 	ns, _ := cmd.Flags().GetString(NameServerFlag)
+	az, _ := cmd.Flags().GetString(AvailZoneFlag)
+	region, _ := cmd.Flags().GetString(RegionFlag)
+	metadata, _ := cmd.Flags().GetString(MetaDataFlag)
+	tls, _ := cmd.Flags().GetBool(TLSFlag)
+	ipv6, _ := cmd.Flags().GetBool(IPv6Flag)
+	endpoint, _ := cmd.Flags().GetString(EfsEndpointFlag)
+	options, _ := cmd.Flags().GetString(OptionsFlag)
+	sharemounts, _ := cmd.Flags().GetBool(ShareMountsFlag)
 	setDockerEnv()
 	mount := syncDockerState("efs")
-	d := drivers.NewEFSDriver(rootForType(drivers.EFS), ns, !resolve, mount)
-	startOutput(fmt.Sprintf("EFS :: resolve: %v, ns: %s", resolve, ns))
+	d, err := drivers.NewEFSDriver(rootForType(drivers.EFS), ns, region, az, metadata, endpoint, options, !resolve, tls, ipv6, sharemounts, mount)
+	if err != nil {
+		log.Fatalf("Error resolving AWS region: %s", err.Error())
+	}
+	startOutput(fmt.Sprintf("EFS :: resolve: %v, ns: %s, region: %s, az: %s, tls: %v", resolve, ns, region, az, tls))
 	start(drivers.EFS, d)
 }
 
 func execCIFS(cmd *cobra.Command, args []string) {
-	user := typeOrEnv(cmd, UsernameFlag, EnvSambaUser)
-	pass := typeOrEnv(cmd, PasswordFlag, EnvSambaPass)
-	domain := typeOrEnv(cmd, DomainFlag, EnvSambaWG)
-	security := typeOrEnv(cmd, SecurityFlag, EnvSambaSec)
-	fileMode := typeOrEnv(cmd, FileModeFlag, EnvSambaFileMode)
-	dirMode := typeOrEnv(cmd, DirModeFlag, EnvSambaDirMode)
+	smbversion := typeOrEnv(cmd, SmbVersionFlag, EnvSambaVersion)
 	netrc, _ := cmd.Flags().GetString(NetRCFlag)
 	options, _ := cmd.Flags().GetString(OptionsFlag)
+	sharemounts, _ := cmd.Flags().GetBool(ShareMountsFlag)
 
 	setDockerEnv()
-	creds := drivers.NewCifsCredentials(user, pass, domain, security, fileMode, dirMode)
+	creds, envCreds := cifsCredentials(cmd)
 
 	mount := syncDockerState("cifs")
-	d := drivers.NewCIFSDriver(rootForType(drivers.CIFS), creds, netrc, options, mount)
-	if len(user) > 0 {
-		startOutput(fmt.Sprintf("CIFS :: %s, opts: %s", creds, options))
-	} else {
-		startOutput(fmt.Sprintf("CIFS :: netrc: %s, opts: %s", netrc, options))
-	}
+	d := drivers.NewCIFSDriver(rootForType(drivers.CIFS), creds, envCreds, netrc, options, smbversion, sharemounts, mount)
+	startOutput(fmt.Sprintf("CIFS :: flags: %s, env: %s, netrc: %s, opts: %s, smbversion: %s", creds, envCreds, netrc, options, smbversion))
 	start(drivers.CIFS, d)
 }
 
+// cifsCredentials returns the credentials given as daemon flags and those from the environment.  They are
+// kept apart since .netrc entries are looked up in between.
+func cifsCredentials(cmd *cobra.Command) (*drivers.CifsCreds, *drivers.CifsCreds) {
+	flag := func(name string) string {
+		val, _ := cmd.Flags().GetString(name)
+		return val
+	}
+	creds := drivers.NewCifsCredentials(flag(UsernameFlag), flag(PasswordFlag), flag(DomainFlag), flag(SecurityFlag),
+		flag(FileModeFlag), flag(DirModeFlag), flag(KeytabFlag), flag(PrincipalFlag), flag(SecretRefFlag))
+	envCreds := drivers.NewCifsCredentials(os.Getenv(EnvSambaUser), os.Getenv(EnvSambaPass), os.Getenv(EnvSambaWG), os.Getenv(EnvSambaSec),
+		os.Getenv(EnvSambaFileMode), os.Getenv(EnvSambaDirMode), os.Getenv(EnvSambaKeytab), os.Getenv(EnvSambaPrinc), os.Getenv(EnvSambaSecret))
+	return creds, envCreds
+}
+
 func startOutput(info string) {
 	log.Infof("== docker-volume-netshare :: Version: %s - Built: %s ==", Version, BuildDate)
 	log.Infof("Starting %s", info)
@@ -303,7 +406,7 @@ func syncDockerState(driverName string) *drivers.MountManager {
 		}
 		connections := activeConnections(vol.Name)
 		log.Infof("Recovered state: %s , %s , %s , %s , %d ", vol.Name, vol.Mountpoint, vol.Driver, vol.CreatedAt, connections)
-		mount.AddMount(vol.Name, vol.Mountpoint, connections)
+		mount.AddMount(vol.Name, vol.Mountpoint, connections, vol.Options)
 	}
 	return mount
 }